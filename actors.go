@@ -0,0 +1,535 @@
+//Actors: the state-owning goroutine from statefulgoroutines.go, made generic
+/*
+statefulgoroutines.go keeps a map inside one goroutine, and everyone else talks to it through readOp and writeOp structs, each with its own resp channel. That is an actor: a goroutine that owns some state and handles one message at a time from its mailbox. No mutex is needed, because only the actor ever touches the state.
+
+Written by hand, every new actor repeats the same loop, and a few things are missing:
+
+the reads and writes channels are unbuffered, so every sender waits until the actor gets to it; and there is no way to say "I'll wait at most 10ms"
+if a handler panics, the whole program dies; if it just stopped, every sender would block forever
+the actor can never be stopped; main ends with time.Sleep(time.Second)
+
+Actor[S, M] is that loop written once, for any state S and message type M:
+
+1. A bounded mailbox. Send blocks while it is full (back-pressure: a fast sender is slowed down to the speed of the actor) until its context is done; TrySend returns ErrMailboxFull instead of blocking
+2. Request/reply: Ask sends a message that carries a reply channel and waits for the answer or for its context, whichever comes first. The reply channel is buffered, so an actor answering a caller that has given up never blocks (the desk from conpatterncancelcontext.go). If the actor crashes on the message, Ask returns the CrashError instead of waiting for an answer that will never come
+3. Supervision: if Receive panics or returns an error, the actor has crashed. The message is dropped, the state is rebuilt with Recover, and the actor goes on with the next message - up to MaxRestarts times, then it stops and Err says why
+4. State recovery: after every message handled without a crash, Checkpoint is called with the new state and the message. What it saves is up to the actor: a copy of the state, or (cheaper) a journal of the messages that changed it. Recover starts from that
+5. Stop stops taking messages, handles the ones already in the mailbox and waits for the actor to finish
+
+KV[K, V] is the map from statefulgoroutines.go on top of Actor. Its Checkpoint keeps a journal of writes, so after a crash Recover replays the journal and no acknowledged write is lost. Only the last write to each key matters for that, so the journal is compacted as it is written: it holds one value per key that is still there, never more, however many writes there were.
+
+go run actors.go
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrMailboxFull is returned by TrySend when the mailbox has no room.
+	ErrMailboxFull = errors.New("actor: mailbox full")
+	// ErrActorStopped is returned when a message is sent to an actor that has stopped.
+	ErrActorStopped = errors.New("actor: stopped")
+	// ErrTooManyRestarts is the Err of an actor that crashed more often than MaxRestarts allows.
+	ErrTooManyRestarts = errors.New("actor: too many restarts")
+)
+
+// ActorConfig describes an actor with state S that handles messages M.
+type ActorConfig[S, M any] struct {
+	// Mailbox is how many messages can wait for the actor. Less than 1 means 1.
+	Mailbox int
+	// Receive handles one message and returns the new state. A panic or an error crashes the actor.
+	Receive func(ctx context.Context, state S, msg M) (S, error)
+	// Recover returns the state to start with, at the start and after every crash.
+	Recover func() (S, error)
+	// Checkpoint, if set, is called with the new state after every message that did not crash the actor.
+	Checkpoint func(state S, msg M)
+	// MaxRestarts is how many crashes the actor survives.
+	MaxRestarts int
+	// OnCrash, if set, is called with every crash and the message that caused it.
+	OnCrash func(msg M, err error)
+}
+
+// Actor runs ActorConfig.Receive for one message at a time on its own goroutine.
+type Actor[S, M any] struct {
+	cfg     ActorConfig[S, M]
+	mailbox chan envelope[M]
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	err     error
+
+	restarts atomic.Int64
+}
+
+// envelope is a message in the mailbox. crashed, if set, is told the CrashError if Receive crashes on msg.
+type envelope[M any] struct {
+	msg     M
+	crashed chan<- error
+}
+
+// CrashError is a panic or error from Receive.
+type CrashError struct {
+	Panic any
+	Err   error
+}
+
+func (e *CrashError) Error() string {
+	if e.Err != nil {
+		return "actor crashed: " + e.Err.Error()
+	}
+	return fmt.Sprintf("actor crashed: panic: %v", e.Panic)
+}
+
+func (e *CrashError) Unwrap() error {
+	return e.Err
+}
+
+// Spawn starts an actor. ctx is passed to Receive; when it is done the actor stops.
+func Spawn[S, M any](ctx context.Context, cfg ActorConfig[S, M]) (*Actor[S, M], error) {
+	if cfg.Mailbox < 1 {
+		cfg.Mailbox = 1
+	}
+	state, err := cfg.Recover()
+	if err != nil {
+		return nil, err
+	}
+	a := &Actor[S, M]{cfg: cfg, mailbox: make(chan envelope[M], cfg.Mailbox), stop: make(chan struct{}), done: make(chan struct{})}
+	go a.loop(ctx, state)
+	return a, nil
+}
+
+func (a *Actor[S, M]) loop(ctx context.Context, state S) {
+	defer close(a.done)
+	for {
+		select {
+		case env := <-a.mailbox:
+			var err error
+			if state, err = a.handle(ctx, state, env); err != nil {
+				a.err = err
+				return
+			}
+		case <-a.stop:
+			//handle what is already in the mailbox, then stop
+			for {
+				select {
+				case env := <-a.mailbox:
+					var err error
+					if state, err = a.handle(ctx, state, env); err != nil {
+						a.err = err
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-ctx.Done():
+			a.err = context.Cause(ctx)
+			return
+		}
+	}
+}
+
+// handle runs Receive for msg, and restarts the actor if it crashes. The error is only set if the actor has to stop.
+func (a *Actor[S, M]) handle(ctx context.Context, state S, env envelope[M]) (S, error) {
+	next, crash := a.receive(ctx, state, env.msg)
+	if crash == nil {
+		if a.cfg.Checkpoint != nil {
+			a.cfg.Checkpoint(next, env.msg)
+		}
+		return next, nil
+	}
+	if env.crashed != nil {
+		//buffered, like the reply channel
+		env.crashed <- crash
+	}
+	if a.cfg.OnCrash != nil {
+		a.cfg.OnCrash(env.msg, crash)
+	}
+	if a.restarts.Add(1) > int64(a.cfg.MaxRestarts) {
+		return state, fmt.Errorf("%w: %w", ErrTooManyRestarts, crash)
+	}
+	//the state may have been half changed before the crash; start again from what Checkpoint saved
+	recovered, err := a.cfg.Recover()
+	if err != nil {
+		return state, fmt.Errorf("actor: recover after crash: %w", err)
+	}
+	return recovered, nil
+}
+
+func (a *Actor[S, M]) receive(ctx context.Context, state S, msg M) (next S, crash error) {
+	defer func() {
+		if v := recover(); v != nil {
+			crash = &CrashError{Panic: v}
+		}
+	}()
+	next, err := a.cfg.Receive(ctx, state, msg)
+	if err != nil {
+		return next, &CrashError{Err: err}
+	}
+	return next, nil
+}
+
+// Send puts msg in the mailbox, waiting while it is full until ctx is done.
+func (a *Actor[S, M]) Send(ctx context.Context, msg M) error {
+	return a.send(ctx, envelope[M]{msg: msg})
+}
+
+func (a *Actor[S, M]) send(ctx context.Context, env envelope[M]) error {
+	select {
+	case <-a.stop:
+		return ErrActorStopped
+	case <-a.done:
+		return ErrActorStopped
+	default:
+	}
+	select {
+	case a.mailbox <- env:
+		return nil
+	case <-a.stop:
+		return ErrActorStopped
+	case <-a.done:
+		return ErrActorStopped
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// TrySend puts msg in the mailbox if there is room, and returns ErrMailboxFull if there is not.
+func (a *Actor[S, M]) TrySend(msg M) error {
+	select {
+	case <-a.stop:
+		return ErrActorStopped
+	case <-a.done:
+		return ErrActorStopped
+	default:
+	}
+	select {
+	case a.mailbox <- envelope[M]{msg: msg}:
+		return nil
+	default:
+		return ErrMailboxFull
+	}
+}
+
+// Stop stops taking new messages, lets the actor handle the ones already in its mailbox, and waits until it has.
+// A message sent at the same moment as Stop may be dropped.
+func (a *Actor[S, M]) Stop() error {
+	a.once.Do(func() { close(a.stop) })
+	<-a.done
+	return a.err
+}
+
+// Done is closed when the actor has stopped.
+func (a *Actor[S, M]) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns why the actor stopped: nil after Stop, ErrTooManyRestarts, or the cause of its context.
+// It may only be called after Done is closed.
+func (a *Actor[S, M]) Err() error {
+	return a.err
+}
+
+// Restarts returns how many times the actor has crashed.
+func (a *Actor[S, M]) Restarts() int {
+	return int(a.restarts.Load())
+}
+
+// Ask sends the message made by build, which must carry the reply channel it is given, and waits for the reply.
+// If the actor crashes on the message, Ask returns the *CrashError.
+func Ask[S, M, R any](ctx context.Context, a *Actor[S, M], build func(reply chan<- R) M) (R, error) {
+	var zero R
+	//buffered, so the actor never blocks on a caller that has given up
+	reply := make(chan R, 1)
+	crashed := make(chan error, 1)
+	if err := a.send(ctx, envelope[M]{msg: build(reply), crashed: crashed}); err != nil {
+		return zero, err
+	}
+	select {
+	case r := <-reply:
+		return r, nil
+	case err := <-crashed:
+		return zero, err
+	case <-a.done:
+		//the actor may have answered just before it stopped
+		select {
+		case r := <-reply:
+			return r, nil
+		default:
+			return zero, ErrActorStopped
+		}
+	case <-ctx.Done():
+		return zero, context.Cause(ctx)
+	}
+}
+
+type kvOpKind int
+
+const (
+	kvGet kvOpKind = iota
+	kvSet
+	kvDelete
+	kvUpdate
+	kvLen
+)
+
+// kvOp is readOp and writeOp from statefulgoroutines.go in one struct.
+type kvOp[K comparable, V any] struct {
+	kind  kvOpKind
+	key   K
+	val   V
+	fn    func(V, bool) V
+	reply chan<- kvReply[V]
+}
+
+type kvReply[V any] struct {
+	val V
+	ok  bool
+	n   int
+}
+
+// KV is a map owned by an actor.
+type KV[K comparable, V any] struct {
+	actor *Actor[map[K]V, kvOp[K, V]]
+	//journal holds the last write that was handled for every key that is still there, which is all Recover needs
+	//to rebuild the map; only the actor's goroutine touches it, in Checkpoint and Recover
+	journal map[K]V
+}
+
+// NewKV starts a KV with the given mailbox size.
+func NewKV[K comparable, V any](ctx context.Context, mailbox, maxRestarts int) *KV[K, V] {
+	kv := &KV[K, V]{journal: make(map[K]V)}
+	a, _ := Spawn(ctx, ActorConfig[map[K]V, kvOp[K, V]]{
+		Mailbox:     mailbox,
+		MaxRestarts: maxRestarts,
+		Receive: func(ctx context.Context, state map[K]V, op kvOp[K, V]) (map[K]V, error) {
+			var r kvReply[V]
+			switch op.kind {
+			case kvGet:
+				r.val, r.ok = state[op.key]
+			case kvSet:
+				state[op.key] = op.val
+			case kvDelete:
+				delete(state, op.key)
+			case kvUpdate:
+				old, ok := state[op.key]
+				r.val = op.fn(old, ok)
+				state[op.key] = r.val
+			case kvLen:
+				r.n = len(state)
+			}
+			op.reply <- r
+			return state, nil
+		},
+		Checkpoint: func(state map[K]V, op kvOp[K, V]) {
+			//a write replaces the one before it for the same key, and a delete drops it: the journal is compacted as it goes
+			switch op.kind {
+			case kvSet:
+				kv.journal[op.key] = op.val
+			case kvDelete:
+				delete(kv.journal, op.key)
+			case kvUpdate:
+				//journal the value Update stored, not the func, so replaying it cannot crash again
+				kv.journal[op.key] = state[op.key]
+			}
+		},
+		Recover: func() (map[K]V, error) {
+			//a copy: Receive changes the state it is given in place
+			return maps.Clone(kv.journal), nil
+		},
+	})
+	kv.actor = a
+	return kv
+}
+
+func (kv *KV[K, V]) ask(ctx context.Context, op kvOp[K, V]) (kvReply[V], error) {
+	return Ask(ctx, kv.actor, func(reply chan<- kvReply[V]) kvOp[K, V] {
+		op.reply = reply
+		return op
+	})
+}
+
+// Get returns the value for key and whether it was there.
+func (kv *KV[K, V]) Get(ctx context.Context, key K) (V, bool, error) {
+	r, err := kv.ask(ctx, kvOp[K, V]{kind: kvGet, key: key})
+	return r.val, r.ok, err
+}
+
+// Set stores val under key.
+func (kv *KV[K, V]) Set(ctx context.Context, key K, val V) error {
+	_, err := kv.ask(ctx, kvOp[K, V]{kind: kvSet, key: key, val: val})
+	return err
+}
+
+// Delete removes key.
+func (kv *KV[K, V]) Delete(ctx context.Context, key K) error {
+	_, err := kv.ask(ctx, kvOp[K, V]{kind: kvDelete, key: key})
+	return err
+}
+
+// Update replaces the value for key with fn(old, found), atomically, and returns the new value.
+// fn runs inside the actor; if it panics, the actor restarts and the value is left as it was.
+func (kv *KV[K, V]) Update(ctx context.Context, key K, fn func(old V, found bool) V) (V, error) {
+	r, err := kv.ask(ctx, kvOp[K, V]{kind: kvUpdate, key: key, fn: fn})
+	return r.val, err
+}
+
+// Len returns the number of keys.
+func (kv *KV[K, V]) Len(ctx context.Context) (int, error) {
+	r, err := kv.ask(ctx, kvOp[K, V]{kind: kvLen})
+	return r.n, err
+}
+
+// Stop stops the actor behind the KV.
+func (kv *KV[K, V]) Stop() error {
+	return kv.actor.Stop()
+}
+
+// Restarts returns how many times the actor behind the KV has crashed.
+func (kv *KV[K, V]) Restarts() int {
+	return kv.actor.Restarts()
+}
+
+func main() {
+	ctx := context.Background()
+
+	//statefulgoroutines.go again: 100 readers and 10 writers on 5 keys, now through KV
+	kv := NewKV[int, int](ctx, 16, 0)
+	var readOps, writeOps atomic.Uint64
+	runCtx, stop := context.WithTimeout(ctx, 200*time.Millisecond)
+	var wg sync.WaitGroup
+	for r := 0; r < 100; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for runCtx.Err() == nil {
+				if _, _, err := kv.Get(runCtx, rand.Intn(5)); err == nil {
+					readOps.Add(1)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for runCtx.Err() == nil {
+				if err := kv.Set(runCtx, rand.Intn(5), rand.Intn(100)); err == nil {
+					writeOps.Add(1)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	//no time.Sleep(time.Second) and hope: the context ends the work, and the WaitGroup waits for it
+	wg.Wait()
+	stop()
+	n, _ := kv.Len(ctx)
+	fmt.Println("readOps > 0:", readOps.Load() > 0, "writeOps > 0:", writeOps.Load() > 0, "keys:", n)
+	kv.Stop()
+
+	//a crash in the middle of an update: the actor restarts, replays its journal, and no acknowledged write is lost
+	prices := NewKV[string, int](ctx, 4, 3)
+	prices.Set(ctx, "vanilla", 3)
+	prices.Set(ctx, "chocolate", 4)
+	//the actor drops the message it crashed on and never answers it, but Ask is told about the crash:
+	//Update returns even with a context that never ends
+	_, err := prices.Update(ctx, "vanilla", func(old int, _ bool) int {
+		panic("price list on fire")
+	})
+	var crash *CrashError
+	fmt.Println("update that crashed:", err, errors.As(err, &crash))
+	v, _, _ := prices.Get(ctx, "vanilla")
+	c, _, _ := prices.Get(ctx, "chocolate")
+	fmt.Println("after restart: vanilla", v, "chocolate", c, "restarts", prices.Restarts())
+	v, _ = prices.Update(ctx, "vanilla", func(old int, _ bool) int { return old + 1 })
+	fmt.Println("vanilla after a good update:", v)
+	//a thousand writes to the same few keys leave one journal entry per key
+	for i := range 1000 {
+		prices.Set(ctx, fmt.Sprint("flavour ", i%3), i)
+	}
+	prices.Delete(ctx, "flavour 0")
+	//Stop first, so reading the journal does not race with the actor
+	prices.Stop()
+	fmt.Println("journal after 1000 more writes and a delete:", len(prices.journal))
+
+	//an actor that is stuck until the gate opens, with a mailbox of 2: TrySend is turned away, Send waits (back-pressure)
+	//its messages are optional reply channels, so Ask can ask it how many messages it has handled
+	gate := make(chan struct{})
+	busy, _ := Spawn(ctx, ActorConfig[int, chan<- int]{
+		Mailbox: 2,
+		Recover: func() (int, error) { return 0, nil },
+		Receive: func(ctx context.Context, handled int, reply chan<- int) (int, error) {
+			<-gate
+			handled++
+			if reply != nil {
+				reply <- handled
+			}
+			return handled, nil
+		},
+	})
+	busy.Send(ctx, nil)
+	//let the actor take the first message off the mailbox and get stuck on it
+	time.Sleep(10 * time.Millisecond)
+	var full int
+	for i := 0; i < 5; i++ {
+		if errors.Is(busy.TrySend(nil), ErrMailboxFull) {
+			full++
+		}
+	}
+	fmt.Println("TrySend turned away:", full, "of 5")
+	sendCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	fmt.Println("Send while full:", busy.Send(sendCtx, nil))
+	cancel()
+	close(gate)
+	handled, err := Ask(ctx, busy, func(reply chan<- int) chan<- int { return reply })
+	fmt.Println("Ask after the gate opened: handled", handled, err)
+	fmt.Println("Stop:", busy.Stop())
+
+	//an actor that crashes on every message gives up after MaxRestarts
+	var crashes []string
+	bad, _ := Spawn(ctx, ActorConfig[int, int]{
+		MaxRestarts: 2,
+		Recover:     func() (int, error) { return 0, nil },
+		Receive: func(ctx context.Context, s, msg int) (int, error) {
+			return s, fmt.Errorf("cannot handle %d", msg)
+		},
+		OnCrash: func(msg int, err error) { crashes = append(crashes, err.Error()) },
+	})
+	for i := 1; i <= 5; i++ {
+		bad.Send(ctx, i)
+	}
+	<-bad.Done()
+	fmt.Println("crashes:", crashes)
+	fmt.Println("Err:", bad.Err())
+}
+
+/*
+Result
+go run actors.go
+
+readOps > 0: true writeOps > 0: true keys: 5
+update that crashed: actor crashed: panic: price list on fire true
+after restart: vanilla 3 chocolate 4 restarts 1
+vanilla after a good update: 4
+journal after 1000 more writes and a delete: 4
+TrySend turned away: 3 of 5
+Send while full: context deadline exceeded
+Ask after the gate opened: handled 4 <nil>
+Stop: <nil>
+crashes: [actor crashed: cannot handle 1 actor crashed: cannot handle 2 actor crashed: cannot handle 3]
+Err: actor: too many restarts: actor crashed: cannot handle 3
+
+The busy actor handled its first message, the two that fit in the mailbox, and the Ask: 4. Messages 4 and 5 to the bad actor were never handled; it had already given up.
+*/
@@ -0,0 +1,381 @@
+//Adaptive concurrency limits: the drop pattern from conpatterndrop.go, with a capacity that tunes itself
+/*
+conpatterndrop.go uses a constant capacity, cap = 100. Where does 100 come from? If the service behind us gets slower (a cold cache, a busy database), 100 requests in flight is too many: they all queue up and every one of them is slow. If it gets faster, 100 is too few and we drop work we could have done.
+
+The answer from TCP congestion control: measure. We watch how long each request takes (its round-trip time, RTT). While the limit is below what the service can handle, RTT stays flat. Once we go over, requests start queueing inside the service and RTT goes up. So:
+
+AIMD (additive increase, multiplicative decrease) - the TCP classic. Every request that comes back fast and without error raises the limit by one. A slow or failed request cuts it by a fraction (say to 90%). It probes upwards slowly and backs off quickly.
+
+Gradient (TCP Vegas style) - keep the smallest RTT seen (minRTT, the RTT with no queueing at all) and compare each new RTT with it. gradient = minRTT / RTT is 1 when nothing is queued and drops below 1 as the queue grows. The new limit is limit * gradient plus a little headroom (the square root of the limit) so it keeps probing. It settles near the real capacity instead of oscillating around it.
+
+AdaptiveLimiter is used like the buffered channel in conpatterndrop.go: Acquire either lets a request in or tells us to drop it. When the request finishes, we call the function Acquire returned, and that is where the RTT is measured.
+
+main runs a simulation of a service whose capacity changes halfway through and prints how the limit follows it, then the same limiter in front of an HTTP handler.
+
+go run adaptivelimiter.go
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// LimitAlgorithm turns measurements into a new concurrency limit.
+type LimitAlgorithm interface {
+	// Update is called for every finished request with its RTT, the number of requests that were in flight when it
+	// started, and whether it failed in a way that means "too much load" (a timeout, a 503). It returns the new limit.
+	Update(rtt time.Duration, inflight int, dropped bool) int
+	// Limit returns the current limit.
+	Limit() int
+}
+
+// AIMD raises the limit by one after every fast success and multiplies it by Backoff after a slow or dropped request.
+type AIMD struct {
+	Min, Max int
+	// Backoff is the factor applied on overload, like 0.9.
+	Backoff float64
+	// Threshold is the RTT above which a request counts as overload.
+	Threshold time.Duration
+
+	limit float64
+}
+
+// NewAIMD starts at initial, moved into [min, max]. A min below 1 is taken as 1: with a limit of 0 nothing gets in,
+// so no RTT is ever measured and the limit could never grow again.
+func NewAIMD(initial, min, max int, backoff float64, threshold time.Duration) *AIMD {
+	if min < 1 {
+		min = 1
+	}
+	return &AIMD{Min: min, Max: max, Backoff: backoff, Threshold: threshold, limit: startLimit(initial, min, max)}
+}
+
+// startLimit is initial moved into [lo, hi]; lo wins if hi is below it.
+func startLimit(initial, lo, hi int) float64 {
+	return float64(max(lo, min(hi, initial)))
+}
+
+func (a *AIMD) Update(rtt time.Duration, inflight int, dropped bool) int {
+	switch {
+	case dropped || rtt > a.Threshold:
+		a.limit *= a.Backoff
+	case float64(inflight)*2 >= a.limit:
+		//only grow when we are actually using the limit; a mostly idle client says nothing about capacity
+		a.limit++
+	}
+	a.limit = math.Max(float64(a.Min), math.Min(float64(a.Max), a.limit))
+	return a.Limit()
+}
+
+func (a *AIMD) Limit() int {
+	return int(a.limit)
+}
+
+// Gradient adjusts the limit by the ratio of the no-load RTT to the measured RTT.
+type Gradient struct {
+	Min, Max int
+	// Smoothing is how much of each new estimate is taken, between 0 and 1. Small values react slowly but steadily.
+	Smoothing float64
+	// Tolerance lets RTT grow to Tolerance * minRTT before the limit is reduced. 1 means no tolerance.
+	Tolerance float64
+	// ProbeEvery resets minRTT after that many samples, so a service that got permanently slower is not measured
+	// against an RTT it will never reach again. Zero means never.
+	ProbeEvery int
+
+	limit   float64
+	minRTT  time.Duration
+	samples int
+}
+
+// NewGradient starts at initial, moved into [min, max]. A min below 1 is taken as 1, as in NewAIMD.
+func NewGradient(initial, min, max int) *Gradient {
+	if min < 1 {
+		min = 1
+	}
+	return &Gradient{Min: min, Max: max, Smoothing: 0.2, Tolerance: 1, ProbeEvery: 500, limit: startLimit(initial, min, max)}
+}
+
+func (g *Gradient) Update(rtt time.Duration, inflight int, dropped bool) int {
+	g.samples++
+	if g.ProbeEvery > 0 && g.samples%g.ProbeEvery == 0 {
+		g.minRTT = 0
+	}
+	if g.minRTT == 0 || rtt < g.minRTT {
+		g.minRTT = rtt
+	}
+	if dropped {
+		g.limit *= 0.9
+	} else {
+		gradient := math.Max(0.5, math.Min(1, g.Tolerance*float64(g.minRTT)/float64(rtt)))
+		queue := math.Sqrt(g.limit)
+		next := g.limit*gradient + queue
+		if next > g.limit && float64(inflight)*2 < g.limit {
+			//app-limited: don't grow on samples that never came close to the limit
+			next = g.limit
+		}
+		g.limit = g.limit*(1-g.Smoothing) + next*g.Smoothing
+	}
+	g.limit = math.Max(float64(g.Min), math.Min(float64(g.Max), g.limit))
+	return g.Limit()
+}
+
+func (g *Gradient) Limit() int {
+	return int(g.limit)
+}
+
+// ErrLimitExceeded is returned by Do when the limiter drops the call.
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// AdaptiveLimiter lets at most Limit() calls run at once, and learns the limit from their RTTs.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	alg      LimitAlgorithm
+	inflight int
+	now      func() time.Time
+}
+
+// NewAdaptiveLimiter returns a limiter driven by alg.
+func NewAdaptiveLimiter(alg LimitAlgorithm) *AdaptiveLimiter {
+	return &AdaptiveLimiter{alg: alg, now: time.Now}
+}
+
+// Acquire lets a call in if there is room under the limit. If ok, done must be called exactly once when the call has
+// finished, with dropped set if it failed because of overload.
+func (l *AdaptiveLimiter) Acquire() (done func(dropped bool), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= l.alg.Limit() {
+		return nil, false
+	}
+	l.inflight++
+	inflight := l.inflight
+	start := l.now()
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			rtt := l.now().Sub(start)
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.inflight--
+			l.alg.Update(rtt, inflight, dropped)
+		})
+	}, true
+}
+
+// Do runs f under the limiter. It returns ErrLimitExceeded without running f if there is no room.
+// Errors from f that match context.DeadlineExceeded count as overload.
+func (l *AdaptiveLimiter) Do(ctx context.Context, f func(context.Context) error) error {
+	done, ok := l.Acquire()
+	if !ok {
+		return ErrLimitExceeded
+	}
+	err := f(ctx)
+	done(errors.Is(err, context.DeadlineExceeded))
+	return err
+}
+
+// Limit returns the current limit.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.alg.Limit()
+}
+
+// Inflight returns the number of calls running now.
+func (l *AdaptiveLimiter) Inflight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight
+}
+
+type limitStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *limitStatusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Handler wraps next so that requests over the limit get 503 straight away. A 503 or 504 from next, or a request
+// whose context ran out, counts as overload.
+func (l *AdaptiveLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done, ok := l.Acquire()
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		sw := &limitStatusWriter{ResponseWriter: w}
+		defer func() {
+			dropped := sw.status == http.StatusServiceUnavailable || sw.status == http.StatusGatewayTimeout ||
+				errors.Is(r.Context().Err(), context.DeadlineExceeded)
+			done(dropped)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// simulate drives alg against a pretend service for steps rounds and returns the limit after every round.
+/*
+The service handles capacity(step) requests at once in base time. Above that, requests queue, so RTT grows in proportion: with twice the capacity in flight, every request takes twice as long. The client always has more work than the limit allows, so in every round it sends exactly limit requests, and they all take the same time - so one sample per round says all there is to say.
+
+This uses no goroutines and no clock, so the result is the same every time.
+*/
+func simulate(alg LimitAlgorithm, steps int, base time.Duration, capacity func(step int) int) []int {
+	var trace []int
+	for step := 0; step < steps; step++ {
+		inflight := alg.Limit()
+		c := capacity(step)
+		rtt := base
+		if inflight > c {
+			rtt = time.Duration(float64(base) * float64(inflight) / float64(c))
+		}
+		//the service sheds what is far over its capacity
+		dropped := inflight > 3*c
+		alg.Update(rtt, inflight, dropped)
+		trace = append(trace, alg.Limit())
+	}
+	return trace
+}
+
+// settled checks that every limit in trace[from:to] is within [lo, hi], and stands in for a test assertion.
+func settled(name string, trace []int, from, to, lo, hi int) {
+	least, most := trace[from], trace[from]
+	for _, l := range trace[from:to] {
+		least, most = min(least, l), max(most, l)
+	}
+	result := "ok  "
+	if least < lo || most > hi {
+		result = "FAIL"
+	}
+	fmt.Printf("  %s %s, rounds %d-%d: %d..%d, want within [%d, %d]\n", result, name, from+1, to, least, most, lo, hi)
+}
+
+func main() {
+	//capacity 40 for the first 100 rounds, then the service slows down to 15
+	capacity := func(step int) int {
+		if step < 100 {
+			return 40
+		}
+		return 15
+	}
+	base := 10 * time.Millisecond
+	show := func(name string, trace []int) {
+		fmt.Printf("%-9s", name)
+		for i := 19; i < len(trace); i += 20 {
+			fmt.Printf("%5d", trace[i])
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%-9s", "round")
+	for i := 20; i <= 200; i += 20 {
+		fmt.Printf("%5d", i)
+	}
+	fmt.Println()
+	aimd := simulate(NewAIMD(5, 1, 1000, 0.9, 15*time.Millisecond), 200, base, capacity)
+	gradient := simulate(NewGradient(5, 1, 1000), 200, base, capacity)
+	show("AIMD", aimd)
+	show("Gradient", gradient)
+	//once settled, before and after the slowdown: AIMD saws between the capacity and its threshold of 1.5 x base,
+	//Gradient stays within two square roots above the capacity
+	for _, phase := range []struct{ from, to, capacity int }{{60, 100, 40}, {120, 200, 15}} {
+		c := phase.capacity
+		settled("AIMD", aimd, phase.from, phase.to, c, c*8/5)
+		settled("Gradient", gradient, phase.from, phase.to, c, c+int(2*math.Sqrt(float64(c))))
+	}
+	//a limit of 0 would let nothing in, and then nothing could raise it again
+	floor := NewGradient(1, 0, 10)
+	floor.Update(time.Second, 1, true)
+	fmt.Println("  min 0 is taken as", floor.Min, "- limit after an overload at 1:", floor.Limit())
+	//nor may it start at 0, or above max: initial is moved into [min, max]
+	fmt.Println("  initial 0 starts at", NewAIMD(0, 0, 1000, 0.9, 15*time.Millisecond).Limit(), NewGradient(0, 0, 1000).Limit(),
+		"- initial 5000 with max 1000 at", NewAIMD(5000, 1, 1000, 0.9, 15*time.Millisecond).Limit(), NewGradient(5000, 1, 1000).Limit())
+	//and from 0 both still find the capacity of 40
+	steady := func(int) int { return 40 }
+	settled("AIMD from 0", simulate(NewAIMD(0, 0, 1000, 0.9, 15*time.Millisecond), 100, base, steady), 60, 100, 40, 64)
+	settled("Gradient from 0", simulate(NewGradient(0, 0, 1000), 100, base, steady), 60, 100, 40, 52)
+
+	//in front of an HTTP handler that can do 10 requests at once in 5ms, and gets slower the busier it is past that
+	var mu sync.Mutex
+	busy := 0
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		busy++
+		n := busy
+		mu.Unlock()
+		d := 5 * time.Millisecond
+		if n > 10 {
+			d = d * time.Duration(n) / 10
+		}
+		time.Sleep(d)
+		mu.Lock()
+		busy--
+		mu.Unlock()
+	})
+	g := NewGradient(50, 1, 200)
+	//real RTTs jitter, so give them some room before calling it queueing
+	g.Tolerance = 1.5
+	lim := NewAdaptiveLimiter(g)
+	srv := httptest.NewServer(lim.Handler(backend))
+	defer srv.Close()
+	var wg sync.WaitGroup
+	codes := make(chan int, 2000)
+	for c := 0; c < 40; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					continue
+				}
+				resp.Body.Close()
+				codes <- resp.StatusCode
+			}
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	count := map[int]int{}
+	for c := range codes {
+		count[c]++
+	}
+	fmt.Println("http: limit settled at", lim.Limit(), "responses", count)
+}
+
+/*
+Result
+go run adaptivelimiter.go
+
+round       20   40   60   80  100  120  140  160  180  200
+AIMD        25   45   57   56   55   22   22   22   22   22
+Gradient    17   38   47   47   47   20   20   19   19   20
+  ok   AIMD, rounds 61-100: 55..61, want within [40, 64]
+  ok   Gradient, rounds 61-100: 46..47, want within [40, 52]
+  ok   AIMD, rounds 121-200: 20..23, want within [15, 24]
+  ok   Gradient, rounds 121-200: 19..20, want within [15, 22]
+  min 0 is taken as 1 - limit after an overload at 1: 1
+  initial 0 starts at 1 1 - initial 5000 with max 1000 at 1000 1000
+  ok   AIMD from 0, rounds 61-100: 54..61, want within [40, 64]
+  ok   Gradient from 0, rounds 61-100: 45..47, want within [40, 52]
+
+Both start at 5. AIMD climbs past the capacity of 40 until RTT crosses its threshold (1.5 x base, so it stops around 1.5 x capacity, sawing up and down), then falls back when the service slows to 15. Gradient settles just above the capacity - capacity plus the square root of the limit as headroom - and follows the drop to 15 within a few rounds. The checks pin those settled ranges down, so a change to either algorithm that moves them shows up as FAIL. Without the floor of 1, the overload would have cut the limit from 1 to 0 (0.9, rounded down).
+
+http: limit settled at 22 responses map[200:1941 503:59]   (changes from run to run)
+*/
@@ -0,0 +1,525 @@
+//Metrics registry: the atomic counter from atomic.go, with names, more kinds, and a way to read them all
+/*
+atomic.go counts with one uint64 and atomic.AddUint64, and statefulgoroutines.go does the same twice, for readOps and writeOps. Each demo declares its own variables and prints them by hand. A registry gives every number a name and one place to read them all from:
+
+Counter - only goes up. atomic.Uint64 (the typed version of atomic.AddUint64 on a uint64)
+Gauge - goes up and down: goroutines running, items queued. atomic.Int64
+StripedCounter - a Counter for hot paths that many goroutines hit at once. See below
+Histogram - counts observations (like latencies) into fixed buckets, so we can see how they are spread, not just the average. Every bucket is an atomic, so Observe never takes a lock; the sum is a float64 kept in an atomic.Uint64 and updated with CompareAndSwap
+
+Why striped? An atomic add is not free when many cores do it to the same counter: the cache line holding it has to move from core to core, and only one core can own it at a time. With 32 cores all counting requests, that one cache line is the bottleneck. StripedCounter keeps several counters, each padded to its own 64-byte cache line, and every Add picks one at random. Adds on different cores mostly hit different cache lines. Load adds all the stripes up, so reading is slower - fine for a counter that is written a million times a second and read once every few seconds.
+
+The registry itself is a map behind a mutex, but it is only used to create or look up a metric. Code keeps the *Counter it got back and calls Add on it directly; the hot path never touches the mutex.
+
+Snapshot copies every value at once into plain structs, and WriteText writes them in the Prometheus text format, as middlewarechain.go does for HTTP metrics. Histogram.Observe, formatFloat and the lines WriteText writes for a histogram come from middlewarechain.go's histogram: every demo here is a program of its own, run with go run on one file, so they are copied and not shared.
+
+go run atomicmetrics.go
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a number that only goes up.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc adds one.
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add adds n.
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+// Load returns the count.
+func (c *Counter) Load() uint64 { return c.v.Load() }
+
+// Gauge is a number that goes up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+
+// Add adds n, which may be negative.
+func (g *Gauge) Add(n int64) { g.v.Add(n) }
+
+// Inc adds one.
+func (g *Gauge) Inc() { g.v.Add(1) }
+
+// Dec subtracts one.
+func (g *Gauge) Dec() { g.v.Add(-1) }
+
+// Load returns the value.
+func (g *Gauge) Load() int64 { return g.v.Load() }
+
+// cacheLine is the size of a cache line on amd64 and most arm64 cores.
+const cacheLine = 64
+
+// stripe is one counter alone on its cache line, so that two stripes never share one.
+type stripe struct {
+	v atomic.Uint64
+	_ [cacheLine - 8]byte
+}
+
+// StripedCounter is a Counter spread over several cache lines, for counters that many goroutines add to at once.
+type StripedCounter struct {
+	stripes []stripe
+}
+
+// NewStripedCounter returns a counter with four stripes per CPU, rounded up to a power of two.
+func NewStripedCounter() *StripedCounter {
+	n := 1
+	for n < 4*runtime.GOMAXPROCS(0) {
+		n *= 2
+	}
+	return &StripedCounter{stripes: make([]stripe, n)}
+}
+
+// Add adds n to a random stripe. math/rand/v2's top-level functions keep their state per thread, so picking the
+// stripe does not become a shared cache line itself.
+func (c *StripedCounter) Add(n uint64) {
+	c.stripes[rand.Uint32()&uint32(len(c.stripes)-1)].v.Add(n)
+}
+
+// Inc adds one.
+func (c *StripedCounter) Inc() { c.Add(1) }
+
+// Load returns the sum of all stripes. Adds that happen while Load runs may or may not be counted.
+func (c *StripedCounter) Load() uint64 {
+	var sum uint64
+	for i := range c.stripes {
+		sum += c.stripes[i].v.Load()
+	}
+	return sum
+}
+
+// Histogram counts observations into fixed buckets without taking a lock.
+type Histogram struct {
+	bounds  []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+// LatencyBuckets are histogram bounds in seconds, from 100µs to 10s.
+var LatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	//as in middlewarechain.go: buckets are stored non-cumulative and summed in Snapshot; values above the last bound
+	//only count in count
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// ObserveDuration records d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// HistogramSnapshot is a copy of a Histogram. Counts are cumulative: Counts[i] is the number of observations <= Bounds[i].
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+// Snapshot copies the histogram. Observations made while it runs may be counted in some buckets and not others.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{Bounds: h.bounds, Counts: make([]uint64, len(h.bounds))}
+	var cum uint64
+	for i := range h.counts {
+		cum += h.counts[i].Load()
+		s.Counts[i] = cum
+	}
+	s.Count = h.count.Load()
+	s.Sum = math.Float64frombits(h.sumBits.Load())
+	return s
+}
+
+// Quantile estimates the q-quantile (0 <= q <= 1) by linear interpolation inside the bucket it falls in, as
+// Prometheus's histogram_quantile does. It returns NaN if there are no observations.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(s.Count)
+	lower, below := 0.0, uint64(0)
+	for i, c := range s.Counts {
+		if float64(c) >= rank {
+			inBucket := c - below
+			if inBucket == 0 {
+				return s.Bounds[i]
+			}
+			return lower + (s.Bounds[i]-lower)*(rank-float64(below))/float64(inBucket)
+		}
+		lower, below = s.Bounds[i], c
+	}
+	//in the overflow bucket: the best we can say is "above the last bound"
+	if len(s.Bounds) == 0 {
+		return math.Inf(1)
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+// MetricKind says what kind of metric a registry entry is.
+type MetricKind int
+
+const (
+	// KindCounter is a Counter or a StripedCounter.
+	KindCounter MetricKind = iota
+	// KindGauge is a Gauge.
+	KindGauge
+	// KindHistogram is a Histogram.
+	KindHistogram
+)
+
+func (k MetricKind) String() string {
+	return [...]string{"counter", "gauge", "histogram"}[k]
+}
+
+type registered struct {
+	kind    MetricKind
+	help    string
+	counter interface{ Load() uint64 }
+	gauge   *Gauge
+	hist    *Histogram
+}
+
+// Registry holds named metrics. Asking for a name twice returns the same metric.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*registered
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*registered)}
+}
+
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// lookup returns the metric called name, creating it with create if there is none. Asking for a name that exists with
+// another kind, or a name Prometheus would not accept, is a programming error, so it panics.
+func (r *Registry) lookup(name, help string, kind MetricKind, create func() *registered) *registered {
+	if !metricName.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid name %q", name))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.metrics[name]
+	if !ok {
+		m = create()
+		m.kind, m.help = kind, help
+		r.metrics[name] = m
+	}
+	if m.kind != kind {
+		panic(fmt.Sprintf("metrics: %s is a %s, not a %s", name, m.kind, kind))
+	}
+	return m
+}
+
+// Counter returns the counter called name.
+func (r *Registry) Counter(name, help string) *Counter {
+	m := r.lookup(name, help, KindCounter, func() *registered { return &registered{counter: new(Counter)} })
+	c, ok := m.counter.(*Counter)
+	if !ok {
+		panic(fmt.Sprintf("metrics: %s is a striped counter", name))
+	}
+	return c
+}
+
+// StripedCounter returns the striped counter called name.
+func (r *Registry) StripedCounter(name, help string) *StripedCounter {
+	m := r.lookup(name, help, KindCounter, func() *registered { return &registered{counter: NewStripedCounter()} })
+	c, ok := m.counter.(*StripedCounter)
+	if !ok {
+		panic(fmt.Sprintf("metrics: %s is not a striped counter", name))
+	}
+	return c
+}
+
+// Gauge returns the gauge called name.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	return r.lookup(name, help, KindGauge, func() *registered { return &registered{gauge: new(Gauge)} }).gauge
+}
+
+// Histogram returns the histogram called name. bounds are only used the first time; nil or empty means LatencyBuckets.
+func (r *Registry) Histogram(name, help string, bounds []float64) *Histogram {
+	return r.lookup(name, help, KindHistogram, func() *registered {
+		if len(bounds) == 0 {
+			bounds = LatencyBuckets
+		}
+		bounds = append([]float64(nil), bounds...)
+		sort.Float64s(bounds)
+		return &registered{hist: &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}}
+	}).hist
+}
+
+// MetricSnapshot is the value of one metric at the time of Snapshot. Value is set for counters and gauges,
+// Histogram for histograms.
+type MetricSnapshot struct {
+	Name      string
+	Help      string
+	Kind      MetricKind
+	Value     float64
+	Histogram HistogramSnapshot
+}
+
+// Snapshot returns every metric, sorted by name.
+func (r *Registry) Snapshot() []MetricSnapshot {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	ms := make([]*registered, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		ms[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	//the values are read after the mutex is released: metrics never go away, and reading them is lock-free
+	out := make([]MetricSnapshot, len(names))
+	for i, m := range ms {
+		s := MetricSnapshot{Name: names[i], Help: m.help, Kind: m.kind}
+		switch m.kind {
+		case KindCounter:
+			s.Value = float64(m.counter.Load())
+		case KindGauge:
+			s.Value = float64(m.gauge.Load())
+		case KindHistogram:
+			s.Histogram = m.hist.Snapshot()
+		}
+		out[i] = s
+	}
+	return out
+}
+
+// Get returns the snapshot of the metric called name from a Snapshot.
+func Get(snap []MetricSnapshot, name string) (MetricSnapshot, bool) {
+	i := sort.Search(len(snap), func(i int) bool { return snap[i].Name >= name })
+	if i < len(snap) && snap[i].Name == name {
+		return snap[i], true
+	}
+	return MetricSnapshot{}, false
+}
+
+// helpEscaper escapes HELP text as the Prometheus text format wants it: a backslash as \\ and a newline as \n, so a
+// help string cannot end its line early.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// WriteText writes a snapshot of every metric to w in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, m := range r.Snapshot() {
+		if m.Help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", m.Name, helpEscaper.Replace(m.Help))
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.Name, m.Kind)
+		if m.Kind != KindHistogram {
+			fmt.Fprintf(&b, "%s %s\n", m.Name, formatFloat(m.Value))
+			continue
+		}
+		h := m.Histogram
+		for i, le := range h.Bounds {
+			fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", m.Name, formatFloat(le), h.Counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", m.Name, h.Count)
+		fmt.Fprintf(&b, "%s_sum %s\n", m.Name, formatFloat(h.Sum))
+		fmt.Fprintf(&b, "%s_count %d\n", m.Name, h.Count)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func main() {
+	reg := NewRegistry()
+
+	//atomic.go: 50 goroutines add 1000 each, to a Counter and to a StripedCounter
+	ops := reg.Counter("ops_total", "Operations counted by atomic.go.")
+	striped := reg.StripedCounter("ops_striped_total", "The same operations, on a striped counter.")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := 0; c < 1000; c++ {
+				ops.Inc()
+				striped.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Println("ops:", ops.Load(), "striped:", striped.Load())
+
+	//statefulgoroutines.go: readers and writers on a state-owning goroutine, with real stats instead of two uint64s
+	readOps := reg.Counter("state_reads_total", "Reads served by the state goroutine.")
+	writeOps := reg.Counter("state_writes_total", "Writes served by the state goroutine.")
+	waiting := reg.Gauge("state_waiting", "Goroutines waiting for the state goroutine right now.")
+	latency := reg.Histogram("state_op_seconds", "Time from sending a request to getting the answer.", nil)
+	//one struct for reads and writes: a write increments the key, so it needs no value
+	type stateOp struct {
+		key  int
+		resp chan int
+	}
+	reads := make(chan stateOp)
+	writes := make(chan stateOp)
+	done := make(chan struct{})
+	go func() {
+		state := make(map[int]int)
+		for {
+			select {
+			case read := <-reads:
+				read.resp <- state[read.key]
+			case write := <-writes:
+				state[write.key]++
+				write.resp <- 0
+			case <-done:
+				return
+			}
+		}
+	}()
+	op := func(ch chan stateOp, count *Counter) {
+		waiting.Inc()
+		start := time.Now()
+		o := stateOp{key: rand.IntN(5), resp: make(chan int)}
+		ch <- o
+		<-o.resp
+		latency.ObserveDuration(time.Since(start))
+		waiting.Dec()
+		count.Inc()
+	}
+	for r := 0; r < 100; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				op(reads, readOps)
+			}
+		}()
+	}
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				op(writes, writeOps)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	snap := reg.Snapshot()
+	h, _ := Get(snap, "state_op_seconds")
+	fmt.Printf("state ops: %d, median %.0fµs, p99 %.0fµs\n", h.Histogram.Count,
+		h.Histogram.Quantile(0.5)*1e6, h.Histogram.Quantile(0.99)*1e6)
+
+	//asking for the same name gives the same metric; asking for it as another kind is a bug
+	fmt.Println("same counter:", reg.Counter("ops_total", "") == ops)
+	func() {
+		defer func() { fmt.Println("recovered:", recover()) }()
+		reg.Gauge("ops_total", "")
+	}()
+
+	//no bounds at all gets the default ones, not a histogram with only the overflow bucket
+	noBounds := NewRegistry().Histogram("no_bounds_seconds", "", []float64{})
+	noBounds.Observe(0.003)
+	fmt.Println("empty bounds: median", noBounds.Snapshot().Quantile(0.5), "of", len(noBounds.bounds), "buckets")
+
+	//help text with a backslash and a line break stays on its one HELP line
+	reg.Gauge("spool_files", "Files waiting in C:\\spool.\nCounted once a minute.").Set(3)
+
+	fmt.Println()
+	reg.WriteText(os.Stdout)
+}
+
+/*
+Result
+go run atomicmetrics.go
+
+ops: 50000 striped: 50000
+state ops: 5500, median 50µs, p99 99µs
+same counter: true
+recovered: metrics: ops_total is a counter, not a gauge
+empty bounds: median 0.00375 of 16 buckets
+
+# HELP ops_striped_total The same operations, on a striped counter.
+# TYPE ops_striped_total counter
+ops_striped_total 50000
+# HELP ops_total Operations counted by atomic.go.
+# TYPE ops_total counter
+ops_total 50000
+# HELP spool_files Files waiting in C:\\spool.\nCounted once a minute.
+# TYPE spool_files gauge
+spool_files 3
+# HELP state_op_seconds Time from sending a request to getting the answer.
+# TYPE state_op_seconds histogram
+state_op_seconds_bucket{le="0.0001"} 5499
+state_op_seconds_bucket{le="0.00025"} 5500
+state_op_seconds_bucket{le="0.0005"} 5500
+state_op_seconds_bucket{le="0.001"} 5500
+state_op_seconds_bucket{le="0.0025"} 5500
+state_op_seconds_bucket{le="0.005"} 5500
+state_op_seconds_bucket{le="0.01"} 5500
+state_op_seconds_bucket{le="0.025"} 5500
+state_op_seconds_bucket{le="0.05"} 5500
+state_op_seconds_bucket{le="0.1"} 5500
+state_op_seconds_bucket{le="0.25"} 5500
+state_op_seconds_bucket{le="0.5"} 5500
+state_op_seconds_bucket{le="1"} 5500
+state_op_seconds_bucket{le="2.5"} 5500
+state_op_seconds_bucket{le="5"} 5500
+state_op_seconds_bucket{le="10"} 5500
+state_op_seconds_bucket{le="+Inf"} 5500
+state_op_seconds_sum 0.009323656999999987
+state_op_seconds_count 5500
+# HELP state_reads_total Reads served by the state goroutine.
+# TYPE state_reads_total counter
+state_reads_total 5000
+# HELP state_waiting Goroutines waiting for the state goroutine right now.
+# TYPE state_waiting gauge
+state_waiting 0
+# HELP state_writes_total Writes served by the state goroutine.
+# TYPE state_writes_total counter
+state_writes_total 500
+
+(the latencies change from run to run)
+*/
@@ -0,0 +1,312 @@
+//Hedged requests and deadline propagation: the cancellation pattern from conpatterncancelcontext.go, taken over the network
+/*
+conpatterncancelcontext.go has one employee and one timer: if the ice cream cone does not come in time, the manager gives up. That protects us from waiting forever, but it does nothing about the slow ones that do come back in time. If 1 request in 100 takes ten times longer than the rest (a GC pause, a cold cache, a busy replica), then a page that makes 100 calls is slow most of the time.
+
+Hedging (from "The Tail at Scale", Dean and Barroso): send the request, and if it has not come back after a short while, send the same request again, to another replica if there is one. Take whichever answer comes first and cancel the other. If the delay is about the 95th percentile of the normal latency, only about 5% of requests are sent twice, but the slow tail is mostly gone.
+
+Hedge does this for any function that takes a context:
+
+1. Attempt 1 starts at once. Every Delay (or, with a LatencyTracker, every time the chosen percentile of recent latencies passes) another attempt starts, up to MaxAttempts
+2. The first success wins; the context of every other attempt is cancelled
+3. A failed attempt starts the next one straight away instead of waiting for the delay
+4. If all attempts fail, the errors are joined
+
+Only hedge what is safe to do twice: reads, or writes with an idempotency key.
+
+The second half is about deadlines. When the manager gives up after 150ms, the employee does not know and keeps working - in conpatterncancelcontext.go that is why the channel needs a buffer. Over HTTP it is worse: the server keeps working on a request whose client has long given up. So DeadlineTransport sends the time the client has left in a header, and DeadlineMiddleware on the server turns it back into a context deadline. The header holds a duration (like grpc-timeout does), not a point in time, so the clocks of client and server do not have to agree. A server that calls further services passes its own request context on, and the remaining time shrinks at every hop.
+
+go run conpatternhedge.go
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyTracker keeps the last few latencies and answers percentile queries over them.
+type LatencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// NewLatencyTracker remembers the last size latencies.
+func NewLatencyTracker(size int) *LatencyTracker {
+	return &LatencyTracker{samples: make([]time.Duration, size)}
+}
+
+// Observe records one latency.
+func (t *LatencyTracker) Observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.next] = d
+	t.next++
+	if t.next == len(t.samples) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// Percentile returns the p-th percentile (0 < p <= 100) of the recorded latencies, and false if there are none yet.
+func (t *LatencyTracker) Percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	n := t.next
+	if t.full {
+		n = len(t.samples)
+	}
+	sorted := slices.Clone(t.samples[:n])
+	t.mu.Unlock()
+	if n == 0 {
+		return 0, false
+	}
+	slices.Sort(sorted)
+	i := int(float64(n)*p/100+0.5) - 1
+	i = max(0, min(n-1, i))
+	return sorted[i], true
+}
+
+// HedgePolicy says when Hedge starts another attempt.
+type HedgePolicy struct {
+	// MaxAttempts is the most attempts that run in total, the first one included. Less than 2 means no hedging.
+	MaxAttempts int
+	// Delay is the wait before each further attempt.
+	Delay time.Duration
+	// Tracker and Percentile, if set, replace Delay with that percentile of the latencies Tracker has seen.
+	// Delay is still used until Tracker has any samples. Hedge records the latency of every success in Tracker.
+	Tracker    *LatencyTracker
+	Percentile float64
+}
+
+func (p HedgePolicy) delay() time.Duration {
+	if p.Tracker != nil && p.Percentile > 0 {
+		if d, ok := p.Tracker.Percentile(p.Percentile); ok {
+			return d
+		}
+	}
+	return p.Delay
+}
+
+// Hedge calls f, and calls it again in parallel if it is slow, as HedgePolicy says. It returns the first success and
+// cancels the rest. f gets the attempt number, starting at 1, so it can pick a different replica each time.
+func Hedge[T any](ctx context.Context, p HedgePolicy, f func(ctx context.Context, attempt int) (T, error)) (T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	//the losers see this when they return; it also stops the attempts that are still running
+	defer cancel()
+
+	type result struct {
+		v   T
+		err error
+	}
+	attempts := max(1, p.MaxAttempts)
+	//buffered, so attempts that finish after the winner do not leak, like the desk in conpatterncancelcontext.go
+	results := make(chan result, attempts)
+	start := func(attempt int) {
+		go func() {
+			began := time.Now()
+			v, err := f(ctx, attempt)
+			if err == nil && p.Tracker != nil {
+				p.Tracker.Observe(time.Since(began))
+			}
+			results <- result{v, err}
+		}()
+	}
+
+	started, finished := 1, 0
+	start(1)
+	timer := time.NewTimer(p.delay())
+	defer timer.Stop()
+	var errs []error
+	for {
+		var hedge <-chan time.Time
+		if started < attempts {
+			hedge = timer.C
+		}
+		select {
+		case r := <-results:
+			finished++
+			if r.err == nil {
+				return r.v, nil
+			}
+			errs = append(errs, r.err)
+			if started < attempts {
+				//no point waiting for the delay: this attempt will not win
+				started++
+				start(started)
+				timer.Reset(p.delay())
+			} else if finished == started {
+				var zero T
+				return zero, errors.Join(errs...)
+			}
+		case <-hedge:
+			started++
+			start(started)
+			timer.Reset(p.delay())
+		case <-ctx.Done():
+			var zero T
+			return zero, context.Cause(ctx)
+		}
+	}
+}
+
+// DeadlineHeader carries the time a request has left, in milliseconds.
+const DeadlineHeader = "X-Request-Timeout"
+
+// DeadlineTransport adds DeadlineHeader to every request whose context has a deadline.
+type DeadlineTransport struct {
+	// Base is the RoundTripper that sends the request. nil means http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+func (t *DeadlineTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		return base.RoundTrip(r)
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	//a RoundTripper must not modify the request it was given
+	r = r.Clone(r.Context())
+	r.Header.Set(DeadlineHeader, strconv.FormatInt(left.Milliseconds(), 10))
+	return base.RoundTrip(r)
+}
+
+// DeadlineMiddleware gives every request that carries DeadlineHeader a context deadline of that much time from now.
+// A request that has no time left gets 504 without running next; a malformed header gets 400.
+func DeadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get(DeadlineHeader)
+		if h == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ms, err := strconv.ParseInt(h, 10, 64)
+		if err != nil || ms < 0 {
+			http.Error(w, "bad "+DeadlineHeader+" header", http.StatusBadRequest)
+			return
+		}
+		if ms == 0 {
+			http.Error(w, "deadline already passed", http.StatusGatewayTimeout)
+			return
+		}
+		//WithTimeout keeps an earlier deadline if the context already has one
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func main() {
+	//a replica that answers in about 10ms, except 1 request in 10, which takes 200ms
+	var served, cancelled atomic.Int64
+	replica := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := time.Duration(8+rand.Intn(5)) * time.Millisecond
+		if rand.Intn(10) == 0 {
+			d = 200 * time.Millisecond
+		}
+		select {
+		case <-time.After(d):
+			served.Add(1)
+			fmt.Fprintln(w, "ice cream")
+		case <-r.Context().Done():
+			//the client hung up (it took the other attempt) or the propagated deadline ran out
+			cancelled.Add(1)
+		}
+	})
+	srv := httptest.NewServer(DeadlineMiddleware(replica))
+	defer srv.Close()
+	client := &http.Client{Transport: &DeadlineTransport{}}
+
+	get := func(ctx context.Context, attempt int) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("attempt %d: %s", attempt, resp.Status)
+		}
+		return "ok", nil
+	}
+
+	run := func(name string, p HedgePolicy) {
+		served.Store(0)
+		cancelled.Store(0)
+		var lat []time.Duration
+		for i := 0; i < 200; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			began := time.Now()
+			if _, err := Hedge(ctx, p, get); err != nil {
+				fmt.Println(name, err)
+			}
+			lat = append(lat, time.Since(began))
+			cancel()
+		}
+		slices.Sort(lat)
+		//give the server a moment to notice the cancelled attempts
+		time.Sleep(50 * time.Millisecond)
+		fmt.Printf("%-22s p50 %3dms  p99 %3dms  served %d  cancelled %d\n", name,
+			lat[len(lat)/2].Milliseconds(), lat[len(lat)*99/100].Milliseconds(), served.Load(), cancelled.Load())
+	}
+	run("no hedging", HedgePolicy{MaxAttempts: 1})
+	run("hedge after 20ms", HedgePolicy{MaxAttempts: 3, Delay: 20 * time.Millisecond})
+	run("hedge after p90", HedgePolicy{MaxAttempts: 3, Delay: 20 * time.Millisecond,
+		Tracker: NewLatencyTracker(100), Percentile: 90})
+
+	//the deadline travels with the request: the server sees how long the client is willing to wait
+	echo := httptest.NewServer(DeadlineMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := r.Context().Deadline()
+		if !ok {
+			fmt.Fprint(w, "no deadline")
+			return
+		}
+		fmt.Fprintf(w, "server has %v left", time.Until(deadline).Round(10*time.Millisecond))
+	})))
+	defer echo.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, echo.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	var body [64]byte
+	n, _ := resp.Body.Read(body[:])
+	fmt.Println("client set 150ms,", string(body[:n]))
+}
+
+/*
+Result
+go run conpatternhedge.go
+
+no hedging             p50  12ms  p99 202ms  served 200  cancelled 0
+hedge after 20ms       p50  11ms  p99  54ms  served 200  cancelled 21
+hedge after p90        p50  11ms  p99  40ms  served 200  cancelled 39
+client set 150ms, server has 150ms left
+
+(latencies change from run to run)
+Without hedging, 1 request in 10 waits the full 200ms, so p99 is 200ms. With hedging, a slow request gets a backup after 20ms, and the backup is almost always fast: p99 falls to a fraction, at the cost of about 1 extra request in 10. The cancelled count is the slow attempts the server stopped working on because the client took the other answer.
+*/
@@ -0,0 +1,264 @@
+//Supervised Fan Out: conpatternfanout.go with typed results, error handling and restarts
+/*
+conpatternfanout.go starts one goroutine per employee, each sends "paper" into a channel, and the manager counts the signals. Then it sleeps for a second, just in case. That leaves a lot out:
+
+there is one goroutine per piece of work - with a million inputs that is a million goroutines
+the signal is always "paper"; real work has a result, and the results come back in whatever order the employees finish
+an employee cannot fail, and if one panics the whole program goes down
+
+Supervise keeps the shape (a manager, some employees, a channel between them) and adds:
+
+1. A fixed number of workers, however many inputs there are
+2. Typed results: work is a func(ctx, In) (Out, error), and the results come back in input order, whatever order they finish in
+3. Two ways of handling errors, picked with SupervisorMode:
+   CancelOnError - the first error cancels the context every other worker sees and no new work starts, like golang.org/x/sync/errgroup. Supervise returns that error
+   CollectErrors - every input is tried; the errors come back together (errors.Join), each one an *ItemError that says which input it belongs to
+4. A supervisor, as in Erlang: a worker that panics is restarted and tries its input again. After MaxRestarts restarts the supervisor gives up and cancels everything - a bug that panics on every input should not be retried forever
+
+The workers write each result straight into its slot in the output slice. That is safe without a mutex, because no two workers ever have the same input, and the supervisor only reads the slice after every worker has told it (through a channel) that it has stopped.
+
+go run conpatternsupervisor.go
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SupervisorMode decides what Supervise does when work returns an error.
+type SupervisorMode int
+
+const (
+	// CancelOnError stops at the first error.
+	CancelOnError SupervisorMode = iota
+	// CollectErrors runs every input and returns all the errors.
+	CollectErrors
+)
+
+// ErrTooManyRestarts is the cause when the workers panicked more often than MaxRestarts allows.
+var ErrTooManyRestarts = errors.New("supervisor: too many restarts")
+
+// SupervisorConfig configures Supervise.
+type SupervisorConfig struct {
+	// Workers is how many inputs are worked on at once. Less than 1 means 1.
+	Workers int
+	Mode    SupervisorMode
+	// MaxRestarts is how many times in total a panicked worker is restarted.
+	MaxRestarts int
+	// OnRestart, if set, is called every time a worker is restarted.
+	OnRestart func(worker int, p *PanicError)
+}
+
+// PanicError is a recovered panic.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// ItemError is the error for one input.
+type ItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("input %d: %v", e.Index, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// workerExit is what a worker tells the supervisor when it stops. If it panicked, item is what it was working on.
+type workerExit struct {
+	worker int
+	item   int
+	panic  *PanicError
+}
+
+// Supervise runs work over inputs on cfg.Workers goroutines and returns the results in input order.
+// An input that failed or never ran has the zero value in the results.
+func Supervise[In, Out any](ctx context.Context, cfg SupervisorConfig, inputs []In, work func(context.Context, In) (Out, error)) ([]Out, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	workers := max(1, min(cfg.Workers, len(inputs)))
+
+	out := make([]Out, len(inputs))
+	errs := make([]error, len(inputs))
+
+	//the manager hands out inputs one by one; it stops as soon as the context is cancelled
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range inputs {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	exits := make(chan workerExit)
+	//retry is the input a restarted worker picks up again, or -1
+	var worker func(id, retry int)
+	worker = func(id, retry int) {
+		current := -1
+		defer func() {
+			if v := recover(); v != nil {
+				exits <- workerExit{worker: id, item: current, panic: &PanicError{Value: v, Stack: debug.Stack()}}
+				return
+			}
+			exits <- workerExit{worker: id, item: -1}
+		}()
+		handle := func(i int) {
+			current = i
+			if ctx.Err() != nil {
+				errs[i] = context.Cause(ctx)
+				return
+			}
+			v, err := work(ctx, inputs[i])
+			out[i], errs[i] = v, err
+			if err != nil && cfg.Mode == CancelOnError {
+				cancel(&ItemError{Index: i, Err: err})
+			}
+			current = -1
+		}
+		if retry >= 0 {
+			handle(retry)
+		}
+		for i := range jobs {
+			handle(i)
+		}
+	}
+	for id := 0; id < workers; id++ {
+		go worker(id, -1)
+	}
+
+	//the supervisor: wait for every worker to stop, restarting the ones that panicked
+	restarts := 0
+	for alive := workers; alive > 0; {
+		e := <-exits
+		if e.panic == nil {
+			alive--
+			continue
+		}
+		errs[e.item] = e.panic
+		if restarts < cfg.MaxRestarts && ctx.Err() == nil {
+			restarts++
+			if cfg.OnRestart != nil {
+				cfg.OnRestart(e.worker, e.panic)
+			}
+			go worker(e.worker, e.item)
+			continue
+		}
+		alive--
+		if ctx.Err() == nil {
+			cancel(fmt.Errorf("%w: %w", ErrTooManyRestarts, &ItemError{Index: e.item, Err: e.panic}))
+		}
+	}
+
+	if cfg.Mode == CancelOnError {
+		if ctx.Err() != nil {
+			return out, context.Cause(ctx)
+		}
+		return out, nil
+	}
+	var all []error
+	cause := context.Cause(ctx)
+	if cause != nil {
+		all = append(all, cause)
+	}
+	for i, err := range errs {
+		//inputs skipped after a cancel carry the cause, and the panic that gave up is inside it; both are in the list already
+		if err != nil && (cause == nil || !errors.Is(cause, err)) {
+			all = append(all, &ItemError{Index: i, Err: err})
+		}
+	}
+	return out, errors.Join(all...)
+}
+
+func main() {
+	papers := []string{"memo", "invoice", "report", "contract", "letter", "receipt", "form", "note"}
+
+	//every employee stamps papers; the results come back in input order, not in the order they were done
+	stamp := func(ctx context.Context, p string) (string, error) {
+		time.Sleep(time.Duration(len(p)) * 5 * time.Millisecond)
+		return strings.ToUpper(p), nil
+	}
+	out, err := Supervise(context.Background(), SupervisorConfig{Workers: 3}, papers, stamp)
+	fmt.Println("stamped:", out, err)
+
+	//the contract cannot be stamped
+	var ran atomic.Int64
+	picky := func(ctx context.Context, p string) (string, error) {
+		ran.Add(1)
+		if p == "contract" {
+			return "", errors.New("needs a signature")
+		}
+		select {
+		case <-time.After(20 * time.Millisecond):
+			return strings.ToUpper(p), nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	out, err = Supervise(context.Background(), SupervisorConfig{Workers: 2, Mode: CancelOnError}, papers, picky)
+	fmt.Printf("cancel on error: %q err=%v ran=%d of %d\n", out, err, ran.Load(), len(papers))
+
+	ran.Store(0)
+	out, err = Supervise(context.Background(), SupervisorConfig{Workers: 2, Mode: CollectErrors}, papers, picky)
+	fmt.Printf("collect errors: %q err=%v ran=%d of %d\n", out, err, ran.Load(), len(papers))
+
+	//the first time anyone touches the receipt, the employee panics; the supervisor restarts them and they try again
+	var tripped atomic.Bool
+	flaky := func(ctx context.Context, p string) (string, error) {
+		if p == "receipt" && tripped.CompareAndSwap(false, true) {
+			panic("paper cut")
+		}
+		return strings.ToUpper(p), nil
+	}
+	cfg := SupervisorConfig{Workers: 3, Mode: CollectErrors, MaxRestarts: 2,
+		OnRestart: func(w int, p *PanicError) { fmt.Printf("  restarting employee %d after %v\n", w, p) },
+	}
+	out, err = Supervise(context.Background(), cfg, papers, flaky)
+	fmt.Println("restarted:", out, err)
+
+	//a panic on every input uses up the restarts, and the supervisor gives up
+	broken := func(ctx context.Context, p string) (string, error) {
+		panic("stapler jammed")
+	}
+	cfg.OnRestart = nil
+	_, err = Supervise(context.Background(), cfg, papers, broken)
+	var pe *PanicError
+	fmt.Println("gave up:", errors.Is(err, ErrTooManyRestarts), errors.As(err, &pe))
+	fmt.Println(err)
+}
+
+/*
+Result
+go run conpatternsupervisor.go
+
+stamped: [MEMO INVOICE REPORT CONTRACT LETTER RECEIPT FORM NOTE] <nil>
+cancel on error: ["MEMO" "INVOICE" "" "" "" "" "" ""] err=input 3: needs a signature ran=4 of 8
+collect errors: ["MEMO" "INVOICE" "REPORT" "" "LETTER" "RECEIPT" "FORM" "NOTE"] err=input 3: needs a signature ran=8 of 8
+  restarting employee 0 after panic: paper cut
+restarted: [MEMO INVOICE REPORT CONTRACT LETTER RECEIPT FORM NOTE] <nil>
+gave up: true true
+supervisor: too many restarts: input 1: panic: stapler jammed
+input 0: panic: stapler jammed
+
+(which employee is restarted, and which inputs panic before the supervisor gives up, change from run to run)
+With CancelOnError the report was already being stamped when the contract failed; it saw the cancelled context and stopped, and the papers after it were never handed out.
+*/
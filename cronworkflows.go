@@ -0,0 +1,871 @@
+//Workflows: cron triggers that launch a DAG of jobs
+//see the notes at the bottom of cronjobs.go: "cron makes it very difficult to track the data flow between different tasks"
+
+/*
+cron.v2 and gocron run one function per schedule. Real jobs usually look more like a pipeline: fetch some data, then transform it, then load it in two different places, and only send the report once both loads are done. That is a DAG (directed acyclic graph) of jobs.
+
+Here we build a small scheduler with only the standard library:
+
+1. A Job has a name, the names of the jobs it depends on, a number of retries and a function to run
+2. A Workflow is a set of jobs. Validate checks that every dependency exists and that there are no cycles (a cycle would mean a job waits for itself forever)
+3. A Scheduler takes a spec in the cron.v2 style ("@every 1s") and launches a new Run of the workflow on every tick
+4. Every job runs in its own goroutine as soon as all of its dependencies have succeeded. The outputs of the upstream jobs are passed to the downstream job as a map keyed by job name
+5. If a job fails after all of its retries, every job downstream of it is skipped
+6. A Run keeps the state of each node, so we can print a view of what happened
+7. Notifiers are told when a job fails, when it recovers after a failure, and when it runs longer than expected. A Dedup wrapper keeps a flapping job from spamming us
+
+go run cronworkflows.go
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// JobFunc is the work done by one node of a Workflow. inputs holds the outputs of the jobs it depends on, keyed by job name.
+type JobFunc func(ctx context.Context, inputs map[string]any) (any, error)
+
+// Job is one node of a Workflow.
+type Job struct {
+	Name      string
+	DependsOn []string
+	// Retries is the number of extra attempts made after the first one fails.
+	Retries int
+	// RetryDelay is the pause between attempts.
+	RetryDelay time.Duration
+	// Expected is how long the job should take. A job still running after Expected raises an EventOverrun. Zero disables the check.
+	Expected time.Duration
+	Run      JobFunc
+}
+
+// Workflow is a named DAG of jobs.
+type Workflow struct {
+	Name string
+	Jobs []Job
+}
+
+var (
+	// ErrCycle is returned by Validate when the jobs of a Workflow depend on each other in a loop.
+	ErrCycle = errors.New("workflow has a dependency cycle")
+	// ErrUnknownDependency is returned by Validate when a job depends on a job that is not in the Workflow.
+	ErrUnknownDependency = errors.New("workflow has an unknown dependency")
+)
+
+// Validate checks that job names are unique, that every job has a Run, that every dependency exists and that the jobs
+// form a DAG.
+/*
+Cycle detection is a depth-first search that colours every job:
+white - not visited yet
+grey  - on the current path
+black - fully explored
+If we reach a grey job again we walked in a circle, and the path we are on is the cycle.
+*/
+func (wf *Workflow) Validate() error {
+	jobs := make(map[string]*Job, len(wf.Jobs))
+	for i := range wf.Jobs {
+		j := &wf.Jobs[i]
+		if _, ok := jobs[j.Name]; ok {
+			return fmt.Errorf("workflow %s: duplicate job %q", wf.Name, j.Name)
+		}
+		if j.Run == nil {
+			//it would only panic later, in the job's goroutine, at the first tick
+			return fmt.Errorf("workflow %s: job %q has no Run", wf.Name, j.Name)
+		}
+		jobs[j.Name] = j
+	}
+	for _, j := range wf.Jobs {
+		for _, d := range j.DependsOn {
+			if _, ok := jobs[d]; !ok {
+				return fmt.Errorf("%w: %s depends on %q", ErrUnknownDependency, j.Name, d)
+			}
+		}
+	}
+
+	const (
+		white = iota
+		grey
+		black
+	)
+	colour := make(map[string]int, len(jobs))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		colour[name] = grey
+		path = append(path, name)
+		for _, d := range jobs[name].DependsOn {
+			switch colour[d] {
+			case grey:
+				//cut the path back to where the loop starts
+				start := 0
+				for i, p := range path {
+					if p == d {
+						start = i
+					}
+				}
+				loop := append(append([]string{}, path[start:]...), d)
+				return fmt.Errorf("%w: %s", ErrCycle, strings.Join(loop, " -> "))
+			case white:
+				if err := visit(d); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		colour[name] = black
+		return nil
+	}
+	for _, j := range wf.Jobs {
+		if colour[j.Name] == white {
+			if err := visit(j.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NodeState is the state of one job inside a Run.
+type NodeState int
+
+const (
+	Pending NodeState = iota
+	Running
+	Succeeded
+	Failed
+	Skipped
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Running:
+		return "running"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Skipped:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// Node is the record of one job inside a Run.
+type Node struct {
+	Job      string
+	State    NodeState
+	Attempts int
+	Output   any
+	Err      error
+	Started  time.Time
+	Finished time.Time
+}
+
+// Run is one execution of a Workflow. It is safe to read a Run (with Nodes or String) while it is still executing.
+type Run struct {
+	ID       int
+	Workflow string
+	Started  time.Time
+	Finished time.Time
+
+	mu    sync.Mutex
+	nodes map[string]*Node
+	order []string
+	done  chan struct{}
+}
+
+// Wait blocks until every node of the Run has finished or been skipped.
+func (r *Run) Wait() {
+	<-r.done
+}
+
+// Err returns the first failure of the Run in job order, or nil if every job succeeded.
+func (r *Run) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range r.order {
+		if n := r.nodes[name]; n.State == Failed {
+			return fmt.Errorf("job %s: %w", name, n.Err)
+		}
+	}
+	return nil
+}
+
+// Nodes returns a copy of the state of every node, in the order the jobs were declared.
+func (r *Run) Nodes() []Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Node, 0, len(r.order))
+	for _, name := range r.order {
+		out = append(out, *r.nodes[name])
+	}
+	return out
+}
+
+// String renders the run view: one line per node with its state, attempts, duration and output or error.
+func (r *Run) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "run #%d of %s\n", r.ID, r.Workflow)
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tSTATE\tATTEMPTS\tTOOK\tRESULT")
+	for _, n := range r.Nodes() {
+		took := "-"
+		if !n.Finished.IsZero() && !n.Started.IsZero() {
+			took = n.Finished.Sub(n.Started).Round(time.Millisecond).String()
+		}
+		result := ""
+		switch {
+		case n.Err != nil:
+			result = n.Err.Error()
+		case n.Output != nil:
+			result = fmt.Sprint(n.Output)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", n.Job, n.State, n.Attempts, took, result)
+	}
+	tw.Flush()
+	return b.String()
+}
+
+func (r *Run) update(name string, f func(n *Node)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(r.nodes[name])
+}
+
+// Execute runs wf once and returns immediately. Use Wait on the returned Run to block until it completes.
+/*
+Every job gets a done channel. A job's goroutine first waits on the done channels of all its dependencies (the same done channel trick as the Promise in genericscondemo.go), then looks at their state. Because the workflow was validated, there are no cycles, so this can never deadlock.
+*/
+func Execute(ctx context.Context, id int, wf *Workflow) (*Run, error) {
+	return execute(ctx, id, wf, nil)
+}
+
+// hook, when not nil, is told about every job that finishes and every job that overruns
+func execute(ctx context.Context, id int, wf *Workflow, hook func(Event)) (*Run, error) {
+	if hook == nil {
+		hook = func(Event) {}
+	}
+	if err := wf.Validate(); err != nil {
+		return nil, err
+	}
+	r := &Run{
+		ID:       id,
+		Workflow: wf.Name,
+		Started:  time.Now(),
+		nodes:    make(map[string]*Node, len(wf.Jobs)),
+		done:     make(chan struct{}),
+	}
+	dones := make(map[string]chan struct{}, len(wf.Jobs))
+	for _, j := range wf.Jobs {
+		r.nodes[j.Name] = &Node{Job: j.Name}
+		r.order = append(r.order, j.Name)
+		dones[j.Name] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(wf.Jobs))
+	for _, j := range wf.Jobs {
+		go func(j Job) {
+			defer wg.Done()
+			defer close(dones[j.Name])
+
+			inputs := make(map[string]any, len(j.DependsOn))
+			for _, d := range j.DependsOn {
+				<-dones[d]
+			}
+			r.mu.Lock()
+			skip := ""
+			for _, d := range j.DependsOn {
+				up := r.nodes[d]
+				if up.State != Succeeded {
+					skip = d
+					break
+				}
+				inputs[d] = up.Output
+			}
+			r.mu.Unlock()
+			if skip != "" {
+				r.update(j.Name, func(n *Node) {
+					n.State = Skipped
+					n.Err = fmt.Errorf("upstream %s did not succeed", skip)
+				})
+				return
+			}
+
+			started := time.Now()
+			r.update(j.Name, func(n *Node) {
+				n.State = Running
+				n.Started = started
+			})
+			if j.Expected > 0 {
+				t := time.AfterFunc(j.Expected, func() {
+					hook(Event{Kind: EventOverrun, Workflow: wf.Name, Job: j.Name, RunID: id, Took: time.Since(started), Time: time.Now()})
+				})
+				defer t.Stop()
+			}
+			var out any
+			var err error
+			for attempt := 0; attempt <= j.Retries; attempt++ {
+				if attempt > 0 {
+					select {
+					case <-ctx.Done():
+						err = ctx.Err()
+					case <-time.After(j.RetryDelay):
+					}
+					if ctx.Err() != nil {
+						break
+					}
+				}
+				r.update(j.Name, func(n *Node) { n.Attempts++ })
+				out, err = j.Run(ctx, inputs)
+				if err == nil {
+					break
+				}
+			}
+			r.update(j.Name, func(n *Node) {
+				n.Finished = time.Now()
+				n.Output, n.Err = out, err
+				n.State = Succeeded
+				if err != nil {
+					n.State = Failed
+				}
+			})
+			ev := Event{Kind: eventSuccess, Workflow: wf.Name, Job: j.Name, RunID: id, Took: time.Since(started), Time: time.Now()}
+			if err != nil {
+				ev.Kind, ev.Err = EventFailure, err.Error()
+			}
+			hook(ev)
+		}(j)
+	}
+	go func() {
+		wg.Wait()
+		r.mu.Lock()
+		r.Finished = time.Now()
+		r.mu.Unlock()
+		close(r.done)
+	}()
+	return r, nil
+}
+
+// Scheduler launches workflows on a schedule and keeps the most recent runs of each one.
+type Scheduler struct {
+	// Keep is how many runs per workflow are kept for the run view. Zero means 10.
+	Keep int
+	// Notifiers are sent every failure, recovery and overrun event. Set them before Start.
+	Notifiers []Notifier
+
+	mu      sync.Mutex
+	entries []*entry
+	nextID  int
+	failing map[string]bool
+	cancel  context.CancelFunc
+	//stopped is set by Stop before it waits; after that, observe must not add to wg
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+type entry struct {
+	every time.Duration
+	wf    *Workflow
+	runs  []*Run
+}
+
+// NewScheduler returns an empty Scheduler. Add workflows with AddWorkflow and then call Start.
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// AddWorkflow registers wf to be run on spec. Only the "@every <duration>" form from cron.v2 is supported.
+// The workflow is validated here, so a cycle is reported when it is added and not at the first tick.
+func (s *Scheduler) AddWorkflow(spec string, wf *Workflow) error {
+	every, err := parseSpec(spec)
+	if err != nil {
+		return err
+	}
+	if err := wf.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, &entry{every: every, wf: wf})
+	return nil
+}
+
+func parseSpec(spec string) (time.Duration, error) {
+	rest, ok := strings.CutPrefix(spec, "@every ")
+	if !ok {
+		return 0, fmt.Errorf("unsupported schedule %q: only \"@every <duration>\" is supported", spec)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(rest))
+	if err != nil {
+		return 0, fmt.Errorf("bad schedule %q: %w", spec, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("bad schedule %q: interval must be positive", spec)
+	}
+	return d, nil
+}
+
+// Start launches one ticker goroutine per workflow. It returns immediately, like cron.v2's Start.
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.cancel = cancel
+	s.stopped = false
+	entries := append([]*entry(nil), s.entries...)
+	s.mu.Unlock()
+	for _, e := range entries {
+		s.wg.Add(1)
+		go func(e *entry) {
+			defer s.wg.Done()
+			t := time.NewTicker(e.every)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					s.trigger(ctx, e)
+				}
+			}
+		}(e)
+	}
+}
+
+func (s *Scheduler) trigger(ctx context.Context, e *entry) {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+	r, err := execute(ctx, id, e.wf, s.observe)
+	if err != nil {
+		return
+	}
+	keep := s.Keep
+	if keep <= 0 {
+		keep = 10
+	}
+	s.mu.Lock()
+	e.runs = append(e.runs, r)
+	if len(e.runs) > keep {
+		e.runs = e.runs[len(e.runs)-keep:]
+	}
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		r.Wait()
+	}()
+}
+
+// observe turns the raw job events of a run into notifications.
+// A success is only interesting when the last run of the same job failed: that is a recovery.
+// Events that come after Stop are not sent.
+/*
+An overrun comes from a time.AfterFunc, whose goroutine no WaitGroup counts: it can fire after the run is over and Stop
+is already in wg.Wait. An Add at that point races with the Wait, so the stopped check and the Adds happen under s.mu,
+which Stop takes to set stopped. Once stopped, the jobs still running fail with context.Canceled anyway, which is no
+news worth sending.
+*/
+func (s *Scheduler) observe(ev Event) {
+	key := ev.Workflow + "/" + ev.Job
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if s.failing == nil {
+		s.failing = make(map[string]bool)
+	}
+	switch ev.Kind {
+	case EventFailure:
+		s.failing[key] = true
+	case eventSuccess:
+		if !s.failing[key] {
+			return
+		}
+		delete(s.failing, key)
+		ev.Kind = EventRecovery
+	}
+
+	//notifiers talk to the network, so they must not hold up the jobs
+	for _, n := range s.Notifiers {
+		s.wg.Add(1)
+		go func(n Notifier) {
+			defer s.wg.Done()
+			if err := n.Notify(context.Background(), ev); err != nil {
+				log.Printf("notify %s for %s: %v", ev.Kind, key, err)
+			}
+		}(n)
+	}
+}
+
+// Stop stops the tickers, cancels the context of running jobs and waits for every run to finish, and for the
+// notifications already on their way.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.stopped = true
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	s.wg.Wait()
+}
+
+// Runs returns the kept runs of every workflow, oldest first.
+func (s *Scheduler) Runs() []*Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*Run
+	for _, e := range s.entries {
+		out = append(out, e.runs...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// EventKind says why a notification was sent.
+type EventKind int
+
+const (
+	// EventFailure is sent when a job fails after all of its retries.
+	EventFailure EventKind = iota + 1
+	// EventRecovery is sent when a job succeeds after its previous run failed.
+	EventRecovery
+	// EventOverrun is sent when a job is still running after its Expected duration.
+	EventOverrun
+
+	//eventSuccess never reaches a Notifier; the Scheduler uses it to spot recoveries
+	eventSuccess
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventFailure:
+		return "failure"
+	case EventRecovery:
+		return "recovery"
+	case EventOverrun:
+		return "overrun"
+	case eventSuccess:
+		return "success"
+	}
+	return "unknown"
+}
+
+// MarshalText lets an EventKind show up as a word in JSON.
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Event is what a Notifier is told about.
+type Event struct {
+	Kind     EventKind     `json:"kind"`
+	Workflow string        `json:"workflow"`
+	Job      string        `json:"job"`
+	RunID    int           `json:"run_id"`
+	Err      string        `json:"error,omitempty"`
+	Took     time.Duration `json:"took_ns"`
+	Time     time.Time     `json:"time"`
+	// Suppressed is how many identical events Dedup swallowed before this one.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+func (ev Event) String() string {
+	s := fmt.Sprintf("[%s] %s/%s run #%d after %s", ev.Kind, ev.Workflow, ev.Job, ev.RunID, ev.Took.Round(time.Millisecond))
+	if ev.Err != "" {
+		s += ": " + ev.Err
+	}
+	if ev.Suppressed > 0 {
+		s += fmt.Sprintf(" (%d similar suppressed)", ev.Suppressed)
+	}
+	return s
+}
+
+// Notifier delivers an Event somewhere a human will see it.
+type Notifier interface {
+	Notify(ctx context.Context, ev Event) error
+}
+
+// NotifierFunc lets an ordinary function be used as a Notifier, like http.HandlerFunc.
+type NotifierFunc func(ctx context.Context, ev Event) error
+
+func (f NotifierFunc) Notify(ctx context.Context, ev Event) error {
+	return f(ctx, ev)
+}
+
+// WebhookNotifier POSTs every Event as JSON to URL (a Slack-style incoming webhook, for example).
+type WebhookNotifier struct {
+	URL string
+	// Client defaults to a client with a 10 second timeout.
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, ev Event) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+		Event
+	}{ev.String(), ev})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c := n.Client
+	if c == nil {
+		c = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier emails every Event.
+type SMTPNotifier struct {
+	// Addr is host:port of the mail server.
+	Addr string
+	Auth smtp.Auth
+	From string
+	To   []string
+
+	//send is smtp.SendMail unless replaced, so the demo can run without a mail server
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, ev Event) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [%s] %s/%s\r\n", ev.Kind, ev.Workflow, ev.Job)
+	fmt.Fprintf(&msg, "\r\n%s\r\n", ev)
+	send := n.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+
+	//smtp.SendMail takes no ctx: leave it behind when ctx ends, it gives up on its own when the connection does
+	errc := make(chan error, 1)
+	go func() { errc <- send(n.Addr, n.Auth, n.From, n.To, msg.Bytes()) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// WriterNotifier writes one line per Event to W. Use os.Stdout, or a file from NewFileNotifier.
+type WriterNotifier struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// NewFileNotifier appends events to the file at path, creating it if needed.
+func NewFileNotifier(path string) (*WriterNotifier, io.Closer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &WriterNotifier{W: f}, f, nil
+}
+
+func (n *WriterNotifier) Notify(ctx context.Context, ev Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := fmt.Fprintf(n.W, "%s %s\n", ev.Time.Format(time.RFC3339), ev)
+	return err
+}
+
+// Dedup wraps a Notifier and drops repeats of the same kind of event for the same job within Window.
+// The next event that does get through carries the number of events that were dropped.
+/*
+A flapping job fails, recovers, fails, recovers... Without Dedup every one of those is an email. With Dedup we get the first failure and the first recovery, then nothing for Window, then one of each again with a count of what we missed.
+*/
+type Dedup struct {
+	Next   Notifier
+	Window time.Duration
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+func (d *Dedup) Notify(ctx context.Context, ev Event) error {
+	key := fmt.Sprintf("%s/%s/%s", ev.Workflow, ev.Job, ev.Kind)
+	d.mu.Lock()
+	if d.last == nil {
+		d.last = make(map[string]time.Time)
+		d.suppressed = make(map[string]int)
+	}
+	if last, ok := d.last[key]; ok && ev.Time.Sub(last) < d.Window {
+		d.suppressed[key]++
+		d.mu.Unlock()
+		return nil
+	}
+	d.last[key] = ev.Time
+	ev.Suppressed = d.suppressed[key]
+	delete(d.suppressed, key)
+	d.mu.Unlock()
+	return d.Next.Notify(ctx, ev)
+}
+
+func main() {
+	//extract -> (transform, audit) -> load -> report
+	//transform is flaky and needs a retry now and then
+	wf := &Workflow{
+		Name: "nightly-report",
+		Jobs: []Job{
+			{Name: "extract", Run: func(ctx context.Context, _ map[string]any) (any, error) {
+				return []int{3, 1, 2}, nil
+			}},
+			{Name: "transform", DependsOn: []string{"extract"}, Retries: 2, RetryDelay: 50 * time.Millisecond,
+				Run: func(ctx context.Context, in map[string]any) (any, error) {
+					if rand.Intn(2) == 0 {
+						return nil, errors.New("flaky transform")
+					}
+					rows := append([]int(nil), in["extract"].([]int)...)
+					sort.Ints(rows)
+					return rows, nil
+				}},
+			{Name: "audit", DependsOn: []string{"extract"}, Run: func(ctx context.Context, in map[string]any) (any, error) {
+				return len(in["extract"].([]int)), nil
+			}},
+			{Name: "load", DependsOn: []string{"transform", "audit"}, Run: func(ctx context.Context, in map[string]any) (any, error) {
+				return fmt.Sprintf("loaded %v (%d rows)", in["transform"], in["audit"]), nil
+			}},
+			{Name: "report", DependsOn: []string{"load"}, Run: func(ctx context.Context, in map[string]any) (any, error) {
+				return "sent", nil
+			}},
+		},
+	}
+
+	//a cycle is caught when the workflow is added, and so is a job with nothing to run
+	nop := func(ctx context.Context, _ map[string]any) (any, error) { return nil, nil }
+	bad := &Workflow{Name: "loop", Jobs: []Job{
+		{Name: "a", DependsOn: []string{"c"}, Run: nop},
+		{Name: "b", DependsOn: []string{"a"}, Run: nop},
+		{Name: "c", DependsOn: []string{"b"}, Run: nop},
+	}}
+	empty := &Workflow{Name: "empty", Jobs: []Job{{Name: "forgotten"}}}
+
+	//a job that flaps between failing and working, and sometimes takes too long
+	var calls int
+	var callsMu sync.Mutex
+	flappy := &Workflow{Name: "sync", Jobs: []Job{
+		{Name: "pull", Expected: 100 * time.Millisecond, Run: func(ctx context.Context, _ map[string]any) (any, error) {
+			callsMu.Lock()
+			calls++
+			n := calls
+			callsMu.Unlock()
+			if n == 3 {
+				time.Sleep(150 * time.Millisecond)
+			}
+			if n%2 == 1 {
+				return nil, errors.New("remote said 500")
+			}
+			return "ok", nil
+		}},
+	}}
+
+	//the mail goes nowhere: send only counts it
+	var mails atomic.Int32
+	mail := &SMTPNotifier{Addr: "mail.example.com:25", From: "cron@example.com", To: []string{"ops@example.com"},
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			mails.Add(1)
+			return nil
+		}}
+
+	s := NewScheduler()
+	s.Notifiers = []Notifier{
+		&Dedup{Next: &WriterNotifier{W: os.Stdout}, Window: time.Second},
+		&Dedup{Next: mail, Window: time.Second},
+	}
+	fmt.Println("add loop:", s.AddWorkflow("@every 1s", bad))
+	fmt.Println("add empty:", s.AddWorkflow("@every 1s", empty))
+	if err := s.AddWorkflow("@every 1s", wf); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := s.AddWorkflow("@every 300ms", flappy); err != nil {
+		fmt.Println(err)
+		return
+	}
+	s.Start()
+	time.Sleep(3500 * time.Millisecond)
+	s.Stop()
+
+	for _, r := range s.Runs() {
+		fmt.Println(r)
+	}
+	fmt.Println("mails sent:", mails.Load())
+
+	//a mail server that never answers holds up Notify only as long as its ctx
+	hung := &SMTPNotifier{Addr: "mail.example.com:25", From: "cron@example.com", To: []string{"ops@example.com"},
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			select {}
+		}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fmt.Println("hung mail server:", hung.Notify(ctx, Event{Kind: EventFailure, Workflow: "sync", Job: "pull"}))
+}
+
+/*
+Result
+go run cronworkflows.go
+
+add loop: workflow has a dependency cycle: a -> c -> b -> a
+add empty: workflow empty: job "forgotten" has no Run
+run #1 of nightly-report
+JOB        STATE      ATTEMPTS  TOOK   RESULT
+extract    succeeded  1         0s     [3 1 2]
+transform  succeeded  2         50ms   [1 2 3]
+audit      succeeded  1         0s     3
+load       succeeded  1         0s     loaded [1 2 3] (3 rows)
+report     succeeded  1         0s     sent
+...
+
+with the notifier on stdout, the flapping "sync" workflow prints something like:
+
+2026-10-19T10:00:00Z [failure] sync/pull run #1 after 0s: remote said 500
+2026-10-19T10:00:00Z [recovery] sync/pull run #2 after 0s
+2026-10-19T10:00:01Z [overrun] sync/pull run #4 after 100ms
+2026-10-19T10:00:01Z [failure] sync/pull run #6 after 0s: remote said 500 (1 similar suppressed)
+...
+
+and after the runs:
+
+mails sent: 7
+hung mail server: context deadline exceeded
+
+the mail count varies with the flaky transform; the hung server returns after the 50ms of its ctx,
+its send goroutine is left behind
+*/
@@ -0,0 +1,959 @@
+//Disk queue: a job queue that is still there after a crash
+/*
+Every queue in these demos is a channel or a slice (dropqueue.go, workerpool.go, pubsub.go). When the process dies, whatever was queued is gone. DiskQueue keeps its messages in files instead:
+
+1. Write-ahead log. Everything that happens to a message is appended to the log before it counts: Enqueue writes a put record, Receive a deliver record, Ack an ack record. Opening the queue replays the log to get back to where it was
+2. Checksums. Every record starts with its length and a CRC-32C of the rest. A process killed halfway through a write leaves a torn record at the end of the log; replay stops at the first record that is short or does not match its checksum, and cuts the file there if nothing valid comes after it. Damage anywhere else (in an older file, or followed by a good record) is not a torn write: cutting there would throw away messages that were confirmed, so OpenQueue refuses to open and returns ErrCorrupt
+3. Segment files. The log is split into files of about SegmentSize. A file is deleted when every message in it has been acked, so the log does not grow forever
+4. Consumer offset. All messages below the offset are done. It is written to its own file (to a temporary file first, then renamed over the old one, so it is never half written) before any segment is deleted
+5. Visibility timeout. A message handed out by Receive is invisible for VisibilityTimeout. If it is not acked by then, it is handed out again: the consumer may have crashed. That makes delivery at-least-once, as in pubsub.go
+6. Dead letters. A message that has been handed out MaxAttempts times without an ack goes to a second DiskQueue, DeadLetters(), instead of being tried forever. Someone can look at it there later
+
+7. A lock file. OpenQueue takes an exclusive flock on dir/lock, so a second process (or a second OpenQueue in this one) gets ErrLocked instead of appending to the same log. The kernel drops the lock when the process dies, so a crash never leaves the queue locked. flock is Unix only, like the SIGKILL of the crash tests
+
+Acks and redeliveries survive a crash too: a message that was received but not acked when the process died is handed out again as soon as the queue is opened, with its attempts counted.
+
+Messages stay on disk; the queue only keeps their position in memory, and reads them back when they are received.
+
+Sync makes every write wait for fsync. Without it a killed process loses nothing (the data is in the operating system's cache already), but a machine that loses power can lose the last writes.
+
+The crash tests at the end of main start this same program again as a child process (the DISKQUEUE_CHILD environment variable tells it what to do), and kill it with SIGKILL: once while it is writing, once while it holds messages it has not acked.
+
+go run diskqueue.go
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrCorrupt is returned by OpenQueue when a record that is not the last one is damaged.
+	ErrCorrupt = errors.New("diskqueue: corrupt log")
+	// ErrLocked is returned by OpenQueue when another DiskQueue, in this process or another one, has the directory open.
+	ErrLocked = errors.New("diskqueue: directory in use")
+	// ErrQueueClosed is returned after Close.
+	ErrQueueClosed = errors.New("diskqueue: closed")
+	// ErrLeaseLost is returned by Ack and Nack when the message has been acked already, or handed out again
+	// because the lease expired.
+	ErrLeaseLost = errors.New("diskqueue: lease lost")
+)
+
+// QueueConfig configures a DiskQueue.
+type QueueConfig struct {
+	// SegmentSize is the size at which a new segment file is started. Zero means 1 MiB.
+	SegmentSize int64
+	// VisibilityTimeout is how long a received message stays invisible to other receivers. Zero means 30s.
+	VisibilityTimeout time.Duration
+	// MaxAttempts is how many times a message is handed out before it goes to the dead letters. Zero means 5.
+	MaxAttempts int
+	// Sync calls fsync after every write.
+	Sync bool
+
+	//tearWrites splits every record in writes of this many bytes, with a pause in between, so the crash test can
+	//kill the process in the middle of a record
+	tearWrites int
+}
+
+// Lease is a received message. Ack or Nack it before Deadline.
+type Lease struct {
+	Offset   uint64
+	Data     []byte
+	Attempt  int
+	Deadline time.Time
+}
+
+// RecoveryInfo says what OpenQueue found.
+type RecoveryInfo struct {
+	Segments int
+	// Pending is how many messages are waiting or were received but not acked.
+	Pending int
+	// Truncated is how many bytes of a torn record were cut off the end of the log.
+	Truncated int64
+}
+
+// the record types
+const (
+	recPut byte = iota + 1
+	recDeliver
+	recAck
+	recDead
+)
+
+// a record is: length of data (4 bytes), CRC-32C of everything after the checksum (4), type (1), message offset (8), data
+const headerSize = 4 + 4 + 1 + 8
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func encodeRecord(typ byte, off uint64, data []byte) []byte {
+	b := make([]byte, headerSize+len(data))
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(data)))
+	b[8] = typ
+	binary.LittleEndian.PutUint64(b[9:], off)
+	copy(b[headerSize:], data)
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(b[8:], castagnoli))
+	return b
+}
+
+// decodeRecord returns the record at the start of b and its length, or ok false if there is no whole, valid record.
+func decodeRecord(b []byte) (typ byte, off uint64, data []byte, n int, ok bool) {
+	if len(b) < headerSize {
+		return 0, 0, nil, 0, false
+	}
+	size := int(binary.LittleEndian.Uint32(b[0:]))
+	if size > len(b)-headerSize {
+		return 0, 0, nil, 0, false
+	}
+	n = headerSize + size
+	if crc32.Checksum(b[8:n], castagnoli) != binary.LittleEndian.Uint32(b[4:]) {
+		return 0, 0, nil, 0, false
+	}
+	typ = b[8]
+	if typ < recPut || typ > recDead {
+		return 0, 0, nil, 0, false
+	}
+	return typ, binary.LittleEndian.Uint64(b[9:]), b[headerSize:n], n, true
+}
+
+type segment struct {
+	id   uint64
+	path string
+	r    *os.File
+	//end is the offset of the next message after this segment was finished; every message in it is below
+	end uint64
+}
+
+type entry struct {
+	seg      *segment
+	pos      int64
+	size     int
+	attempts int
+	leased   time.Time
+}
+
+// DiskQueue is a durable FIFO queue. It is safe for concurrent use.
+type DiskQueue struct {
+	dir  string
+	cfg  QueueConfig
+	lock *os.File
+
+	mu       sync.Mutex
+	segments []*segment
+	w        *os.File
+	wsize    int64
+	next     uint64
+	offset   uint64
+	msgs     map[uint64]*entry
+	//order holds the offsets of msgs, sorted: the queue
+	order    []uint64
+	notify   chan struct{}
+	dead     *DiskQueue
+	recovery RecoveryInfo
+	//err is set when a write fails; the end of the log is then unknown until the queue is opened again
+	err    error
+	closed bool
+}
+
+// OpenQueue opens the queue in dir, creating it if needed, and recovers its state from the log.
+// The dead letters are a second queue in dir/dead.
+func OpenQueue(dir string, cfg QueueConfig) (*DiskQueue, error) {
+	return openQueue(dir, cfg, true)
+}
+
+func openQueue(dir string, cfg QueueConfig, withDead bool) (*DiskQueue, error) {
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 1 << 20
+	}
+	if cfg.VisibilityTimeout <= 0 {
+		cfg.VisibilityTimeout = 30 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	q := &DiskQueue{dir: dir, cfg: cfg, msgs: make(map[uint64]*entry), notify: make(chan struct{})}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q.lock = lock
+	offset, err := readOffset(filepath.Join(dir, "offset"))
+	if err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	q.offset, q.next = offset, offset
+	if err := q.replayAll(); err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	if withDead {
+		deadCfg := cfg
+		deadCfg.tearWrites = 0
+		if q.dead, err = openQueue(filepath.Join(dir, "dead"), deadCfg, false); err != nil {
+			q.closeFiles()
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// lockDir takes an exclusive lock on dir/lock. Closing the file releases it.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func (q *DiskQueue) replayAll() error {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	//the names are zero padded, so sorting them as strings sorts them by id
+	sort.Strings(names)
+	for i, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: unexpected file %s", ErrCorrupt, name)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		r, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, path: name, r: r}
+		q.segments = append(q.segments, seg)
+		good := q.replay(seg, data)
+		if good < len(data) {
+			if i != len(names)-1 || validAfter(data[good+1:]) {
+				return fmt.Errorf("%w: %s at byte %d", ErrCorrupt, name, good)
+			}
+			//a torn write at the very end: the process died while writing this record
+			if err := os.Truncate(name, int64(good)); err != nil {
+				return err
+			}
+			q.recovery.Truncated = int64(len(data) - good)
+		}
+		seg.end = q.next
+		q.wsize = int64(good)
+	}
+	q.recovery.Segments = len(q.segments)
+	q.recovery.Pending = len(q.order)
+	if len(q.segments) == 0 {
+		return q.newSegment(0)
+	}
+	last := q.segments[len(q.segments)-1]
+	q.w, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// replay applies the records in data and returns how many bytes of it were whole, valid records.
+func (q *DiskQueue) replay(seg *segment, data []byte) int {
+	pos := 0
+	for {
+		typ, off, payload, n, ok := decodeRecord(data[pos:])
+		if !ok {
+			return pos
+		}
+		switch typ {
+		case recPut:
+			q.next = max(q.next, off+1)
+			if off >= q.offset {
+				q.msgs[off] = &entry{seg: seg, pos: int64(pos + headerSize), size: len(payload)}
+				q.order = append(q.order, off)
+			}
+		case recDeliver:
+			if e := q.msgs[off]; e != nil {
+				e.attempts++
+			}
+		case recAck, recDead:
+			if q.msgs[off] != nil {
+				q.forget(off)
+			}
+		}
+		pos += n
+	}
+}
+
+// validAfter reports whether a whole, valid record starts anywhere in b. Behind a torn write there is none;
+// behind damaged bytes in the middle of the log there are the records that were written after them.
+func validAfter(b []byte) bool {
+	for pos := range b {
+		if _, _, _, _, ok := decodeRecord(b[pos:]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func readOffset(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 12 || crc32.Checksum(b[:8], castagnoli) != binary.LittleEndian.Uint32(b[8:]) {
+		return 0, fmt.Errorf("%w: %s", ErrCorrupt, path)
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// writeOffset replaces the offset file. It always syncs: a segment is deleted right after, and the offset has to
+// be on disk before that happens.
+func (q *DiskQueue) writeOffset() error {
+	b := make([]byte, 12)
+	binary.LittleEndian.PutUint64(b, q.offset)
+	binary.LittleEndian.PutUint32(b[8:], crc32.Checksum(b[:8], castagnoli))
+	tmp := filepath.Join(q.dir, "offset.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, "offset")); err != nil {
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+// syncDir makes a rename or a new file in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (q *DiskQueue) newSegment(id uint64) error {
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d.seg", id))
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if q.cfg.Sync {
+		if err := syncDir(q.dir); err != nil {
+			w.Close()
+			r.Close()
+			return err
+		}
+	}
+	q.segments = append(q.segments, &segment{id: id, path: path, r: r})
+	q.w, q.wsize = w, 0
+	return nil
+}
+
+// write appends a record to the log, starting a new segment first if the current one is full.
+// It returns where the data of the record starts in the segment.
+func (q *DiskQueue) write(typ byte, off uint64, data []byte) (*segment, int64, error) {
+	if q.err != nil {
+		return nil, 0, q.err
+	}
+	if q.wsize >= q.cfg.SegmentSize {
+		active := q.segments[len(q.segments)-1]
+		active.end = q.next
+		if err := q.w.Close(); err != nil {
+			q.err = err
+			return nil, 0, err
+		}
+		if err := q.newSegment(active.id + 1); err != nil {
+			q.err = err
+			return nil, 0, err
+		}
+		if err := q.compact(); err != nil {
+			return nil, 0, err
+		}
+	}
+	b := encodeRecord(typ, off, data)
+	var err error
+	if q.cfg.tearWrites > 0 {
+		for i := 0; i < len(b) && err == nil; i += q.cfg.tearWrites {
+			_, err = q.w.Write(b[i:min(i+q.cfg.tearWrites, len(b))])
+			time.Sleep(200 * time.Microsecond)
+		}
+	} else {
+		_, err = q.w.Write(b)
+	}
+	if err == nil && q.cfg.Sync {
+		err = q.w.Sync()
+	}
+	if err != nil {
+		//part of the record may be in the file; replay will cut it off
+		q.err = err
+		return nil, 0, err
+	}
+	seg := q.segments[len(q.segments)-1]
+	pos := q.wsize + headerSize
+	q.wsize += int64(len(b))
+	return seg, pos, nil
+}
+
+// compact deletes the oldest segments whose messages are all done.
+func (q *DiskQueue) compact() error {
+	n := 0
+	for n < len(q.segments)-1 && q.segments[n].end <= q.offset {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	if err := q.writeOffset(); err != nil {
+		return err
+	}
+	for _, seg := range q.segments[:n] {
+		seg.r.Close()
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+	}
+	q.segments = q.segments[n:]
+	return nil
+}
+
+// forget removes a message from the queue and moves the offset past every message that is done.
+func (q *DiskQueue) forget(off uint64) {
+	delete(q.msgs, off)
+	i := sort.Search(len(q.order), func(i int) bool { return q.order[i] >= off })
+	q.order = append(q.order[:i], q.order[i+1:]...)
+	if len(q.order) > 0 {
+		q.offset = q.order[0]
+	} else {
+		q.offset = q.next
+	}
+}
+
+func (q *DiskQueue) usable() error {
+	if q.closed {
+		return ErrQueueClosed
+	}
+	return q.err
+}
+
+// wake tells waiting receivers that something changed.
+func (q *DiskQueue) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// Enqueue appends data to the queue and returns its offset. With Sync, the message is on disk when Enqueue returns.
+func (q *DiskQueue) Enqueue(data []byte) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.usable(); err != nil {
+		return 0, err
+	}
+	off := q.next
+	seg, pos, err := q.write(recPut, off, data)
+	if err != nil {
+		return 0, err
+	}
+	q.next++
+	q.msgs[off] = &entry{seg: seg, pos: pos, size: len(data)}
+	q.order = append(q.order, off)
+	q.wake()
+	return off, nil
+}
+
+// Receive waits for a message and hands it out with a lease. Ack it when it has been handled.
+func (q *DiskQueue) Receive(ctx context.Context) (Lease, error) {
+	for {
+		q.mu.Lock()
+		l, ok, wait, err := q.receive()
+		notify := q.notify
+		q.mu.Unlock()
+		if ok || err != nil {
+			return l, err
+		}
+		//nothing visible: wait for an Enqueue or a Nack, or for the first lease to expire
+		var expired <-chan time.Time
+		var t *time.Timer
+		if wait > 0 {
+			t = time.NewTimer(wait)
+			expired = t.C
+		}
+		select {
+		case <-notify:
+		case <-expired:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if err != nil {
+			return Lease{}, err
+		}
+	}
+}
+
+// TryReceive is Receive without waiting: ok is false if no message is visible.
+func (q *DiskQueue) TryReceive() (l Lease, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l, ok, _, err = q.receive()
+	return l, ok, err
+}
+
+// receive hands out the first visible message. If there is none, wait is how long until a lease expires
+// (zero if no message is leased).
+func (q *DiskQueue) receive() (l Lease, ok bool, wait time.Duration, err error) {
+	if err := q.usable(); err != nil {
+		return Lease{}, false, 0, err
+	}
+	now := time.Now()
+	for i := 0; i < len(q.order); {
+		off := q.order[i]
+		e := q.msgs[off]
+		if now.Before(e.leased) {
+			if d := e.leased.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+			i++
+			continue
+		}
+		if q.dead != nil && e.attempts >= q.cfg.MaxAttempts {
+			//forget removes it from order, so i already points at the next one
+			if err := q.deadLetter(off, e); err != nil {
+				return Lease{}, false, 0, err
+			}
+			continue
+		}
+		data, err := q.read(e)
+		if err != nil {
+			return Lease{}, false, 0, err
+		}
+		if _, _, err := q.write(recDeliver, off, nil); err != nil {
+			return Lease{}, false, 0, err
+		}
+		e.attempts++
+		e.leased = now.Add(q.cfg.VisibilityTimeout)
+		return Lease{Offset: off, Data: data, Attempt: e.attempts, Deadline: e.leased}, true, 0, nil
+	}
+	return Lease{}, false, wait, nil
+}
+
+func (q *DiskQueue) read(e *entry) ([]byte, error) {
+	data := make([]byte, e.size)
+	_, err := e.seg.r.ReadAt(data, e.pos)
+	return data, err
+}
+
+// deadLetter moves a message to the dead letters. It is put there before it is removed here: a crash in between
+// leaves it in both places, never in neither.
+func (q *DiskQueue) deadLetter(off uint64, e *entry) error {
+	data, err := q.read(e)
+	if err != nil {
+		return err
+	}
+	if _, err := q.dead.Enqueue(data); err != nil {
+		return err
+	}
+	if _, _, err := q.write(recDead, off, nil); err != nil {
+		return err
+	}
+	q.forget(off)
+	return q.compact()
+}
+
+// lease returns the entry of l if l is still the current lease of its message.
+func (q *DiskQueue) lease(l Lease) (*entry, error) {
+	if err := q.usable(); err != nil {
+		return nil, err
+	}
+	e := q.msgs[l.Offset]
+	if e == nil || e.attempts != l.Attempt {
+		return nil, ErrLeaseLost
+	}
+	return e, nil
+}
+
+// Ack removes a received message from the queue for good. It still works after the lease expired, as long as the
+// message has not been handed out again.
+func (q *DiskQueue) Ack(l Lease) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.lease(l); err != nil {
+		return err
+	}
+	if _, _, err := q.write(recAck, l.Offset, nil); err != nil {
+		return err
+	}
+	q.forget(l.Offset)
+	return q.compact()
+}
+
+// Nack gives a received message back right away, instead of when its lease expires. If that was its last attempt,
+// it goes to the dead letters.
+func (q *DiskQueue) Nack(l Lease) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, err := q.lease(l)
+	if err != nil {
+		return err
+	}
+	if q.dead != nil && e.attempts >= q.cfg.MaxAttempts {
+		return q.deadLetter(l.Offset, e)
+	}
+	e.leased = time.Time{}
+	q.wake()
+	return nil
+}
+
+// Len returns how many messages are in the queue, received but not acked ones included.
+func (q *DiskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.order)
+}
+
+// Segments returns how many segment files the log has.
+func (q *DiskQueue) Segments() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.segments)
+}
+
+// Recovery returns what OpenQueue found.
+func (q *DiskQueue) Recovery() RecoveryInfo {
+	return q.recovery
+}
+
+// DeadLetters returns the queue of messages that ran out of attempts.
+func (q *DiskQueue) DeadLetters() *DiskQueue {
+	return q.dead
+}
+
+// Close saves the consumer offset and closes the files. Leases that are not acked are handed out again when the
+// queue is opened next time.
+func (q *DiskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.wake()
+	err := q.w.Sync()
+	if q.err == nil {
+		err = errors.Join(err, q.writeOffset())
+	}
+	err = errors.Join(err, q.closeFiles())
+	if q.dead != nil {
+		err = errors.Join(err, q.dead.Close())
+	}
+	return err
+}
+
+func (q *DiskQueue) closeFiles() error {
+	var err error
+	if q.w != nil {
+		err = q.w.Close()
+	}
+	for _, seg := range q.segments {
+		err = errors.Join(err, seg.r.Close())
+	}
+	//last, so the directory stays locked until everything else is closed
+	return errors.Join(err, q.lock.Close())
+}
+
+func payload(i int) []byte {
+	return fmt.Appendf(nil, "job %06d %s", i, strings.Repeat("x", 40))
+}
+
+func check(name string, got, want any) {
+	if fmt.Sprint(got) == fmt.Sprint(want) {
+		fmt.Printf("  ok   %s: %v\n", name, got)
+		return
+	}
+	fmt.Printf("  FAIL %s: got %v, want %v\n", name, got, want)
+}
+
+// child is the process the crash tests kill.
+func child(mode, dir string) {
+	switch mode {
+	case "writer":
+		q, err := OpenQueue(dir, QueueConfig{SegmentSize: 4 << 10, tearWrites: 8})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for i := 0; ; i++ {
+			off, err := q.Enqueue(payload(i))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			//the parent counts this message as safe from now on
+			fmt.Println(off)
+		}
+	case "consumer":
+		q, err := OpenQueue(dir, QueueConfig{})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for i := range 3 {
+			l, _ := q.Receive(context.Background())
+			if i == 0 {
+				q.Ack(l)
+			}
+		}
+		fmt.Println("ready")
+		select {}
+	}
+}
+
+// startChild runs this program again in mode, and returns the child and its standard output.
+func startChild(mode, dir string) (*exec.Cmd, *bufio.Scanner) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "DISKQUEUE_CHILD="+mode, "DISKQUEUE_DIR="+dir)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		panic(err)
+	}
+	if err := cmd.Start(); err != nil {
+		panic(err)
+	}
+	return cmd, bufio.NewScanner(out)
+}
+
+// drainQueue receives and acks everything, and returns the offsets and whether each message held the right payload.
+func drainQueue(q *DiskQueue) (offsets []uint64, intact bool) {
+	intact = true
+	for {
+		l, ok, err := q.TryReceive()
+		if err != nil || !ok {
+			return offsets, intact
+		}
+		offsets = append(offsets, l.Offset)
+		intact = intact && string(l.Data) == string(payload(int(l.Offset)))
+		q.Ack(l)
+	}
+}
+
+func main() {
+	if mode := os.Getenv("DISKQUEUE_CHILD"); mode != "" {
+		child(mode, os.Getenv("DISKQUEUE_DIR"))
+		return
+	}
+	root, err := os.MkdirTemp("", "diskqueue")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	fmt.Println("FIFO, segments and the consumer offset:")
+	dir := filepath.Join(root, "basic")
+	q, _ := OpenQueue(dir, QueueConfig{SegmentSize: 1 << 10})
+	for i := range 100 {
+		q.Enqueue(payload(i))
+	}
+	check("segments after 100 messages", q.Segments(), 7)
+	var firstTen []uint64
+	for range 10 {
+		l, _ := q.Receive(context.Background())
+		firstTen = append(firstTen, l.Offset)
+		q.Ack(l)
+	}
+	check("first ten", firstTen, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	offsets, intact := drainQueue(q)
+	check("the other 90, in order", len(offsets) == 90 && offsets[0] == 10 && offsets[89] == 99 && intact, true)
+	check("segments once all are acked", q.Segments(), 1)
+	q.Close()
+	q, _ = OpenQueue(dir, QueueConfig{})
+	off, _ := q.Enqueue(payload(100))
+	check("reopened: pending, next offset", fmt.Sprint(q.Recovery().Pending, " ", off), "0 100")
+	_, err = OpenQueue(dir, QueueConfig{})
+	check("opened twice", errors.Is(err, ErrLocked), true)
+	q.Close()
+	q, err = OpenQueue(dir, QueueConfig{})
+	check("opened again after Close", err, nil)
+	q.Close()
+
+	fmt.Println("visibility timeout and dead letters:")
+	q, _ = OpenQueue(filepath.Join(root, "leases"), QueueConfig{VisibilityTimeout: 50 * time.Millisecond, MaxAttempts: 3})
+	q.Enqueue([]byte("flaky"))
+	first, _ := q.Receive(context.Background())
+	_, visible, _ := q.TryReceive()
+	check("invisible while leased", visible, false)
+	again, _ := q.Receive(context.Background())
+	check("handed out again after the timeout", fmt.Sprint(string(again.Data), " attempt ", again.Attempt, " waited ", again.Deadline.Sub(first.Deadline).Round(50*time.Millisecond)), "flaky attempt 2 waited 50ms")
+	check("ack of the first lease", q.Ack(first), ErrLeaseLost)
+	q.Nack(again)
+	third, _ := q.Receive(context.Background())
+	check("third attempt", third.Attempt, 3)
+	q.Nack(third)
+	dead, ok, _ := q.DeadLetters().TryReceive()
+	check("dead letter after 3 attempts", fmt.Sprint(ok, " ", string(dead.Data), " ", q.Len()), "true flaky 0")
+	q.Close()
+
+	fmt.Println("crash while writing:")
+	dir = filepath.Join(root, "writer")
+	cmd, out := startChild("writer", dir)
+	confirmed := -1
+	for out.Scan() {
+		confirmed, _ = strconv.Atoi(out.Text())
+		if confirmed == 199 {
+			cmd.Process.Kill()
+		}
+	}
+	cmd.Wait()
+	q, err = OpenQueue(dir, QueueConfig{})
+	check("open", err, nil)
+	info := q.Recovery()
+	offsets, intact = drainQueue(q)
+	fmt.Printf("  killed after %d confirmed messages; found %d in %d segments, cut %d bytes of a torn record\n",
+		confirmed+1, info.Pending, info.Segments, info.Truncated)
+	check("every confirmed message is there, in order, intact", len(offsets) > confirmed && offsets[confirmed] == uint64(confirmed) && intact, true)
+	off, _ = q.Enqueue(payload(len(offsets)))
+	check("the next message gets the next offset", off, len(offsets))
+	q.Close()
+
+	fmt.Println("crash while holding leases:")
+	dir = filepath.Join(root, "consumer")
+	q, _ = OpenQueue(dir, QueueConfig{})
+	for i := range 5 {
+		q.Enqueue(payload(i))
+	}
+	q.Close()
+	cmd, out = startChild("consumer", dir)
+	out.Scan()
+	cmd.Process.Kill()
+	cmd.Wait()
+	q, _ = OpenQueue(dir, QueueConfig{})
+	var got []string
+	for {
+		l, ok, _ := q.TryReceive()
+		if !ok {
+			break
+		}
+		got = append(got, fmt.Sprintf("%d#%d", l.Offset, l.Attempt))
+		q.Ack(l)
+	}
+	check("the child acked 0 and held 1 and 2 (offset#attempt)", got, []string{"1#2", "2#2", "3#1", "4#1"})
+	q.Close()
+
+	fmt.Println("a torn record and a damaged byte:")
+	dir = filepath.Join(root, "bitflip")
+	q, _ = OpenQueue(dir, QueueConfig{})
+	for i := range 5 {
+		q.Enqueue(payload(i))
+	}
+	q.Close()
+	seg := filepath.Join(dir, fmt.Sprintf("%020d.seg", 0))
+	recordSize := int64(headerSize + len(payload(0)))
+	//what a kill in the middle of writing message 4 leaves
+	os.Truncate(seg, 4*recordSize+10)
+	q, _ = OpenQueue(dir, QueueConfig{})
+	check("torn last record: pending; cut", fmt.Sprint(q.Recovery().Pending, " ", q.Recovery().Truncated), "4 10")
+	q.Close()
+	//flip a byte inside message 1, and put it back after
+	flip := func(pos int64, b byte) byte {
+		f, _ := os.OpenFile(seg, os.O_RDWR, 0)
+		defer f.Close()
+		old := make([]byte, 1)
+		f.ReadAt(old, pos)
+		f.WriteAt([]byte{b}, pos)
+		return old[0]
+	}
+	old := flip(recordSize+headerSize+2, '!')
+	_, err = OpenQueue(dir, QueueConfig{})
+	check("damage with good records after it", errors.Is(err, ErrCorrupt), true)
+	fmt.Println(" ", strings.ReplaceAll(err.Error(), root, "$TMPDIR"))
+	flip(recordSize+headerSize+2, old)
+	//a second segment makes the first one not the newest any more: damage there cannot be a torn write,
+	//not even in its last record
+	os.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d.seg", 1)), nil, 0o644)
+	flip(3*recordSize+headerSize+2, '?')
+	_, err = OpenQueue(dir, QueueConfig{})
+	check("damage before the newest segment", errors.Is(err, ErrCorrupt), true)
+	fmt.Println(" ", strings.ReplaceAll(err.Error(), root, "$TMPDIR"))
+}
+
+/*
+Result
+go run diskqueue.go
+
+FIFO, segments and the consumer offset:
+  ok   segments after 100 messages: 7
+  ok   first ten: [0 1 2 3 4 5 6 7 8 9]
+  ok   the other 90, in order: true
+  ok   segments once all are acked: 1
+  ok   reopened: pending, next offset: 0 100
+  ok   opened twice: true
+  ok   opened again after Close: <nil>
+visibility timeout and dead letters:
+  ok   invisible while leased: false
+  ok   handed out again after the timeout: flaky attempt 2 waited 50ms
+  ok   ack of the first lease: diskqueue: lease lost
+  ok   third attempt: 3
+  ok   dead letter after 3 attempts: true flaky 0
+crash while writing:
+  ok   open: <nil>
+  killed after 200 confirmed messages; found 200 in 4 segments, cut 8 bytes of a torn record
+  ok   every confirmed message is there, in order, intact: true
+  ok   the next message gets the next offset: 200
+crash while holding leases:
+  ok   the child acked 0 and held 1 and 2 (offset#attempt): [1#2 2#2 3#1 4#1]
+a torn record and a damaged byte:
+  ok   torn last record: pending; cut: 4 10
+  ok   damage with good records after it: true
+  diskqueue: corrupt log: $TMPDIR/bitflip/00000000000000000000.seg at byte 68
+  ok   damage before the newest segment: true
+  diskqueue: corrupt log: $TMPDIR/bitflip/00000000000000000000.seg at byte 204
+
+(the crash test changes a little from run to run: the child is killed when the parent has read 200 offsets, and by then it may have finished another message, or written a different part of the next record)
+
+100 records of 68 bytes fill 7 segments of 1 KiB; once they are all acked, only the newest one is left, and the offset file remembers that everything below 100 is done. A second OpenQueue of the same directory fails while the first one has it open.
+The writer child writes every record in pieces of 8 bytes, so the kill nearly always lands inside one. Replay cuts that record off; every message whose Enqueue had returned is still there.
+The consumer child received 0, 1 and 2 and acked only 0. After the kill, 1 and 2 come first again, with their second attempt, and 3 and 4 after them.
+Cutting the file 10 bytes into message 4 is what a kill during that write leaves: the 10 bytes go, 0 to 3 stay. A flipped byte in message 1 is followed by the good records 2 and 3, so it is not a torn write, and cutting there would lose them: OpenQueue stops instead (a checksum finds damage, it cannot repair it). In a segment that is not the newest, even damage in the last record stops it.
+*/
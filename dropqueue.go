@@ -0,0 +1,412 @@
+//Drop Pattern, made reusable: see conpatterndrop.go first
+/*
+conpatterndrop.go shows the idea with one buffered channel and a select/default: when the buffer is full, the manager drops the work. That is fine for a demo, but:
+
+the only choice is to drop the newest work - sometimes the oldest work is the least useful (a stale price update), or some work matters more than the rest
+dropped work is only printed, nobody can count it or retry it later
+the program ends with time.Sleep(time.Second) and hopes the employee has finished
+
+DropQueue[T] keeps the idea (a fixed capacity, a fixed number of workers, drop instead of block) and fixes those:
+
+1. A DropPolicy decides what goes when the queue is full: DropNewest (what conpatterndrop.go does), DropOldest, or DropLowestPriority
+2. Dropped items go to an OnDrop callback and/or a dead-letter channel
+3. Counters for accepted, dropped and processed items
+4. Close stops taking work, lets the workers finish everything already queued, and only returns once they have - no Sleep
+
+A buffered channel can only drop the newest item, so the queue is a slice guarded by a mutex, and a sync.Cond wakes the workers when work arrives.
+
+Finally, LoadShedder uses a DropQueue in front of an http.Handler: requests queue up to the capacity, and the ones that are dropped get 503 Service Unavailable straight away instead of piling up - the DNS server use case from conpatterndrop.go.
+
+go run dropqueue.go
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DropPolicy decides which item is dropped when a DropQueue is full.
+type DropPolicy int
+
+const (
+	// DropNewest turns away the item being offered.
+	DropNewest DropPolicy = iota
+	// DropOldest evicts the item that has waited longest, to make room.
+	DropOldest
+	// DropLowestPriority evicts the queued item with the lowest priority if the new one ranks higher; otherwise the new one is dropped.
+	DropLowestPriority
+)
+
+// DropQueueConfig configures a DropQueue.
+type DropQueueConfig[T any] struct {
+	Workers  int
+	Capacity int
+	Policy   DropPolicy
+	// Priority ranks items for DropLowestPriority; higher is more important and is also handled first.
+	Priority func(T) int
+	// OnDrop, if set, is called with every dropped item. It runs in the goroutine that called Offer.
+	OnDrop func(T)
+	// DeadLetter, if set, receives every dropped item. The send never blocks: if the channel is full the item is lost.
+	DeadLetter chan<- T
+}
+
+// DropQueueStats counts what a DropQueue has done.
+type DropQueueStats struct {
+	Accepted  uint64
+	Dropped   uint64
+	Processed uint64
+	Queued    int
+}
+
+// DropQueue is a bounded work queue with a fixed number of workers that drops work instead of blocking when full.
+type DropQueue[T any] struct {
+	cfg    DropQueueConfig[T]
+	handle func(T) bool
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []T
+	closed bool
+	wg     sync.WaitGroup
+
+	accepted  atomic.Uint64
+	dropped   atomic.Uint64
+	processed atomic.Uint64
+}
+
+// NewDropQueue starts cfg.Workers goroutines that call handle for every accepted item. handle reports whether it did
+// any work; an item it skips (one that is no longer wanted by the time a worker gets to it) is not counted as processed.
+func NewDropQueue[T any](cfg DropQueueConfig[T], handle func(T) bool) *DropQueue[T] {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.Capacity < 1 {
+		cfg.Capacity = 1
+	}
+	if cfg.Policy == DropLowestPriority && cfg.Priority == nil {
+		panic("dropqueue: DropLowestPriority needs a Priority func")
+	}
+	q := &DropQueue[T]{cfg: cfg, handle: handle, items: make([]T, 0, cfg.Capacity)}
+	q.cond = sync.NewCond(&q.mu)
+	q.wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+func (q *DropQueue[T]) worker() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			//closed and drained
+			q.mu.Unlock()
+			return
+		}
+		v := q.items[0]
+		var zero T
+		q.items[0] = zero
+		q.items = q.items[1:]
+		q.mu.Unlock()
+
+		if q.handle(v) {
+			q.processed.Add(1)
+		}
+	}
+}
+
+// Offer adds v to the queue. It returns false if v itself was dropped; it returns true if v was queued, even if
+// another item was evicted to make room for it. Offer never blocks.
+func (q *DropQueue[T]) Offer(v T) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		q.drop(v)
+		return false
+	}
+	var evicted T
+	var didEvict bool
+	if len(q.items) >= q.cfg.Capacity {
+		switch q.cfg.Policy {
+		case DropOldest:
+			evicted, didEvict = q.items[0], true
+			q.items = append(q.items[:0], q.items[1:]...)
+		case DropLowestPriority:
+			//items are kept sorted by priority, highest first, so the lowest is last
+			last := len(q.items) - 1
+			if q.cfg.Priority(v) <= q.cfg.Priority(q.items[last]) {
+				q.mu.Unlock()
+				q.drop(v)
+				return false
+			}
+			evicted, didEvict = q.items[last], true
+			q.items = q.items[:last]
+		default:
+			q.mu.Unlock()
+			q.drop(v)
+			return false
+		}
+	}
+	if q.cfg.Policy == DropLowestPriority {
+		//insert after every item of the same or higher priority, so equal priorities stay first in, first out
+		p := q.cfg.Priority(v)
+		i := sort.Search(len(q.items), func(i int) bool { return q.cfg.Priority(q.items[i]) < p })
+		var zero T
+		q.items = append(q.items, zero)
+		copy(q.items[i+1:], q.items[i:])
+		q.items[i] = v
+	} else {
+		q.items = append(q.items, v)
+	}
+	q.accepted.Add(1)
+	q.cond.Signal()
+	q.mu.Unlock()
+	if didEvict {
+		q.drop(evicted)
+	}
+	return true
+}
+
+func (q *DropQueue[T]) drop(v T) {
+	q.dropped.Add(1)
+	if q.cfg.OnDrop != nil {
+		q.cfg.OnDrop(v)
+	}
+	if q.cfg.DeadLetter != nil {
+		select {
+		case q.cfg.DeadLetter <- v:
+		default:
+		}
+	}
+}
+
+// Close stops accepting work and waits until the workers have handled everything already queued.
+// Items offered after Close are dropped.
+func (q *DropQueue[T]) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// Stats returns the counters.
+func (q *DropQueue[T]) Stats() DropQueueStats {
+	q.mu.Lock()
+	queued := len(q.items)
+	q.mu.Unlock()
+	return DropQueueStats{
+		Accepted:  q.accepted.Load(),
+		Dropped:   q.dropped.Load(),
+		Processed: q.processed.Load(),
+		Queued:    queued,
+	}
+}
+
+// shedJob is one HTTP request waiting in a LoadShedder's queue.
+/*
+The request's own goroutine (the one net/http started) waits for the job to finish, while a worker runs the handler. Three things can happen to a waiting job, and only one may win, so the state is changed with CompareAndSwap:
+pending -> running  a worker picked it up
+pending -> dropped  the queue evicted it; it gets a 503
+pending -> gone     the client went away before it ran; nobody will run it
+*/
+type shedJob struct {
+	w     http.ResponseWriter
+	r     *http.Request
+	state atomic.Int32
+	done  chan struct{}
+}
+
+const (
+	jobPending int32 = iota
+	jobRunning
+	jobDropped
+	jobGone
+)
+
+// LoadShedder returns a middleware that lets at most workers requests run at once, queues up to capacity more,
+// and answers 503 to the requests the policy drops. The Priority func, for DropLowestPriority, gets the *http.Request.
+// Every handler the middleware wraps has a DropQueue with its own workers; stop closes them all, after they have
+// handled what is queued. Call it once the server has shut down. Requests that come after it get a 503.
+func LoadShedder(workers, capacity int, policy DropPolicy, priority func(*http.Request) int) (middleware func(http.Handler) http.Handler, stop func()) {
+	var mu sync.Mutex
+	var queues []*DropQueue[*shedJob]
+	stopped := false
+	stop = func() {
+		mu.Lock()
+		stopped = true
+		qs := queues
+		queues = nil
+		mu.Unlock()
+		for _, q := range qs {
+			q.Close()
+		}
+	}
+	middleware = func(next http.Handler) http.Handler {
+		cfg := DropQueueConfig[*shedJob]{
+			Workers:  workers,
+			Capacity: capacity,
+			Policy:   policy,
+			OnDrop: func(j *shedJob) {
+				if j.state.CompareAndSwap(jobPending, jobDropped) {
+					j.w.Header().Set("Retry-After", "1")
+					http.Error(j.w, "server is overloaded", http.StatusServiceUnavailable)
+					close(j.done)
+				}
+			},
+		}
+		if priority != nil {
+			cfg.Priority = func(j *shedJob) int { return priority(j.r) }
+		}
+		q := NewDropQueue(cfg, func(j *shedJob) bool {
+			if !j.state.CompareAndSwap(jobPending, jobRunning) {
+				//the client left before a worker got to it
+				return false
+			}
+			defer close(j.done)
+			next.ServeHTTP(j.w, j.r)
+			return true
+		})
+		mu.Lock()
+		if stopped {
+			//too late: the queue drops everything, so every request gets a 503
+			mu.Unlock()
+			q.Close()
+		} else {
+			queues = append(queues, q)
+			mu.Unlock()
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			j := &shedJob{w: w, r: r, done: make(chan struct{})}
+			q.Offer(j)
+			select {
+			case <-j.done:
+			case <-r.Context().Done():
+				if !j.state.CompareAndSwap(jobPending, jobGone) {
+					//a worker (or OnDrop) already has the ResponseWriter; we must not return before it is done with it
+					<-j.done
+				}
+			}
+		})
+	}
+	return middleware, stop
+}
+
+func main() {
+	//conpatterndrop.go again: capacity 100, 200 pieces of work, one employee
+	q := NewDropQueue(DropQueueConfig[string]{Workers: 1, Capacity: 100}, func(p string) bool {
+		time.Sleep(time.Microsecond)
+		return true
+	})
+	for w := 0; w < 200; w++ {
+		q.Offer("paper")
+	}
+	q.Close()
+	fmt.Printf("drop newest: %+v\n", q.Stats())
+
+	//work that is no longer wanted when a worker gets to it (like a request whose client left) is not processed
+	cancelled := map[int]bool{2: true, 3: true}
+	skip := NewDropQueue(DropQueueConfig[int]{Workers: 1, Capacity: 10}, func(i int) bool {
+		return !cancelled[i]
+	})
+	for i := 1; i <= 5; i++ {
+		skip.Offer(i)
+	}
+	skip.Close()
+	fmt.Printf("two of five skipped: %+v\n", skip.Stats())
+
+	//DropOldest keeps the freshest work; the evicted items go to a dead-letter channel
+	dead := make(chan int, 10)
+	block := make(chan struct{})
+	var got []int
+	oldest := NewDropQueue(DropQueueConfig[int]{Workers: 1, Capacity: 3, Policy: DropOldest, DeadLetter: dead}, func(i int) bool {
+		<-block
+		got = append(got, i)
+		return true
+	})
+	for i := 1; i <= 8; i++ {
+		oldest.Offer(i)
+		time.Sleep(time.Millisecond)
+	}
+	close(block)
+	oldest.Close()
+	close(dead)
+	var dl []int
+	for i := range dead {
+		dl = append(dl, i)
+	}
+	fmt.Println("drop oldest: handled", got, "dead letters", dl)
+
+	//DropLowestPriority: while the worker is busy, low priority work makes room for high priority work
+	block = make(chan struct{})
+	var order []string
+	prio := NewDropQueue(DropQueueConfig[string]{Workers: 1, Capacity: 2, Policy: DropLowestPriority,
+		Priority: func(s string) int { return int(s[0] - '0') },
+		OnDrop:   func(s string) { fmt.Println("  dropped", s) },
+	}, func(s string) bool {
+		<-block
+		order = append(order, s)
+		return true
+	})
+	for _, s := range []string{"0-busy", "1-low", "5-mid", "9-high", "1-low-again"} {
+		prio.Offer(s)
+		time.Sleep(time.Millisecond)
+	}
+	close(block)
+	prio.Close()
+	fmt.Println("priority: handled", order)
+
+	//LoadShedder: one request at a time, two waiting, everyone else gets a 503
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintln(w, "done")
+	})
+	shed, stopShedder := LoadShedder(1, 2, DropNewest, nil)
+	srv := httptest.NewServer(shed(slow))
+	var mu sync.Mutex
+	codes := map[int]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			mu.Lock()
+			codes[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	fmt.Println("load shedder:", codes)
+	//the server first, so no request is still on its way in; then the shedder's workers
+	srv.Close()
+	stopShedder()
+}
+
+/*
+Result
+go run dropqueue.go
+
+drop newest: {Accepted:100 Dropped:100 Processed:100 Queued:0}
+two of five skipped: {Accepted:5 Dropped:0 Processed:3 Queued:0}
+drop oldest: handled [1 6 7 8] dead letters [2 3 4 5]
+  dropped 1-low
+  dropped 1-low-again
+priority: handled [0-busy 9-high 5-mid]
+load shedder: map[200:3 503:7]   (the split depends on timing)
+*/
@@ -7,6 +7,11 @@ Run functions asychronously
 Wait for multiple functions to complete
 Add cancellation support to a function
 Take the output of one concurrent function and use it as the input for another concurrent function
+Combine many promises: wait for all of them, for the first success, or for the first one to finish
+Cancel a promise, so its function actually stops instead of running on in the background
+Run promises on a bounded pool of workers instead of one goroutine each
+Survive a panicking function, find out which step of a chain failed, and recover or clean up with Catch and Finally
+Decorate a function with retries, a timeout, a circuit breaker or a bulkhead, the same way WithCancellation does
 */
 
 package main
@@ -15,8 +20,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Func represents any function that returns a Promise when passed to Run or Then.
@@ -34,9 +48,11 @@ var (
 The Promise has the return value and the error, along with a done channel. The val and err fields are unexported; we want to block access to these until the values are populated.
 */
 type Promise[V any] struct {
-	val  V
-	err  error
-	done <-chan struct{}
+	val    V
+	err    error
+	done   <-chan struct{}
+	cancel context.CancelFunc
+	stage  int
 }
 
 // Get returns the value and the error (if any) for the Promise. Get waits until the Func associated with this
@@ -49,6 +65,15 @@ func (p *Promise[V]) Get() (V, error) {
 	return p.val, p.err
 }
 
+// Cancel asks the Func associated with this Promise to stop by cancelling the context it was given. The Func has to
+// watch ctx.Done() for this to have an effect; Get still waits for the Func to return, so nothing is left running behind it.
+// Cancelling a Promise that has completed does nothing.
+func (p *Promise[V]) Cancel() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
 // GetNow returns the value and the error (if any) for the Promise. If the Func associated with this Promise has
 // not completed, GetNow returns the zero value for the return type and ErrIncomplete.
 func (p *Promise[V]) GetNow() (V, error) {
@@ -68,16 +93,24 @@ Pass a context.Context, the data to process, and a function that meets the Func
 */
 func Run[T, V any](ctx context.Context, t T, f Func[T, V]) *Promise[V] {
 	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
 	p := Promise[V]{
-		done: done,
+		done:   done,
+		cancel: cancel,
 	}
 	go func() {
 		defer close(done)
-		p.val, p.err = f(ctx, t)
+		defer cancel()
+		defer track(ctx, f)()
+		p.val, p.err = safeCall(ctx, f, t)
 	}()
 	return &p
 }
 
+/*
+Each Promise gets its own child of the context passed in, and keeps the cancel function. Cancel calls it, and the combinators below use it to tell the promises that lost a race to stop. The deferred cancel releases the context's resources once the Func is done.
+*/
+
 /*
 To build a Wait function that works when the Promise instances don't all return values of the same type, define a new, non-generic interface, Waiting, make Promise implement this interface:
 */
@@ -94,7 +127,8 @@ func (p *Promise[V]) Wait() error {
 
 //write Wait in terms of Waiting
 // Wait takes in zero or more Waiting instances and pauses until one returns an error or all of them complete successfully.
-// It returns the first error from a Waiting or nil, if no Waiting returns an error.
+// It returns the first error from a Waiting or nil, if no Waiting returns an error. When one fails, every Waiting that has
+// a Cancel method (like *Promise) is cancelled, so the others don't keep running for nothing.
 func Wait(ws ...Waiting) error {
 	var wg sync.WaitGroup
 	wg.Add(len(ws))
@@ -115,6 +149,11 @@ func Wait(ws ...Waiting) error {
 	}()
 	select {
 	case err := <-errChan:
+		for _, w := range ws {
+			if c, ok := w.(interface{ Cancel() }); ok {
+				c.Cancel()
+			}
+		}
 		return err
 	case <-done:
 	}
@@ -132,22 +171,31 @@ Returning that zero value relies on an interesting Go generics trick. In order t
 
 generics and closures
 */
+/*
+There was a catch in the first version of this function: when the context won, we returned, but the goroutine running f kept going and wrote val and err later, when nobody was looking any more. Now f gets its own child context, and the deferred cancel tells it to stop as soon as we return, whichever way we return. The result comes back over a channel with a buffer of one, so even a late f can always send and exit instead of blocking forever.
+Go can't kill a goroutine from the outside. If f never looks at ctx it still runs to the end - CheckDetached below is there to catch those.
+*/
 func WithCancellation[T, V any](f Func[T, V]) Func[T, V] {
+	type result struct {
+		val V
+		err error
+	}
 	return func(ctx context.Context, t T) (V, error) {
-		done := make(chan struct{})
-		var val V
-		var err error
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ch := make(chan result, 1)
 		go func() {
-			defer close(done)
-			val, err = f(ctx, t)
+			defer track(ctx, f)()
+			val, err := safeCall(ctx, f, t)
+			ch <- result{val, err}
 		}()
 		select {
 		case <-ctx.Done():
 			var zero V
 			return zero, ctx.Err()
-		case <-done:
+		case r := <-ch:
+			return r.val, r.err
 		}
-		return val, err
 	}
 }
 
@@ -158,19 +206,31 @@ func WithCancellation[T, V any](f Func[T, V]) Func[T, V] {
 
 func Then[T, V any](ctx context.Context, p *Promise[T], f Func[T, V]) *Promise[V] {
 	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
 	out := Promise[V]{
-		done: done,
+		done:   done,
+		cancel: cancel,
+		stage:  p.stage + 1,
 	}
 	go func() {
 		defer close(done)
+		defer cancel()
+		//if we are cancelled while still waiting for p, there is no point in waiting any longer
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			out.err = ctx.Err()
+			return
+		}
 		val, err := p.Get()
 		if err != nil {
 			out.err = err
 			return
 		}
-		val2, err := f(ctx, val)
+		defer track(ctx, f)()
+		val2, err := safeCall(ctx, f, val)
 		out.val = val2
-		out.err = err
+		out.err = stageError(out.stage, f, err)
 	}()
 	return &out
 }
@@ -179,6 +239,1109 @@ func Then[T, V any](ctx context.Context, p *Promise[T], f Func[T, V]) *Promise[V
 Then looks a lot like Run, with a few minor differences. The first difference is that we pass in a *Promise[T] instead of a T. Second, rather than use the passed-in value directly, we call p.Get() to retrieve the value from the Promise. If the Promise contains a non-nil error, then we assign the error to the new Promise and return immediately. Otherwise, we call our new function with the value from the passed-in Promise.
 */
 
+/*
+Panics and errors
+
+A goroutine that panics takes the whole program down with it, even if someone else started it, and there is no way to recover from the outside. So every Func is run through safeCall, which recovers a panic and turns it into a *PanicError that comes out of Get like any other error. The stack is captured inside the deferred function, so it still shows where the panic happened.
+
+In a chain built with Then, an error from an early step is passed down unchanged, so by the time it comes out of Get we no longer know which step it came from. Then wraps the errors of its own Func in a *StageError that records the step number (1 for the first Then, 2 for the one after it...) and the name of the Func. The first error in the chain is the innermost one, so errors.As finds the step that actually failed. An error that is not wrapped at all came from the Run at the head of the chain.
+*/
+
+// PanicError is the error of a Promise whose Func panicked.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it was an error, so errors.Is works on panic(io.EOF) and the like.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// StageError records which step of a Then chain failed.
+type StageError struct {
+	Stage int
+	Func  string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %d (%s): %v", e.Stage, e.Func, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// safeCall runs f, turning a panic into a *PanicError.
+func safeCall[T, V any](ctx context.Context, f Func[T, V], t T) (val V, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var zero V
+			val, err = zero, &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return f(ctx, t)
+}
+
+func stageError(stage int, f any, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StageError{Stage: stage, Func: funcName(f), Err: err}
+}
+
+// Catch produces a Promise that has the value of p if p succeeds. If p fails, handler is called with the error and its
+// return values become the result, so handler can recover with a fallback value or return a different error.
+func Catch[V any](ctx context.Context, p *Promise[V], handler Func[error, V]) *Promise[V] {
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	out := Promise[V]{
+		done:   done,
+		cancel: cancel,
+		stage:  p.stage + 1,
+	}
+	go func() {
+		defer close(done)
+		defer cancel()
+		val, err := p.Get()
+		if err == nil {
+			out.val = val
+			return
+		}
+		defer track(ctx, handler)()
+		out.val, out.err = safeCall(ctx, handler, err)
+		out.err = stageError(out.stage, handler, out.err)
+	}()
+	return &out
+}
+
+// Finally produces a Promise with the same result as p, after running cleanup once p has completed, whether it succeeded
+// or failed. If cleanup fails (or panics) and p had succeeded, the cleanup error becomes the result.
+func Finally[V any](ctx context.Context, p *Promise[V], cleanup func(context.Context) error) *Promise[V] {
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	out := Promise[V]{
+		done:   done,
+		cancel: cancel,
+		stage:  p.stage + 1,
+	}
+	c := func(ctx context.Context, _ struct{}) (struct{}, error) {
+		return struct{}{}, cleanup(ctx)
+	}
+	go func() {
+		defer close(done)
+		defer cancel()
+		out.val, out.err = p.Get()
+		_, err := safeCall(ctx, c, struct{}{})
+		if out.err == nil && err != nil {
+			var zero V
+			out.val, out.err = zero, stageError(out.stage, cleanup, err)
+		}
+	}()
+	return &out
+}
+
+/*
+Combinators
+
+Wait works for promises of different types, but it can only give back an error, and when one promise fails the others keep running. When all the promises have the same type V we can do better, the same way JavaScript does with Promise.all, Promise.any, Promise.race and Promise.allSettled.
+
+All four use the same trick: one goroutine per input promise waits on it and sends its index into a channel. The channel is buffered with room for every promise, so those goroutines can always finish, even after we stopped listening. That is what keeps them from leaking.
+*/
+
+var (
+	// ErrNoPromises is returned by Any and Race when they are called with no promises, since nothing could ever win.
+	ErrNoPromises = errors.New("no promises")
+)
+
+// Result is the outcome of one Promise, as returned by AllSettled.
+type Result[V any] struct {
+	Val V
+	Err error
+}
+
+// AggregateError is returned by Any when every Promise fails. Errs is in the same order as the promises.
+type AggregateError struct {
+	Errs []error
+}
+
+func (e *AggregateError) Error() string {
+	return fmt.Sprintf("all %d promises failed: %v", len(e.Errs), errors.Join(e.Errs...))
+}
+
+// Unwrap lets errors.Is and errors.As look at every failure.
+func (e *AggregateError) Unwrap() []error {
+	return e.Errs
+}
+
+// settled sends the index of each promise as it completes
+func settled[V any](ps []*Promise[V]) <-chan int {
+	ch := make(chan int, len(ps))
+	for i, p := range ps {
+		go func(i int, p *Promise[V]) {
+			<-p.done
+			ch <- i
+		}(i, p)
+	}
+	return ch
+}
+
+// cancelAll tells every promise that hasn't finished to stop. Cancelling a finished promise does nothing.
+func cancelAll[V any](ps []*Promise[V]) {
+	for _, p := range ps {
+		p.Cancel()
+	}
+}
+
+// All produces a Promise for the values of every supplied Promise, in the same order. If any of them fails, the returned Promise
+// fails with the first error and the others are cancelled.
+func All[V any](ps ...*Promise[V]) *Promise[[]V] {
+	done := make(chan struct{})
+	out := Promise[[]V]{
+		done:   done,
+		cancel: func() { cancelAll(ps) },
+	}
+	go func() {
+		defer close(done)
+		ch := settled(ps)
+		for range ps {
+			i := <-ch
+			if err := ps[i].err; err != nil {
+				cancelAll(ps)
+				out.err = err
+				return
+			}
+		}
+		out.val = make([]V, len(ps))
+		for i, p := range ps {
+			out.val[i] = p.val
+		}
+	}()
+	return &out
+}
+
+// AllSettled produces a Promise that waits for every supplied Promise and returns the value and error of each, in the same order.
+// It never fails and never cancels anything.
+func AllSettled[V any](ps ...*Promise[V]) *Promise[[]Result[V]] {
+	done := make(chan struct{})
+	out := Promise[[]Result[V]]{
+		done:   done,
+		cancel: func() { cancelAll(ps) },
+	}
+	go func() {
+		defer close(done)
+		res := make([]Result[V], len(ps))
+		for i, p := range ps {
+			res[i].Val, res[i].Err = p.Get()
+		}
+		out.val = res
+	}()
+	return &out
+}
+
+// Any produces a Promise for the first supplied Promise to succeed; the others are cancelled. If all of them fail, the returned
+// Promise fails with an *AggregateError holding every error.
+func Any[V any](ps ...*Promise[V]) *Promise[V] {
+	done := make(chan struct{})
+	out := Promise[V]{
+		done:   done,
+		cancel: func() { cancelAll(ps) },
+	}
+	go func() {
+		defer close(done)
+		if len(ps) == 0 {
+			out.err = ErrNoPromises
+			return
+		}
+		ch := settled(ps)
+		for range ps {
+			i := <-ch
+			if ps[i].err == nil {
+				cancelAll(ps)
+				out.val = ps[i].val
+				return
+			}
+		}
+		errs := make([]error, len(ps))
+		for i, p := range ps {
+			errs[i] = p.err
+		}
+		out.err = &AggregateError{Errs: errs}
+	}()
+	return &out
+}
+
+// Race produces a Promise for the first supplied Promise to finish, whether it succeeded or failed. The others are cancelled.
+func Race[V any](ps ...*Promise[V]) *Promise[V] {
+	done := make(chan struct{})
+	out := Promise[V]{
+		done:   done,
+		cancel: func() { cancelAll(ps) },
+	}
+	go func() {
+		defer close(done)
+		if len(ps) == 0 {
+			out.err = ErrNoPromises
+			return
+		}
+		i := <-settled(ps)
+		cancelAll(ps)
+		out.val, out.err = ps[i].val, ps[i].err
+	}()
+	return &out
+}
+
+/*
+Executor
+
+Every Run and Then starts a new goroutine. Goroutines are cheap, but a fan-out over 100,000 items that each open a connection is not. An Executor is a fixed number of worker goroutines reading tasks from a buffered channel (the same shape as the worker pools in waitgroups.go and conpatterndrop.go). RunOn and ThenOn are Run and Then that hand the Func to an Executor instead of starting a goroutine.
+
+When the queue is full, the RejectPolicy decides what happens to a new task:
+Block      - wait for room (or for the context to be cancelled)
+FailFast   - give up straight away; the Promise fails with ErrRejected
+CallerRuns - run the task in the goroutine that submitted it. This slows the submitter down, which is a natural brake on a producer that is too fast
+*/
+
+var (
+	// ErrRejected is the error of a Promise whose task was turned away by a FailFast Executor with a full queue.
+	ErrRejected = errors.New("executor queue is full")
+	// ErrExecutorClosed is the error of a Promise submitted after Shutdown.
+	ErrExecutorClosed = errors.New("executor is shut down")
+)
+
+// RejectPolicy says what an Executor does with a task when its queue is full.
+type RejectPolicy int
+
+const (
+	Block RejectPolicy = iota
+	FailFast
+	CallerRuns
+)
+
+type task struct {
+	fn       func()
+	enqueued time.Time
+}
+
+// Executor runs tasks on a fixed number of worker goroutines.
+type Executor struct {
+	workers int
+	policy  RejectPolicy
+	queue   chan task
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+
+	running       atomic.Int64
+	maxQueueDepth atomic.Int64
+	submitted     atomic.Uint64
+	completed     atomic.Uint64
+	rejected      atomic.Uint64
+	callerRan     atomic.Uint64
+	//waitNanos adds up the time in the queue of the dequeued tasks, waited how many there were
+	waitNanos atomic.Int64
+	waited    atomic.Uint64
+	runNanos  atomic.Int64
+}
+
+// NewExecutor starts an Executor with the given number of workers and room for queueLimit waiting tasks.
+func NewExecutor(workers, queueLimit int, policy RejectPolicy) *Executor {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueLimit < 0 {
+		queueLimit = 0
+	}
+	e := &Executor{
+		workers: workers,
+		policy:  policy,
+		queue:   make(chan task, queueLimit),
+	}
+	e.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer e.wg.Done()
+			for tk := range e.queue {
+				e.waitNanos.Add(int64(time.Since(tk.enqueued)))
+				e.waited.Add(1)
+				e.exec(tk.fn)
+			}
+		}()
+	}
+	return e
+}
+
+func (e *Executor) exec(fn func()) {
+	e.running.Add(1)
+	start := time.Now()
+	fn()
+	e.runNanos.Add(int64(time.Since(start)))
+	e.running.Add(-1)
+	e.completed.Add(1)
+}
+
+// submit queues fn according to the policy. It returns an error only if fn will never run.
+func (e *Executor) submit(ctx context.Context, fn func()) error {
+	//the read lock keeps Shutdown from closing the queue while we send on it, and no longer than that:
+	//a CallerRuns task runs after it is released, so a long task cannot hold up Shutdown
+	e.mu.RLock()
+	queued, err := e.enqueue(ctx, task{fn: fn, enqueued: time.Now()})
+	e.mu.RUnlock()
+	if err != nil {
+		e.rejected.Add(1)
+		return err
+	}
+	e.submitted.Add(1)
+	if !queued {
+		e.callerRan.Add(1)
+		e.exec(fn)
+	}
+	return nil
+}
+
+// enqueue puts tk in the queue according to the policy. It returns queued false and no error if the caller is to run
+// the task itself. e.mu must be read locked.
+func (e *Executor) enqueue(ctx context.Context, tk task) (queued bool, err error) {
+	if e.closed {
+		return false, ErrExecutorClosed
+	}
+	select {
+	case e.queue <- tk:
+		e.noteDepth()
+		return true, nil
+	default:
+	}
+	switch e.policy {
+	case FailFast:
+		return false, ErrRejected
+	case CallerRuns:
+		return false, nil
+	}
+	select {
+	case e.queue <- tk:
+		e.noteDepth()
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (e *Executor) noteDepth() {
+	d := int64(len(e.queue))
+	for {
+		m := e.maxQueueDepth.Load()
+		if d <= m || e.maxQueueDepth.CompareAndSwap(m, d) {
+			return
+		}
+	}
+}
+
+// Shutdown stops accepting tasks, lets the workers finish everything already queued, and waits for them.
+func (e *Executor) Shutdown() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+	e.wg.Wait()
+}
+
+// ExecutorStats is a snapshot of what an Executor is doing and has done.
+type ExecutorStats struct {
+	Workers       int
+	QueueDepth    int
+	MaxQueueDepth int
+	Running       int
+	// Submitted counts the tasks that were accepted, CallerRan those of them that the submitter ran itself
+	// (CallerRuns), and Rejected the ones turned away for any reason: full queue, cancelled while blocked, or shut down.
+	Submitted uint64
+	CallerRan uint64
+	Completed uint64
+	Rejected  uint64
+	// AvgWait is the average time a task spent in the queue, over the tasks that went through it; AvgRun is the
+	// average time a task took to run.
+	AvgWait time.Duration
+	AvgRun  time.Duration
+}
+
+// Stats returns the current numbers for e.
+func (e *Executor) Stats() ExecutorStats {
+	st := ExecutorStats{
+		Workers:       e.workers,
+		QueueDepth:    len(e.queue),
+		MaxQueueDepth: int(e.maxQueueDepth.Load()),
+		Running:       int(e.running.Load()),
+		Submitted:     e.submitted.Load(),
+		CallerRan:     e.callerRan.Load(),
+		Completed:     e.completed.Load(),
+		Rejected:      e.rejected.Load(),
+	}
+	if waited := e.waited.Load(); waited > 0 {
+		st.AvgWait = time.Duration(e.waitNanos.Load() / int64(waited))
+	}
+	if st.Completed > 0 {
+		st.AvgRun = time.Duration(e.runNanos.Load() / int64(st.Completed))
+	}
+	return st
+}
+
+func (st ExecutorStats) String() string {
+	return fmt.Sprintf("workers=%d queue=%d (max %d) running=%d submitted=%d (caller ran %d) completed=%d rejected=%d avg wait=%s avg run=%s",
+		st.Workers, st.QueueDepth, st.MaxQueueDepth, st.Running, st.Submitted, st.CallerRan, st.Completed, st.Rejected,
+		st.AvgWait.Round(time.Microsecond), st.AvgRun.Round(time.Microsecond))
+}
+
+// RunOn is Run, but the Func is run by one of e's workers. If e rejects the task, the Promise fails with the reason.
+func RunOn[T, V any](ctx context.Context, e *Executor, t T, f Func[T, V]) *Promise[V] {
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	p := Promise[V]{
+		done:   done,
+		cancel: cancel,
+	}
+	err := e.submit(ctx, func() {
+		defer close(done)
+		defer cancel()
+		//a Promise cancelled while it sat in the queue never starts
+		if err := ctx.Err(); err != nil {
+			p.err = err
+			return
+		}
+		defer track(ctx, f)()
+		p.val, p.err = safeCall(ctx, f, t)
+	})
+	if err != nil {
+		p.err = err
+		cancel()
+		close(done)
+	}
+	return &p
+}
+
+// ThenOn is Then, but the Func is run by one of e's workers.
+/*
+ThenOn still uses a goroutine of its own to wait for p, because a worker that sat waiting for p would be a worker not doing anything - and with every worker waiting on promises that are queued behind them, the pool would deadlock. The waiting goroutine does no work, so it is cheap; the Func itself only ever runs on a worker.
+*/
+func ThenOn[T, V any](ctx context.Context, e *Executor, p *Promise[T], f Func[T, V]) *Promise[V] {
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	out := Promise[V]{
+		done:   done,
+		cancel: cancel,
+		stage:  p.stage + 1,
+	}
+	fail := func(err error) {
+		out.err = err
+		cancel()
+		close(done)
+	}
+	go func() {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			fail(ctx.Err())
+			return
+		}
+		val, err := p.Get()
+		if err != nil {
+			fail(err)
+			return
+		}
+		err = e.submit(ctx, func() {
+			defer close(done)
+			defer cancel()
+			if err := ctx.Err(); err != nil {
+				out.err = err
+				return
+			}
+			defer track(ctx, f)()
+			out.val, out.err = safeCall(ctx, f, val)
+			out.err = stageError(out.stage, f, out.err)
+		})
+		if err != nil {
+			fail(err)
+		}
+	}()
+	return &out
+}
+
+/*
+Decorators
+
+WithCancellation takes a Func and returns a Func, so it can wrap anything and the result still works with Run and Then. The same closure trick gives us the usual tools for calling flaky services:
+
+WithRetry          - call again after a failure, waiting longer each time (exponential back-off), with some randomness (jitter) so a thousand clients don't all retry at the same moment
+WithTimeout        - give up after a fixed time
+WithCircuitBreaker - after too many failures in a row stop calling for a while ("open"), then let a few trial calls through ("half-open") to see if the service is back
+WithBulkhead       - allow only so many calls at once, so one slow dependency can't use up every goroutine
+
+They stack: WithRetry(WithTimeout(f, ...), ...) retries calls that time out (as long as the caller's own context is still live).
+
+Every one of them that waits takes a Clock, so tests can use a ManualClock and move time forward by hand instead of sleeping.
+*/
+
+// Clock is the source of time for the decorators.
+type Clock interface {
+	Now() time.Time
+	// After is time.After, plus a stop func for a caller that stops waiting early, so the timer does not linger.
+	After(d time.Duration) (<-chan time.Time, func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }
+}
+
+// RealClock is the Clock that uses the time package.
+var RealClock Clock = realClock{}
+
+// ManualClock is a Clock that only moves when Advance is called.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
+}
+
+type manualWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewManualClock returns a ManualClock set to start.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch, func() {}
+	}
+	c.waiters = append(c.waiters, manualWaiter{at: c.now.Add(d), ch: ch})
+	//stop takes the waiter out, so that BlockUntil does not count a goroutine that is not waiting any more
+	stop := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.waiters = slices.DeleteFunc(c.waiters, func(w manualWaiter) bool { return w.ch == ch })
+	}
+	return ch, stop
+}
+
+// Advance moves the clock forward by d and fires every After that is now due.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	kept := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			kept = append(kept, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = kept
+}
+
+// BlockUntil waits until at least n goroutines are waiting on After. Call it before Advance to be sure the code under test
+// has started waiting, otherwise the Advance can happen too early and be missed.
+func (c *ManualClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		got := len(c.waiters)
+		c.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// RetryPolicy configures WithRetry.
+type RetryPolicy struct {
+	// Attempts is the total number of calls, including the first one. Zero means 3.
+	Attempts int
+	// Base is the wait after the first failure; each later wait is Multiplier times longer, up to Max.
+	Base       time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter is the fraction of each wait that is random: 0 waits exactly, 1 waits anywhere between 0 and the full wait.
+	Jitter float64
+	// Retryable says whether an error is worth another try. Nil retries everything except context cancellation and
+	// deadlines, but does retry ErrTimeout from WithTimeout while the caller's context is still live.
+	Retryable func(error) bool
+	Clock     Clock
+	// Rand returns a number in [0, 1). Nil uses math/rand.
+	Rand func() float64
+}
+
+// Backoff returns the wait before attempt number n+1, after n failed attempts (n starts at 1).
+func (rp RetryPolicy) Backoff(n int) time.Duration {
+	mult := rp.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+	d := float64(rp.Base) * math.Pow(mult, float64(n-1))
+	if rp.Max > 0 && d > float64(rp.Max) {
+		d = float64(rp.Max)
+	}
+	if rp.Jitter > 0 {
+		r := rand.Float64
+		if rp.Rand != nil {
+			r = rp.Rand
+		}
+		d -= d * rp.Jitter * r()
+	}
+	return time.Duration(d)
+}
+
+// WithRetry takes in a Func and returns a Func that calls it again, after a back-off, when it fails with a retryable error.
+// The error of the last attempt is returned.
+func WithRetry[T, V any](f Func[T, V], rp RetryPolicy) Func[T, V] {
+	if rp.Attempts <= 0 {
+		rp.Attempts = 3
+	}
+	if rp.Clock == nil {
+		rp.Clock = RealClock
+	}
+	retryable := rp.Retryable
+	return func(ctx context.Context, t T) (V, error) {
+		var val V
+		var err error
+		for n := 1; ; n++ {
+			val, err = f(ctx, t)
+			if err == nil || n == rp.Attempts {
+				return val, err
+			}
+			if retryable != nil && !retryable(err) || retryable == nil && !defaultRetryable(ctx, err) {
+				return val, err
+			}
+			wait, stop := rp.Clock.After(rp.Backoff(n))
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				stop()
+				var zero V
+				return zero, ctx.Err()
+			}
+		}
+	}
+}
+
+// defaultRetryable is the Retryable of a RetryPolicy that has none. ErrTimeout matches context.DeadlineExceeded, but
+// it is WithTimeout giving up on one attempt, not the caller giving up on all of them.
+func defaultRetryable(ctx context.Context, err error) bool {
+	if errors.Is(err, ErrTimeout) {
+		return ctx.Err() == nil
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// ErrTimeout is returned by a Func decorated with WithTimeout when it runs out of time. It matches context.DeadlineExceeded with errors.Is.
+var ErrTimeout = fmt.Errorf("timed out: %w", context.DeadlineExceeded)
+
+// WithTimeout takes in a Func and returns a Func that gives up with ErrTimeout after d, measured on clock (nil means RealClock).
+// Like WithCancellation, it returns at the deadline and cancels the context of the passed-in Func.
+func WithTimeout[T, V any](f Func[T, V], d time.Duration, clock Clock) Func[T, V] {
+	if clock == nil {
+		clock = RealClock
+	}
+	inner := WithCancellation(f)
+	return func(ctx context.Context, t T) (V, error) {
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		timer, stop := clock.After(d)
+		go func() {
+			select {
+			case <-timer:
+				cancel(ErrTimeout)
+			case <-ctx.Done():
+				stop()
+			}
+		}()
+		val, err := inner(ctx, t)
+		if err != nil && errors.Is(context.Cause(ctx), ErrTimeout) {
+			var zero V
+			return zero, ErrTimeout
+		}
+		return val, err
+	}
+}
+
+// ErrCircuitOpen is returned without calling the Func while a circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	Closed BreakerState = iota
+	Open
+	HalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker counts failures of the Funcs it guards. One breaker can guard several Funcs that call the same service.
+/*
+closed    --FailureThreshold failures in a row-->  open
+open      --OpenTimeout has passed-------------->  half-open
+half-open --SuccessThreshold successes---------->  closed
+half-open --any failure------------------------->  open
+*/
+type CircuitBreaker struct {
+	// FailureThreshold is how many failures in a row open the breaker. Zero means 5.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before letting trial calls through. Zero means 30 seconds.
+	OpenTimeout time.Duration
+	// HalfOpenMax is how many trial calls may be in flight while half-open. Zero means 1.
+	HalfOpenMax int
+	// SuccessThreshold is how many successful trial calls close the breaker again. Zero means 1.
+	SuccessThreshold int
+	// IsFailure says whether an error counts against the service. Nil counts every error except context cancellation by the caller.
+	IsFailure func(error) bool
+	// OnStateChange, if set, is called (with the breaker locked, so keep it short) on every change of state.
+	OnStateChange func(from, to BreakerState)
+	Clock         Clock
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	successes int
+	trials    int
+	openedAt  time.Time
+	//gen counts state changes; a call is recorded only in the state that admitted it
+	gen uint64
+}
+
+// State returns the current state, moving from open to half-open if OpenTimeout has passed.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.defaults()
+	cb.tick()
+	return cb.state
+}
+
+func (cb *CircuitBreaker) defaults() {
+	if cb.FailureThreshold <= 0 {
+		cb.FailureThreshold = 5
+	}
+	if cb.OpenTimeout <= 0 {
+		cb.OpenTimeout = 30 * time.Second
+	}
+	if cb.HalfOpenMax <= 0 {
+		cb.HalfOpenMax = 1
+	}
+	if cb.SuccessThreshold <= 0 {
+		cb.SuccessThreshold = 1
+	}
+	if cb.Clock == nil {
+		cb.Clock = RealClock
+	}
+	if cb.IsFailure == nil {
+		cb.IsFailure = func(err error) bool { return !errors.Is(err, context.Canceled) }
+	}
+}
+
+func (cb *CircuitBreaker) setState(to BreakerState) {
+	from := cb.state
+	cb.state = to
+	cb.failures, cb.successes, cb.trials = 0, 0, 0
+	cb.gen++
+	if to == Open {
+		cb.openedAt = cb.Clock.Now()
+	}
+	if cb.OnStateChange != nil && from != to {
+		cb.OnStateChange(from, to)
+	}
+}
+
+func (cb *CircuitBreaker) tick() {
+	if cb.state == Open && !cb.Clock.Now().Before(cb.openedAt.Add(cb.OpenTimeout)) {
+		cb.setState(HalfOpen)
+	}
+}
+
+// allow decides whether a call may go ahead, and counts it as a trial when half-open. It returns the generation
+// to pass to record.
+func (cb *CircuitBreaker) allow() (uint64, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.defaults()
+	cb.tick()
+	switch cb.state {
+	case Open:
+		return 0, ErrCircuitOpen
+	case HalfOpen:
+		if cb.trials >= cb.HalfOpenMax {
+			return 0, ErrCircuitOpen
+		}
+		cb.trials++
+	}
+	return cb.gen, nil
+}
+
+// record counts the outcome of a call that allow admitted in generation gen. A call that was admitted before the
+// last change of state says nothing about the new one (and was never one of its trials), so it is ignored.
+func (cb *CircuitBreaker) record(gen uint64, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if gen != cb.gen {
+		return
+	}
+	failed := err != nil && cb.IsFailure(err)
+	//an error that is not a failure (the caller cancelled) is not a success either
+	neutral := err != nil && !failed
+	switch cb.state {
+	case Closed:
+		if neutral {
+			return
+		}
+		if !failed {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= cb.FailureThreshold {
+			cb.setState(Open)
+		}
+	case HalfOpen:
+		if failed {
+			cb.setState(Open)
+			return
+		}
+		cb.trials--
+		if neutral {
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.SuccessThreshold {
+			cb.setState(Closed)
+		}
+	}
+}
+
+// WithCircuitBreaker takes in a Func and returns a Func that is only called while cb lets it. When cb is open the call
+// fails straight away with ErrCircuitOpen.
+func WithCircuitBreaker[T, V any](f Func[T, V], cb *CircuitBreaker) Func[T, V] {
+	return func(ctx context.Context, t T) (V, error) {
+		gen, err := cb.allow()
+		if err != nil {
+			var zero V
+			return zero, err
+		}
+		//a panic counts as a failure, but it keeps going up to whoever recovers it (safeCall, if we run inside a Promise)
+		panicked := true
+		defer func() {
+			if panicked {
+				cb.record(gen, errors.New("panic"))
+			}
+		}()
+		val, err := f(ctx, t)
+		panicked = false
+		cb.record(gen, err)
+		return val, err
+	}
+}
+
+// ErrBulkheadFull is returned when a Bulkhead has no free slot within its MaxWait.
+var ErrBulkheadFull = errors.New("bulkhead is full")
+
+// Bulkhead limits how many calls run at the same time. Share one Bulkhead between the Funcs that use the same resource.
+type Bulkhead struct {
+	slots   chan struct{}
+	maxWait time.Duration
+	clock   Clock
+}
+
+// NewBulkhead allows max concurrent calls. A call that finds no free slot waits up to maxWait (zero means not at all)
+// on clock (nil means RealClock), then fails with ErrBulkheadFull.
+func NewBulkhead(max int, maxWait time.Duration, clock Clock) *Bulkhead {
+	if clock == nil {
+		clock = RealClock
+	}
+	return &Bulkhead{slots: make(chan struct{}, max), maxWait: maxWait, clock: clock}
+}
+
+// InUse returns the number of calls running now.
+func (b *Bulkhead) InUse() int {
+	return len(b.slots)
+}
+
+// WithBulkhead takes in a Func and returns a Func that only runs when b has a free slot.
+func WithBulkhead[T, V any](f Func[T, V], b *Bulkhead) Func[T, V] {
+	return func(ctx context.Context, t T) (V, error) {
+		var zero V
+		select {
+		case b.slots <- struct{}{}:
+		default:
+			if b.maxWait <= 0 {
+				return zero, ErrBulkheadFull
+			}
+			wait, stop := b.clock.After(b.maxWait)
+			select {
+			case b.slots <- struct{}{}:
+				stop()
+			case <-wait:
+				return zero, ErrBulkheadFull
+			case <-ctx.Done():
+				stop()
+				return zero, ctx.Err()
+			}
+		}
+		defer func() { <-b.slots }()
+		return f(ctx, t)
+	}
+}
+
+/*
+Detached Func detector
+
+A Func that ignores its context can't be stopped, and after Cancel it runs on detached from anyone waiting for it. To find those in tests, Run, Then and WithCancellation register every Func while it runs. context.AfterFunc notes the moment its context is cancelled, and the record is removed when the Func returns. Anything still registered well after being cancelled is a leak.
+
+Registering costs a sync.Map entry, a runtime.FuncForPC lookup and a context.AfterFunc per call, which production code should not pay for. So it is off until a test calls EnableLeakTracking; until then track does nothing.
+*/
+
+type funcRecord struct {
+	name        string
+	started     time.Time
+	cancelledAt atomic.Int64
+}
+
+var (
+	liveFuncs    sync.Map // *funcRecord -> struct{}
+	leakTracking atomic.Bool
+)
+
+// EnableLeakTracking makes Run, Then and WithCancellation register their Funcs for DetachedFuncs and CheckDetached,
+// and returns the function that turns it off again (for t.Cleanup). Funcs started while it is off are never reported.
+func EnableLeakTracking() (disable func()) {
+	leakTracking.Store(true)
+	return func() { leakTracking.Store(false) }
+}
+
+func untracked() {}
+
+// track registers f as running with ctx, and returns the function that unregisters it.
+// With leak tracking off it does nothing.
+func track(ctx context.Context, f any) func() {
+	if !leakTracking.Load() {
+		return untracked
+	}
+	rec := &funcRecord{name: funcName(f), started: time.Now()}
+	liveFuncs.Store(rec, struct{}{})
+	stop := context.AfterFunc(ctx, func() {
+		rec.cancelledAt.Store(time.Now().UnixNano())
+	})
+	return func() {
+		stop()
+		liveFuncs.Delete(rec)
+	}
+}
+
+func funcName(f any) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return "unknown"
+}
+
+// Detached describes a Func that is still running after its context was cancelled.
+type Detached struct {
+	Func           string
+	Running        time.Duration
+	SinceCancelled time.Duration
+}
+
+func (d Detached) String() string {
+	return fmt.Sprintf("%s still running %s after cancel (%s in total)", d.Func, d.SinceCancelled.Round(time.Millisecond), d.Running.Round(time.Millisecond))
+}
+
+// DetachedFuncs returns every Func that was cancelled at least grace ago and has still not returned, longest-cancelled first.
+func DetachedFuncs(grace time.Duration) []Detached {
+	now := time.Now()
+	var out []Detached
+	liveFuncs.Range(func(k, _ any) bool {
+		rec := k.(*funcRecord)
+		at := rec.cancelledAt.Load()
+		if at == 0 {
+			return true
+		}
+		if since := now.Sub(time.Unix(0, at)); since >= grace {
+			out = append(out, Detached{Func: rec.name, Running: now.Sub(rec.started), SinceCancelled: since})
+		}
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].SinceCancelled > out[j].SinceCancelled })
+	return out
+}
+
+// TB is the part of testing.TB that CheckDetached needs, so *testing.T can be passed straight in.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// CheckDetached gives cancelled Funcs up to grace to return, then reports every one that is still running as a test error.
+// Call it at the end of a test, or with t.Cleanup.
+func CheckDetached(t TB, grace time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(grace)
+	for {
+		leaks := DetachedFuncs(0)
+		if len(leaks) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, l := range leaks {
+				t.Errorf("detached Func: %s", l)
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// printT stands in for *testing.T so main can show what CheckDetached reports
+type printT struct{}
+
+func (printT) Helper() {}
+func (printT) Errorf(format string, args ...any) {
+	fmt.Printf("  FAIL: "+format+"\n", args...)
+}
+
 func main() {
 	ctx := context.Background()
 	p1 := Run(ctx, 10, func(ctx context.Context, i int) (int, error) {
@@ -189,8 +1352,280 @@ func main() {
 	})
 	val, err := p2.Get()
 	fmt.Println(val, err)
+
+	//sleepy returns i after i*10 milliseconds, or stops early when its context is cancelled. Odd numbers fail.
+	sleepy := func(ctx context.Context, i int) (int, error) {
+		select {
+		case <-time.After(time.Duration(i) * 10 * time.Millisecond):
+		case <-ctx.Done():
+			fmt.Println("  cancelled", i)
+			return 0, ctx.Err()
+		}
+		if i%2 == 1 {
+			return 0, fmt.Errorf("%d is odd", i)
+		}
+		return i, nil
+	}
+	start := func(is ...int) []*Promise[int] {
+		ps := make([]*Promise[int], len(is))
+		for n, i := range is {
+			ps[n] = Run(ctx, i, sleepy)
+		}
+		return ps
+	}
+
+	fmt.Println(All(start(2, 4, 6)...).Get())
+	fmt.Println(All(start(2, 3, 40)...).Get())
+	fmt.Println(AllSettled(start(2, 3, 4)...).Get())
+	fmt.Println(Any(start(1, 6, 40)...).Get())
+	fmt.Println(Any(start(1, 3)...).Get())
+	fmt.Println(Race(start(30, 1, 20)...).Get())
+	time.Sleep(50 * time.Millisecond)
+
+	//Cancel stops a Func that listens to its context; Get waits until it has actually returned
+	p3 := Run(ctx, 1000, sleepy)
+	p3.Cancel()
+	fmt.Println(p3.Get())
+
+	//a stubborn Func ignores ctx, so cancelling it only detaches it. CheckDetached notices, with leak tracking on.
+	disableTracking := EnableLeakTracking()
+	stubborn := func(ctx context.Context, i int) (int, error) {
+		time.Sleep(200 * time.Millisecond)
+		return i, nil
+	}
+	tctx, tcancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	fmt.Println(WithCancellation(stubborn)(tctx, 7))
+	tcancel()
+	CheckDetached(printT{}, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	fmt.Println("after it returns:", len(DetachedFuncs(0)), "detached")
+	disableTracking()
+
+	//fan out over 1000 items with only 4 goroutines doing the work
+	square := func(ctx context.Context, i int) (int, error) {
+		time.Sleep(100 * time.Microsecond)
+		return i * i, nil
+	}
+	half := func(ctx context.Context, i int) (int, error) {
+		return i / 2, nil
+	}
+	ex := NewExecutor(4, 16, Block)
+	squares := make([]*Promise[int], 1000)
+	for i := range squares {
+		squares[i] = ThenOn(ctx, ex, RunOn(ctx, ex, i, square), half)
+	}
+	vals, err := All(squares...).Get()
+	fmt.Println(len(vals), vals[999], err)
+	ex.Shutdown()
+	fmt.Println(ex.Stats())
+
+	//with FailFast, anything that doesn't fit in the queue is turned away
+	ff := NewExecutor(1, 2, FailFast)
+	var burst []*Promise[int]
+	for i := 0; i < 10; i++ {
+		burst = append(burst, RunOn(ctx, ff, 10, sleepy))
+	}
+	settledBurst, _ := AllSettled(burst...).Get()
+	var rejected int
+	for _, p := range settledBurst {
+		if errors.Is(p.Err, ErrRejected) {
+			rejected++
+		}
+	}
+	ff.Shutdown()
+	ffStats := ff.Stats()
+	fmt.Println("rejected", rejected, "of 10 with FailFast; counted as submitted:", ffStats.Submitted == uint64(10-rejected), "rejected:", ffStats.Rejected == uint64(rejected))
+	RunOn(ctx, ff, 1, sleepy).Get()
+	fmt.Println("after Shutdown: rejected", ff.Stats().Rejected-ffStats.Rejected, "more, submitted", ff.Stats().Submitted-ffStats.Submitted, "more")
+
+	//with CallerRuns, what doesn't fit runs in the submitting goroutine, and spends no time in the queue
+	cr := NewExecutor(1, 1, CallerRuns)
+	var crs []*Promise[int]
+	for i := 0; i < 10; i++ {
+		crs = append(crs, RunOn(ctx, cr, 2, sleepy))
+	}
+	All(crs...).Get()
+	cr.Shutdown()
+	crStats := cr.Stats()
+	fmt.Println("CallerRuns: submitted", crStats.Submitted, "completed", crStats.Completed, "caller ran some:", crStats.CallerRan > 0, "rejected", crStats.Rejected)
+
+	//a panic in the second step of a chain doesn't crash us; it comes back as an error that says where it happened
+	parse := func(ctx context.Context, s string) (int, error) {
+		return strconv.Atoi(s)
+	}
+	lookup := func(ctx context.Context, i int) (string, error) {
+		names := []string{"zero", "one", "two"}
+		return names[i], nil
+	}
+	chain := Then(ctx, Then(ctx, Run(ctx, "7", parse), lookup), func(ctx context.Context, s string) (string, error) {
+		return "name: " + s, nil
+	})
+	_, err = chain.Get()
+	var se *StageError
+	var pe *PanicError
+	if errors.As(err, &se) && errors.As(err, &pe) {
+		fmt.Println("stage", se.Stage, "panicked:", pe.Value)
+	}
+
+	//Catch swaps the failure for a fallback, Finally runs either way
+	safe := Finally(ctx, Catch(ctx, chain, func(ctx context.Context, err error) (string, error) {
+		return "name: unknown", nil
+	}), func(ctx context.Context) error {
+		fmt.Println("cleanup ran")
+		return nil
+	})
+	fmt.Println(safe.Get())
+	_, err = Then(ctx, Run(ctx, "x", parse), lookup).Get()
+	fmt.Println("unwrapped error from the head of the chain:", err)
+
+	//decorators, driven by a ManualClock so nothing really sleeps
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var calls int
+	flaky := func(ctx context.Context, s string) (string, error) {
+		calls++
+		if calls < 3 {
+			return "", fmt.Errorf("attempt %d failed", calls)
+		}
+		return "hello " + s, nil
+	}
+	retrying := WithRetry(flaky, RetryPolicy{Attempts: 5, Base: time.Second, Max: 10 * time.Second, Clock: clock})
+	pr := Run(ctx, "world", retrying)
+	for i := 1; i <= 2; i++ {
+		clock.BlockUntil(1)
+		fmt.Println("  backing off", RetryPolicy{Base: time.Second}.Backoff(i))
+		clock.Advance(RetryPolicy{Base: time.Second}.Backoff(i))
+	}
+	fmt.Println(pr.Get())
+
+	never := func(ctx context.Context, s string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	pt := Run(ctx, "x", WithTimeout(never, 5*time.Second, clock))
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+	_, err = pt.Get()
+	fmt.Println(err, errors.Is(err, context.DeadlineExceeded))
+
+	//WithRetry around WithTimeout: the first attempt times out, the retry answers
+	var tries atomic.Int32
+	slowOnce := func(ctx context.Context, s string) (string, error) {
+		if tries.Add(1) == 1 {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return "answered on try 2", nil
+	}
+	prt := Run(ctx, "x", WithRetry(WithTimeout(slowOnce, 5*time.Second, clock), RetryPolicy{Base: time.Second, Clock: clock}))
+	clock.BlockUntil(1)
+	clock.Advance(5 * time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	fmt.Println(prt.Get())
+
+	cb := &CircuitBreaker{FailureThreshold: 2, OpenTimeout: time.Minute, Clock: clock,
+		OnStateChange: func(from, to BreakerState) { fmt.Println("  breaker:", from, "->", to) }}
+	down := true
+	service := WithCircuitBreaker(func(ctx context.Context, s string) (string, error) {
+		if down {
+			return "", errors.New("503")
+		}
+		return "ok", nil
+	}, cb)
+	for i := 0; i < 3; i++ {
+		_, err := service(ctx, "")
+		fmt.Println(" ", err)
+	}
+	down = false
+	clock.Advance(time.Minute)
+	fmt.Println(service(ctx, ""))
+
+	//a call let through while closed that ends after the breaker opened and went half-open is not a trial of the
+	//half-open breaker, and its success must not close it
+	cb2 := &CircuitBreaker{FailureThreshold: 1, OpenTimeout: time.Minute, Clock: clock}
+	admitted, release := make(chan struct{}), make(chan struct{})
+	guarded := WithCircuitBreaker(func(ctx context.Context, s string) (string, error) {
+		switch s {
+		case "slow":
+			close(admitted)
+			<-release
+		case "fail":
+			return "", errors.New("503")
+		}
+		return "ok", nil
+	}, cb2)
+	stale := Run(ctx, "slow", guarded)
+	<-admitted
+	guarded(ctx, "fail")
+	clock.Advance(time.Minute)
+	fmt.Println("  breaker:", cb2.State())
+	close(release)
+	stale.Get()
+	fmt.Println("  after the old call succeeds:", cb2.State())
+
+	bh := NewBulkhead(1, 0, clock)
+	hold := make(chan struct{})
+	slow := WithBulkhead(func(ctx context.Context, s string) (string, error) {
+		<-hold
+		return s, nil
+	}, bh)
+	first := Run(ctx, "first", slow)
+	for bh.InUse() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fmt.Println(slow(ctx, "second"))
+	close(hold)
+	fmt.Println(first.Get())
 }
 
 /*
 two new types( Func and Promise )and three functions (Run, WithCancellation, and Then
 */
+
+/*
+Result
+go run genericscondemo.go
+
+20 <nil>
+[2 4 6] <nil>
+  cancelled 40
+[] 3 is odd
+[{2 <nil>} {0 3 is odd} {4 <nil>}] <nil>
+  cancelled 40
+6 <nil>
+0 all 2 promises failed: 1 is odd
+3 is odd
+0 1 is odd
+  cancelled 20
+  cancelled 30
+  cancelled 1000
+0 context canceled
+0 context deadline exceeded
+  FAIL: detached Func: main.main.func5 still running 50ms after cancel (60ms in total)
+after it returns: 0 detached
+1000 499000 <nil>
+workers=4 queue=0 (max 16) running=0 submitted=2000 (caller ran 0) completed=2000 rejected=0 avg wait=331µs avg run=61µs
+rejected 7 of 10 with FailFast; counted as submitted: true rejected: true
+after Shutdown: rejected 1 more, submitted 0 more
+CallerRuns: submitted 10 completed 10 caller ran some: true rejected 0
+stage 1 panicked: runtime error: index out of range [7] with length 3
+cleanup ran
+name: unknown <nil>
+unwrapped error from the head of the chain: strconv.Atoi: parsing "x": invalid syntax
+  backing off 1s
+  backing off 2s
+hello world <nil>
+timed out: context deadline exceeded true
+answered on try 2 <nil>
+  503
+  breaker: closed -> open
+  503
+  circuit breaker is open
+  breaker: open -> half-open
+  breaker: half-open -> closed
+ok <nil>
+  breaker: half-open
+  after the old call succeeds: half-open
+ bulkhead is full
+first <nil>
+*/
@@ -0,0 +1,481 @@
+//Streaming pipelines with generics: the Func type from genericscondemo.go, applied to channels of values instead of one value at a time
+
+/*
+genericscondemo.go chains single values: Run produces one value, Then turns it into another. Most real work is a stream: lines of a file, rows from a database, messages from a queue. In Go a stream is a channel, and a pipeline is a chain of goroutines connected by channels, each one a stage that reads from the channel before it and writes to the channel after it.
+
+We will:
+
+Reuse Func[T, V] as the function each stage applies, so anything written for Run and Then also works here
+Build the usual stages: Map, Filter, FlatMap, Batch, ParallelMap, Merge and Tee
+Stop on the first error: the first stage to fail records its error and cancels a shared context
+Tear everything down on cancellation: every stage selects on ctx.Done() on every send and receive, so no goroutine is left blocked on a channel nobody reads
+
+A Pipeline is the shared part: the context, the first error, and a WaitGroup over every stage goroutine. Wait returns once they have all exited.
+
+go run genericspipeline.go
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Func is the same type as in genericscondemo.go: a function that takes a context and a T, and returns a V or an error.
+type Func[T, V any] func(context.Context, T) (V, error)
+
+// Pipeline ties stages together: they share one context, and the first error from any stage cancels it.
+type Pipeline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	err    error
+	waited bool
+}
+
+// NewPipeline returns a Pipeline whose stages stop when ctx is cancelled.
+func NewPipeline(ctx context.Context) *Pipeline {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Pipeline{ctx: ctx, cancel: cancel}
+}
+
+// Context returns the context shared by the stages. It is cancelled on the first error.
+func (p *Pipeline) Context() context.Context {
+	return p.ctx
+}
+
+// Fail records err (if it is the first) and cancels every stage.
+func (p *Pipeline) Fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	p.cancel()
+}
+
+// Wait waits for every stage goroutine to exit and returns the first error. If the pipeline was stopped by cancelling the
+// context passed to NewPipeline, that context's error is returned.
+func (p *Pipeline) Wait() error {
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.waited {
+		p.waited = true
+		if p.err == nil {
+			//nil after a clean finish, or the parent's error if it was cancelled
+			p.err = p.ctx.Err()
+		}
+		p.cancel()
+	}
+	return p.err
+}
+
+func (p *Pipeline) stage(fn func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		fn()
+	}()
+}
+
+// send delivers v unless the pipeline is cancelled first.
+func send[T any](ctx context.Context, out chan<- T, v T) bool {
+	select {
+	case out <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// recv receives the next value. ok is false when in is closed or the pipeline is cancelled.
+func recv[T any](ctx context.Context, in <-chan T) (v T, ok bool) {
+	select {
+	case v, ok = <-in:
+		return v, ok
+	case <-ctx.Done():
+		return v, false
+	}
+}
+
+// Source turns a slice into the first stage of a pipeline.
+func Source[T any](p *Pipeline, items ...T) <-chan T {
+	out := make(chan T)
+	p.stage(func() {
+		defer close(out)
+		for _, v := range items {
+			if !send(p.ctx, out, v) {
+				return
+			}
+		}
+	})
+	return out
+}
+
+// Map applies f to every value.
+func Map[T, V any](p *Pipeline, in <-chan T, f Func[T, V]) <-chan V {
+	out := make(chan V)
+	p.stage(func() {
+		defer close(out)
+		for {
+			v, ok := recv(p.ctx, in)
+			if !ok {
+				return
+			}
+			r, err := f(p.ctx, v)
+			if err != nil {
+				p.Fail(fmt.Errorf("map: %w", err))
+				return
+			}
+			if !send(p.ctx, out, r) {
+				return
+			}
+		}
+	})
+	return out
+}
+
+// Filter passes on the values for which keep returns true.
+func Filter[T any](p *Pipeline, in <-chan T, keep Func[T, bool]) <-chan T {
+	out := make(chan T)
+	p.stage(func() {
+		defer close(out)
+		for {
+			v, ok := recv(p.ctx, in)
+			if !ok {
+				return
+			}
+			k, err := keep(p.ctx, v)
+			if err != nil {
+				p.Fail(fmt.Errorf("filter: %w", err))
+				return
+			}
+			if k && !send(p.ctx, out, v) {
+				return
+			}
+		}
+	})
+	return out
+}
+
+// FlatMap applies f to every value and passes on each element of the slices it returns.
+func FlatMap[T, V any](p *Pipeline, in <-chan T, f Func[T, []V]) <-chan V {
+	out := make(chan V)
+	p.stage(func() {
+		defer close(out)
+		for {
+			v, ok := recv(p.ctx, in)
+			if !ok {
+				return
+			}
+			rs, err := f(p.ctx, v)
+			if err != nil {
+				p.Fail(fmt.Errorf("flatmap: %w", err))
+				return
+			}
+			for _, r := range rs {
+				if !send(p.ctx, out, r) {
+					return
+				}
+			}
+		}
+	})
+	return out
+}
+
+// Batch groups values into slices of n. A smaller batch is sent when maxWait has passed since the first value of the
+// batch arrived, so a slow trickle of values is not held back forever, and at the end of the input.
+func Batch[T any](p *Pipeline, in <-chan T, n int, maxWait time.Duration) <-chan []T {
+	out := make(chan []T)
+	p.stage(func() {
+		defer close(out)
+		var batch []T
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		flush := func() bool {
+			if timer != nil {
+				timer.Stop()
+				timer, timeout = nil, nil
+			}
+			if len(batch) == 0 {
+				return true
+			}
+			b := batch
+			batch = nil
+			return send(p.ctx, out, b)
+		}
+		for {
+			select {
+			case v, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+				batch = append(batch, v)
+				if len(batch) == 1 && maxWait > 0 {
+					timer = time.NewTimer(maxWait)
+					timeout = timer.C
+				}
+				if len(batch) >= n && !flush() {
+					return
+				}
+			case <-timeout:
+				if !flush() {
+					return
+				}
+			case <-p.ctx.Done():
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+		}
+	})
+	return out
+}
+
+// ParallelMap applies f to values on the given number of worker goroutines. With ordered, values come out in the order
+// they went in; otherwise they come out as soon as they are done.
+/*
+Keeping the order without holding everything in memory: for every input value the dispatcher makes a slot, a channel with room for one result, and puts it in a queue of slots before handing the value to a worker. The emitter takes slots off the queue in order and waits on each one. The queue has room for only a few slots, so a slow item at the front holds back the dispatcher instead of letting results pile up.
+*/
+func ParallelMap[T, V any](p *Pipeline, in <-chan T, workers int, ordered bool, f Func[T, V]) <-chan V {
+	if workers < 1 {
+		workers = 1
+	}
+	out := make(chan V)
+	type job struct {
+		v    T
+		slot chan V
+	}
+	jobs := make(chan job)
+	apply := func(v T) (V, bool) {
+		r, err := f(p.ctx, v)
+		if err != nil {
+			p.Fail(fmt.Errorf("parallel map: %w", err))
+			return r, false
+		}
+		return r, true
+	}
+
+	if !ordered {
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			p.stage(func() {
+				defer wg.Done()
+				for {
+					v, ok := recv(p.ctx, in)
+					if !ok {
+						return
+					}
+					r, ok := apply(v)
+					if !ok || !send(p.ctx, out, r) {
+						return
+					}
+				}
+			})
+		}
+		p.stage(func() {
+			wg.Wait()
+			close(out)
+		})
+		return out
+	}
+
+	slots := make(chan chan V, workers)
+	p.stage(func() {
+		defer close(jobs)
+		defer close(slots)
+		for {
+			v, ok := recv(p.ctx, in)
+			if !ok {
+				return
+			}
+			slot := make(chan V, 1)
+			if !send(p.ctx, slots, slot) || !send(p.ctx, jobs, job{v, slot}) {
+				return
+			}
+		}
+	})
+	for i := 0; i < workers; i++ {
+		p.stage(func() {
+			for {
+				j, ok := recv(p.ctx, jobs)
+				if !ok {
+					return
+				}
+				//a failure cancels everything straight away, without waiting for the emitter to reach this slot
+				r, ok := apply(j.v)
+				if !ok {
+					return
+				}
+				j.slot <- r
+			}
+		})
+	}
+	p.stage(func() {
+		defer close(out)
+		for {
+			slot, ok := recv(p.ctx, slots)
+			if !ok {
+				return
+			}
+			r, ok := recv(p.ctx, slot)
+			if !ok {
+				return
+			}
+			if !send(p.ctx, out, r) {
+				return
+			}
+		}
+	})
+	return out
+}
+
+// Merge combines several channels into one, in whatever order values arrive. The output closes when every input has closed.
+func Merge[T any](p *Pipeline, ins ...<-chan T) <-chan T {
+	out := make(chan T)
+	var wg sync.WaitGroup
+	wg.Add(len(ins))
+	for _, in := range ins {
+		p.stage(func() {
+			defer wg.Done()
+			for {
+				v, ok := recv(p.ctx, in)
+				if !ok || !send(p.ctx, out, v) {
+					return
+				}
+			}
+		})
+	}
+	p.stage(func() {
+		wg.Wait()
+		close(out)
+	})
+	return out
+}
+
+// Tee copies every value to n outputs. Each value is delivered to every output before the next one is read, so the
+// slowest reader sets the pace; every output must be read, or the pipeline stalls.
+func Tee[T any](p *Pipeline, in <-chan T, n int) []<-chan T {
+	outs := make([]chan T, n)
+	ro := make([]<-chan T, n)
+	for i := range outs {
+		outs[i] = make(chan T)
+		ro[i] = outs[i]
+	}
+	p.stage(func() {
+		defer func() {
+			for _, o := range outs {
+				close(o)
+			}
+		}()
+		for {
+			v, ok := recv(p.ctx, in)
+			if !ok {
+				return
+			}
+			for _, o := range outs {
+				if !send(p.ctx, o, v) {
+					return
+				}
+			}
+		}
+	})
+	return ro
+}
+
+// Collect reads everything from in, then waits for the pipeline and returns what was read with the pipeline's error.
+func Collect[T any](p *Pipeline, in <-chan T) ([]T, error) {
+	var all []T
+	for {
+		v, ok := recv(p.ctx, in)
+		if !ok {
+			break
+		}
+		all = append(all, v)
+	}
+	return all, p.Wait()
+}
+
+func main() {
+	ctx := context.Background()
+	before := runtime.NumGoroutine()
+
+	isEven := func(ctx context.Context, i int) (bool, error) {
+		return i%2 == 0, nil
+	}
+	slowSquare := func(ctx context.Context, i int) (int, error) {
+		//later items finish first, so an unordered map would shuffle them
+		select {
+		case <-time.After(time.Duration(20-i) * time.Millisecond):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		return i * i, nil
+	}
+
+	nums := make([]int, 20)
+	for i := range nums {
+		nums[i] = i + 1
+	}
+
+	//1..20 -> even numbers -> squared on 4 workers, in order -> batches of 3
+	p := NewPipeline(ctx)
+	batches, err := Collect(p, Batch(p, ParallelMap(p, Filter(p, Source(p, nums...), isEven), 4, true, slowSquare), 3, 50*time.Millisecond))
+	fmt.Println(batches, err)
+
+	//the same thing unordered
+	p = NewPipeline(ctx)
+	squares, err := Collect(p, ParallelMap(p, Filter(p, Source(p, nums...), isEven), 4, false, slowSquare))
+	fmt.Println(squares, err)
+
+	//FlatMap, Tee and Merge: split words into letters, copy the stream twice, and merge the copies back
+	p = NewPipeline(ctx)
+	letters := FlatMap(p, Source(p, "go", "gopher"), func(ctx context.Context, s string) ([]string, error) {
+		var out []string
+		for _, r := range s {
+			out = append(out, string(r))
+		}
+		return out, nil
+	})
+	copies := Tee(p, letters, 2)
+	upper := Map(p, copies[1], func(ctx context.Context, s string) (string, error) {
+		return string(s[0] - 'a' + 'A'), nil
+	})
+	all, err := Collect(p, Merge(p, copies[0], upper))
+	fmt.Println(len(all), "letters", err)
+
+	//the first error stops every stage, even the ones that were still busy
+	p = NewPipeline(ctx)
+	failing := Map(p, Source(p, nums...), func(ctx context.Context, i int) (int, error) {
+		if i == 7 {
+			return 0, fmt.Errorf("bad item %d", i)
+		}
+		return i, nil
+	})
+	got, err := Collect(p, ParallelMap(p, failing, 4, true, slowSquare))
+	fmt.Println(len(got) < 7, err)
+
+	time.Sleep(10 * time.Millisecond)
+	fmt.Println("goroutines left behind:", runtime.NumGoroutine()-before)
+}
+
+/*
+Result
+go run genericspipeline.go
+
+[[4 16 36] [64 100 144] [196 256 324] [400]] <nil>
+[64 36 16 4 256 100 144 196 400 324] <nil>   (unordered: changes from run to run)
+16 letters <nil>
+true map: bad item 7
+goroutines left behind: 0
+*/
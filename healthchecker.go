@@ -0,0 +1,637 @@
+//Health checker: concurrencytimingdemo.go made into a monitoring service
+/*
+concurrencytimingdemo.go checks eight websites with http.Get, one after the other or all at once with a WaitGroup, and prints "is up" or "is down". As a monitor that has a few problems: it never closes the response bodies (so connections are never reused, and a long-running program leaks them), http.Get has no timeout (a site that accepts the connection and never answers blocks forever), "up" only means "answered", and it checks once.
+
+Checker fixes those, and keeps checking:
+
+1. Targets are configured, each with its own interval and timeout (or the defaults from CheckerConfig)
+2. A check passes when the answer has the expected status (any 2xx if ExpectStatus is zero) and, if BodyMatch is set, the body matches it. A page that says "down for maintenance" with a 200 is down
+3. Every check runs with a context timeout, and always reads (up to a limit) and closes the body
+4. At most Concurrency checks run at the same time: the WaitGroup version starts all of them at once, which is fine for 8 sites and not for 800
+5. Every target keeps its last latencies, for percentiles (the LatencyTracker of conpatternhedge.go)
+6. Every target keeps a history of its state changes: when it went down, why, and when it came back. OnChange is told about each one, for alerting
+7. Handler serves everything as JSON: GET /status, or /status?target=name for one target
+
+Run checks every target on its own ticker until its context ends. CheckAll checks them all once, as concurrencytimingdemo.go did.
+
+The demo uses local httptest servers instead of real websites, so it gives the same answers every time.
+
+go run healthchecker.go
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Target is one URL to check.
+type Target struct {
+	Name string
+	URL  string
+	// Interval and Timeout override the CheckerConfig defaults when not zero.
+	Interval time.Duration
+	Timeout  time.Duration
+	// ExpectStatus is the status code a healthy target answers with. Zero means any 2xx.
+	ExpectStatus int
+	// BodyMatch, if not nil, must match the start of the body (the first MaxBody bytes).
+	BodyMatch *regexp.Regexp
+}
+
+// CheckerConfig configures a Checker.
+type CheckerConfig struct {
+	Targets []Target
+	// Interval is how often a target is checked. Zero means 30s.
+	Interval time.Duration
+	// Timeout is how long a check may take. Zero means 5s.
+	Timeout time.Duration
+	// Concurrency is how many checks run at the same time at most. Zero means 4.
+	Concurrency int
+	// History is how many state changes are kept per target. Zero means 20.
+	History int
+	// Samples is how many latencies are kept per target for the percentiles. Zero means 100.
+	Samples int
+	// MaxBody is how much of the body is read. Zero means 64 KiB.
+	MaxBody int64
+	// Client makes the requests. Nil means a client without a timeout of its own: every check has its context.
+	Client *http.Client
+	// OnChange, if not nil, is called after every state change, from the goroutine that made the check.
+	OnChange func(target string, c StateChange)
+}
+
+// State is what a target was found to be.
+type State int
+
+const (
+	Unknown State = iota
+	Up
+	Down
+)
+
+func (s State) String() string {
+	return [...]string{"unknown", "up", "down"}[s]
+}
+
+// MarshalText makes a State show up in JSON as "up" or "down".
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText is the reverse of MarshalText, for clients of the status endpoint.
+func (s *State) UnmarshalText(b []byte) error {
+	for i, name := range [...]string{"unknown", "up", "down"} {
+		if string(b) == name {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("healthchecker: unknown state %q", b)
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Target  string
+	Time    time.Time
+	State   State
+	Status  int
+	Latency time.Duration
+	// Err says why the check failed.
+	Err error
+}
+
+// StateChange is one entry of the history of a target.
+type StateChange struct {
+	Time   time.Time `json:"time"`
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Latencies are percentiles of the last Samples latencies, in milliseconds.
+type Latencies struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// TargetStatus is what Status reports about one target.
+type TargetStatus struct {
+	Name       string        `json:"name"`
+	URL        string        `json:"url"`
+	State      State         `json:"state"`
+	Since      time.Time     `json:"since,omitzero"`
+	LastCheck  time.Time     `json:"last_check,omitzero"`
+	LastStatus int           `json:"last_status,omitempty"`
+	LastError  string        `json:"last_error,omitempty"`
+	Checks     int           `json:"checks"`
+	Failures   int           `json:"failures"`
+	Latency    *Latencies    `json:"latency_ms,omitempty"`
+	History    []StateChange `json:"history"`
+}
+
+// Report is the answer of the status endpoint.
+type Report struct {
+	// Status is "ok" when every target is up, "degraded" otherwise.
+	Status  string         `json:"status"`
+	Targets []TargetStatus `json:"targets"`
+}
+
+// LatencyTracker keeps the last latencies in a ring buffer.
+type LatencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// NewLatencyTracker remembers the last size latencies.
+func NewLatencyTracker(size int) *LatencyTracker {
+	return &LatencyTracker{samples: make([]time.Duration, size)}
+}
+
+// Observe records one latency.
+func (t *LatencyTracker) Observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.next] = d
+	t.next++
+	if t.next == len(t.samples) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// Percentile returns the p-th percentile (0 < p <= 100) of the recorded latencies, and false if there are none yet.
+func (t *LatencyTracker) Percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	n := t.next
+	if t.full {
+		n = len(t.samples)
+	}
+	sorted := slices.Clone(t.samples[:n])
+	t.mu.Unlock()
+	if n == 0 {
+		return 0, false
+	}
+	slices.Sort(sorted)
+	i := int(float64(n)*p/100+0.5) - 1
+	i = max(0, min(n-1, i))
+	return sorted[i], true
+}
+
+type targetState struct {
+	Target
+	latency *LatencyTracker
+
+	mu         sync.Mutex
+	state      State
+	since      time.Time
+	last       Result
+	checks     int
+	failures   int
+	history    []StateChange
+	maxHistory int
+}
+
+// Checker checks targets and remembers what it found.
+type Checker struct {
+	cfg     CheckerConfig
+	targets []*targetState
+	byName  map[string]*targetState
+	sem     chan struct{}
+}
+
+// NewChecker validates the targets and fills in the defaults.
+func NewChecker(cfg CheckerConfig) (*Checker, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 4
+	}
+	if cfg.History <= 0 {
+		cfg.History = 20
+	}
+	if cfg.Samples <= 0 {
+		cfg.Samples = 100
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = 64 << 10
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+	c := &Checker{cfg: cfg, byName: make(map[string]*targetState), sem: make(chan struct{}, cfg.Concurrency)}
+	for _, t := range cfg.Targets {
+		if t.Name == "" {
+			return nil, errors.New("healthchecker: target without a name")
+		}
+		if _, dup := c.byName[t.Name]; dup {
+			return nil, fmt.Errorf("healthchecker: two targets named %q", t.Name)
+		}
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("healthchecker: target %s: bad URL %q", t.Name, t.URL)
+		}
+		if t.Interval <= 0 {
+			t.Interval = cfg.Interval
+		}
+		if t.Timeout <= 0 {
+			t.Timeout = cfg.Timeout
+		}
+		ts := &targetState{Target: t, latency: NewLatencyTracker(cfg.Samples), maxHistory: cfg.History}
+		c.targets = append(c.targets, ts)
+		c.byName[t.Name] = ts
+	}
+	return c, nil
+}
+
+// Run checks every target right away and then every Interval, until ctx ends. A check that takes longer than the
+// interval makes the next one wait, rather than piling up.
+func (c *Checker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range c.targets {
+		wg.Go(func() {
+			tick := time.NewTicker(t.Interval)
+			defer tick.Stop()
+			for {
+				c.check(ctx, t)
+				select {
+				case <-tick.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// CheckAll checks every target once, Concurrency at a time, and returns the results in the order of the targets.
+func (c *Checker) CheckAll(ctx context.Context) []Result {
+	results := make([]Result, len(c.targets))
+	var wg sync.WaitGroup
+	for i, t := range c.targets {
+		wg.Go(func() { results[i] = c.check(ctx, t) })
+	}
+	wg.Wait()
+	return results
+}
+
+// check waits for a free slot, checks t and records the result.
+func (c *Checker) check(ctx context.Context, t *targetState) Result {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return Result{Target: t.Name, Time: time.Now(), State: Unknown, Err: ctx.Err()}
+	}
+	r := c.probe(ctx, t.Target)
+	<-c.sem
+	if ctx.Err() != nil {
+		//we are shutting down; a check cut short by that says nothing about the target
+		return r
+	}
+	c.record(t, r)
+	return r
+}
+
+// probe makes one request and decides whether the answer is healthy.
+func (c *Checker) probe(ctx context.Context, t Target) Result {
+	r := Result{Target: t.Name, Time: time.Now(), State: Down}
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	res, err := c.cfg.Client.Do(req)
+	if err != nil {
+		r.Latency = time.Since(r.Time)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("no answer within %v", t.Timeout)
+		}
+		r.Err = err
+		return r
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, c.cfg.MaxBody))
+	//the rest of a long body is read too, or the connection cannot be used again
+	io.Copy(io.Discard, res.Body)
+	r.Latency = time.Since(r.Time)
+	r.Status = res.StatusCode
+	switch {
+	case err != nil:
+		r.Err = fmt.Errorf("reading body: %w", err)
+	case t.ExpectStatus == 0 && (res.StatusCode < 200 || res.StatusCode > 299):
+		r.Err = fmt.Errorf("status %d, want 2xx", res.StatusCode)
+	case t.ExpectStatus != 0 && res.StatusCode != t.ExpectStatus:
+		r.Err = fmt.Errorf("status %d, want %d", res.StatusCode, t.ExpectStatus)
+	case t.BodyMatch != nil && !t.BodyMatch.Match(body):
+		r.Err = fmt.Errorf("body does not match %s", t.BodyMatch)
+	default:
+		r.State = Up
+	}
+	return r
+}
+
+func (c *Checker) record(t *targetState, r Result) {
+	if r.Status != 0 {
+		//a timeout is not a latency: it would only say what the timeout is
+		t.latency.Observe(r.Latency)
+	}
+	t.mu.Lock()
+	t.last = r
+	t.checks++
+	if r.State != Up {
+		t.failures++
+	}
+	var change *StateChange
+	if r.State != t.state {
+		change = &StateChange{Time: r.Time, From: t.state, To: r.State}
+		if r.Err != nil {
+			change.Reason = r.Err.Error()
+		}
+		t.history = append(t.history, *change)
+		if len(t.history) > t.maxHistory {
+			t.history = slices.Delete(t.history, 0, len(t.history)-t.maxHistory)
+		}
+		t.state, t.since = r.State, r.Time
+	}
+	t.mu.Unlock()
+	if change != nil && c.cfg.OnChange != nil {
+		c.cfg.OnChange(t.Name, *change)
+	}
+}
+
+func (t *targetState) status() TargetStatus {
+	t.mu.Lock()
+	s := TargetStatus{
+		Name:       t.Name,
+		URL:        t.URL,
+		State:      t.state,
+		Since:      t.since,
+		LastCheck:  t.last.Time,
+		LastStatus: t.last.Status,
+		Checks:     t.checks,
+		Failures:   t.failures,
+		History:    slices.Clone(t.history),
+	}
+	if t.last.Err != nil {
+		s.LastError = t.last.Err.Error()
+	}
+	t.mu.Unlock()
+	if _, ok := t.latency.Percentile(50); ok {
+		ms := func(p float64) float64 {
+			d, _ := t.latency.Percentile(p)
+			return float64(d.Microseconds()) / 1000
+		}
+		s.Latency = &Latencies{P50: ms(50), P90: ms(90), P99: ms(99)}
+	}
+	return s
+}
+
+// Status returns the status of every target.
+func (c *Checker) Status() Report {
+	rep := Report{Status: "ok", Targets: make([]TargetStatus, 0, len(c.targets))}
+	for _, t := range c.targets {
+		s := t.status()
+		if s.State != Up {
+			rep.Status = "degraded"
+		}
+		rep.Targets = append(rep.Targets, s)
+	}
+	return rep
+}
+
+// Handler serves the status as JSON: every target, or one with ?target=name.
+func (c *Checker) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var v any = c.Status()
+		if name := r.URL.Query().Get("target"); name != "" {
+			t, ok := c.byName[name]
+			if !ok {
+				http.Error(w, "unknown target "+name, http.StatusNotFound)
+				return
+			}
+			v = t.status()
+		}
+		w.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	})
+}
+
+func main() {
+	//the eight websites of concurrencytimingdemo.go, as local servers that take 50ms to answer
+	var inFlight, maxInFlight atomic.Int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+		}
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintln(w, "ok")
+	}))
+	defer site.Close()
+	var eight []Target
+	for _, name := range []string{"stackoverflow", "github", "linkedin", "medium", "golang", "udemy", "coursera", "wesionary"} {
+		eight = append(eight, Target{Name: name, URL: site.URL + "/" + name})
+	}
+	for _, conc := range []int{1, 2, 8} {
+		c, _ := NewChecker(CheckerConfig{Targets: eight, Concurrency: conc})
+		maxInFlight.Store(0)
+		start := time.Now()
+		results := c.CheckAll(context.Background())
+		up := 0
+		for _, r := range results {
+			if r.State == Up {
+				up++
+			}
+		}
+		fmt.Printf("Concurrency %d: %d/8 up in %v, at most %d at the same time\n",
+			conc, up, time.Since(start).Round(50*time.Millisecond), maxInFlight.Load())
+	}
+
+	//targets that fail in the ways http.Get cannot tell apart from "up", or cannot notice at all
+	var broken atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, `{"status":"ok"}`) })
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "down for maintenance") })
+	mux.HandleFunc("/teapot", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if broken.Load() {
+			http.Error(w, "database unavailable", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, `{"status":"ok"}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	ok := regexp.MustCompile(`"status":\s*"ok"`)
+	changes := make(chan string, 100)
+	c, _ := NewChecker(CheckerConfig{
+		Targets: []Target{
+			{Name: "api", URL: srv.URL + "/health", BodyMatch: ok},
+			{Name: "slow", URL: srv.URL + "/slow", Timeout: 100 * time.Millisecond},
+			{Name: "maintenance", URL: srv.URL + "/maintenance", BodyMatch: ok},
+			{Name: "teapot", URL: srv.URL + "/teapot", ExpectStatus: http.StatusTeapot},
+			{Name: "flaky", URL: srv.URL + "/flaky", BodyMatch: ok},
+		},
+		Interval:    20 * time.Millisecond,
+		Concurrency: 3,
+		OnChange: func(target string, c StateChange) {
+			line := fmt.Sprintf("%s: %s -> %s", target, c.From, c.To)
+			if c.Reason != "" {
+				line += " (" + c.Reason + ")"
+			}
+			changes <- line
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	//flaky breaks for a while, then comes back
+	time.Sleep(150 * time.Millisecond)
+	broken.Store(true)
+	time.Sleep(150 * time.Millisecond)
+	broken.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	cancel()
+	<-done
+	close(changes)
+	//OnChange is called from several goroutines, so targets can be interleaved; per target the order is right
+	var log []string
+	for s := range changes {
+		log = append(log, s)
+	}
+	order := func(line string) int {
+		name, _, _ := strings.Cut(line, ":")
+		return slices.IndexFunc(c.targets, func(t *targetState) bool { return t.Name == name })
+	}
+	slices.SortStableFunc(log, func(a, b string) int { return order(a) - order(b) })
+	for _, s := range log {
+		fmt.Println(s)
+	}
+
+	//the JSON endpoint
+	status := httptest.NewServer(c.Handler())
+	defer status.Close()
+	res, _ := http.Get(status.URL + "/status")
+	var rep Report
+	if err := json.NewDecoder(res.Body).Decode(&rep); err != nil {
+		fmt.Println(err)
+	}
+	res.Body.Close()
+	fmt.Println("status:", rep.Status)
+	for _, t := range rep.Targets {
+		p := "no latency"
+		if t.Latency != nil {
+			p = fmt.Sprintf("p50 <= p90 <= p99: %v", t.Latency.P50 <= t.Latency.P90 && t.Latency.P90 <= t.Latency.P99)
+		}
+		if t.LastError != "" {
+			p += ", last error: " + t.LastError
+		}
+		fmt.Printf("  %-11s %-4s changes %d, %s\n", t.Name, t.State, len(t.History), p)
+	}
+	res, _ = http.Get(status.URL + "/status?target=flaky")
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	fmt.Print(string(body))
+	res, _ = http.Get(status.URL + "/status?target=nope")
+	res.Body.Close()
+	fmt.Println("unknown target:", res.Status)
+}
+
+/*
+Result
+go run healthchecker.go
+
+Concurrency 1: 8/8 up in 400ms, at most 1 at the same time
+Concurrency 2: 8/8 up in 200ms, at most 2 at the same time
+Concurrency 8: 8/8 up in 50ms, at most 8 at the same time
+api: unknown -> up
+slow: unknown -> down (no answer within 100ms)
+maintenance: unknown -> down (body does not match "status":\s*"ok")
+teapot: unknown -> up
+flaky: unknown -> up
+flaky: up -> down (status 500, want 2xx)
+flaky: down -> up
+status: degraded
+  api         up   changes 1, p50 <= p90 <= p99: true
+  slow        down changes 1, no latency, last error: no answer within 100ms
+  maintenance down changes 1, p50 <= p90 <= p99: true, last error: body does not match "status":\s*"ok"
+  teapot      up   changes 1, p50 <= p90 <= p99: true
+  flaky       up   changes 3, p50 <= p90 <= p99: true
+{
+  "name": "flaky",
+  "url": "http://127.0.0.1:37617/flaky",
+  "state": "up",
+  "since": "2026-10-19T05:15:00.071775665Z",
+  "last_check": "2026-10-19T05:15:00.210077234Z",
+  "last_status": 200,
+  "checks": 23,
+  "failures": 7,
+  "latency_ms": {
+    "p50": 1.144,
+    "p90": 2.331,
+    "p99": 2.89
+  },
+  "history": [
+    {
+      "time": "2026-10-19T05:14:59.769782886Z",
+      "from": "unknown",
+      "to": "up"
+    },
+    {
+      "time": "2026-10-19T05:14:59.930193548Z",
+      "from": "up",
+      "to": "down",
+      "reason": "status 500, want 2xx"
+    },
+    {
+      "time": "2026-10-19T05:15:00.071775665Z",
+      "from": "down",
+      "to": "up"
+    }
+  ]
+}
+unknown target: 404 Not Found
+
+(the port, the times, the number of checks and the latencies change from run to run; the rest does not)
+
+Checking the eight sites takes 8 x 50ms one at a time, as in the first version of concurrencytimingdemo.go, and 50ms all at once, as in the WaitGroup version. Concurrency 2 is in between, and never has more than 2 requests out.
+http.Get would call slow, maintenance and teapot broken in the wrong way: it would wait a second for slow (or forever), and call maintenance up because it answers 200. teapot is up because 418 is what it was told to expect.
+flaky was up, went down when it started answering 500 and came back up: its history has all three changes, each with its time, and the reason it went down.
+*/
@@ -0,0 +1,486 @@
+//Goroutine leak check and watchdog: proving that goroutines end, instead of sleeping and hoping
+/*
+goroutine.go, conpatterndrop.go and conpatternfanout.go end with time.Sleep, to give their goroutines time to finish. Nothing checks that they did. statefulgoroutines.go starts 110 goroutines that loop forever; when main returns they are simply killed. In a program that runs for weeks, or in a test suite that runs the same code a thousand times, a goroutine that never ends is a leak: it holds its stack, everything it references, and often a connection or a file.
+
+Two tools for tests:
+
+CheckLeaks takes a snapshot of every running goroutine at the start of a test, and when the test ends (t.Cleanup) it takes another. A goroutine in the second snapshot but not the first was started by the test and never ended. Goroutines often need a moment to finish after the test body returns, so CheckLeaks polls for up to Grace before it calls anything a leak. The report groups leaked goroutines with the same stack ("100 goroutines like this") and prints the stack, with the "created by" line that says where the goroutine was started.
+
+Watchdog is for the opposite problem: a test that never ends, usually a deadlock the runtime cannot see (the runtime only reports "all goroutines are asleep" if every goroutine is blocked, and in a test binary there is always something else running). If the test is still running after the timeout, Watchdog writes the stack of every goroutine, with a count of what they are blocked on, and fails the test - much easier to read than the panic go test prints when its own -timeout runs out. With no timeout it uses the test's deadline (from go test -timeout) minus a margin, so it fires first.
+
+Both take the methods they need from *testing.T through small interfaces, so a test passes its t straight in: CheckLeaks(t, LeakOptions{}). main stands in a printing T to show the reports.
+
+Goroutines are found with runtime.Stack(buf, true), which writes the stack of every goroutine as text:
+
+goroutine 7 [chan receive]:
+main.main.func1()
+	/path/leakcheck.go:312 +0x2c
+created by main.main in goroutine 1
+	/path/leakcheck.go:310 +0x98
+
+Goroutine IDs are never reused, so "new" simply means "an ID that was not there before".
+
+go run leakcheck.go
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Goroutine is one goroutine from a stack dump.
+type Goroutine struct {
+	ID int
+	// State is what the goroutine is doing, like "running" or "chan receive".
+	State string
+	// Top is the function at the top of the stack.
+	Top string
+	// Stack is the full stack as runtime.Stack writes it, without the header line.
+	Stack string
+}
+
+var goroutineHeader = regexp.MustCompile(`^goroutine (\d+) \[([^\]]*)\]:$`)
+
+// allStacks returns runtime.Stack for every goroutine, growing the buffer until it fits.
+func allStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// Goroutines returns every goroutine that is running now.
+func Goroutines() []Goroutine {
+	var out []Goroutine
+	for _, block := range strings.Split(string(allStacks()), "\n\n") {
+		header, stack, _ := strings.Cut(strings.TrimSpace(block), "\n")
+		m := goroutineHeader.FindStringSubmatch(header)
+		if m == nil {
+			continue
+		}
+		id, _ := strconv.Atoi(m[1])
+		//the state may carry a wait time, "chan receive, 2 minutes"; only the state matters here
+		state, _, _ := strings.Cut(m[2], ",")
+		top, _, _ := strings.Cut(stack, "\n")
+		if i := strings.LastIndex(top, "("); i > 0 {
+			top = top[:i]
+		}
+		out = append(out, Goroutine{ID: id, State: state, Top: top, Stack: stack})
+	}
+	return out
+}
+
+// GoroutineSet is a snapshot of the running goroutines, by ID.
+type GoroutineSet map[int]Goroutine
+
+// SnapshotGoroutines returns the goroutines running now.
+func SnapshotGoroutines() GoroutineSet {
+	set := make(GoroutineSet)
+	for _, g := range Goroutines() {
+		set[g.ID] = g
+	}
+	return set
+}
+
+// LeakOptions tune what counts as a leak.
+type LeakOptions struct {
+	// Grace is how long goroutines get to finish before they count as leaked. Zero means a second.
+	Grace time.Duration
+	// Ignore lists functions (as they appear in a stack, like "net/http.(*persistConn).readLoop") whose goroutines
+	// are never leaks. A goroutine is ignored if any line of its stack starts with one of them.
+	Ignore []string
+}
+
+// defaultIgnore are goroutines the testing package and the runtime start on their own: other tests running in
+// parallel, and the signal handler os/signal starts the first time it is used.
+var defaultIgnore = []string{
+	"testing.tRunner",
+	"testing.(*T).Run",
+	"testing.runTests",
+	"os/signal.signal_recv",
+	"os/signal.loop",
+	"runtime.ensureSigM",
+}
+
+func (o LeakOptions) ignored(g Goroutine) bool {
+	for _, line := range strings.Split(g.Stack, "\n") {
+		for _, list := range [][]string{o.Ignore, defaultIgnore} {
+			for _, fn := range list {
+				if strings.HasPrefix(line, fn) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Leaks polls for up to o.Grace and returns the goroutines that are running but were not in before, and are not
+// ignored. It returns as soon as there are none.
+func (before GoroutineSet) Leaks(o LeakOptions) []Goroutine {
+	if o.Grace == 0 {
+		o.Grace = time.Second
+	}
+	deadline := time.Now().Add(o.Grace)
+	wait := time.Millisecond
+	for {
+		var leaked []Goroutine
+		for _, g := range Goroutines() {
+			if _, ok := before[g.ID]; !ok && !o.ignored(g) {
+				leaked = append(leaked, g)
+			}
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			return leaked
+		}
+		time.Sleep(wait)
+		wait = min(2*wait, 100*time.Millisecond)
+	}
+}
+
+var (
+	hexOffset   = regexp.MustCompile(` \+0x[0-9a-f]+$`)
+	hexArgs     = regexp.MustCompile(`\((0x[0-9a-f]+|\.\.\.)(, (0x[0-9a-f]+|\.\.\.|\{[^}]*\}))*\)$`)
+	inGoroutine = regexp.MustCompile(` in goroutine \d+$`)
+)
+
+// stackKey is a stack with the parts that differ between goroutines running the same code (argument values,
+// program counter offsets, the creating goroutine) removed.
+func stackKey(stack string) string {
+	lines := strings.Split(stack, "\n")
+	for i, l := range lines {
+		l = hexOffset.ReplaceAllString(l, "")
+		l = hexArgs.ReplaceAllString(l, "(...)")
+		lines[i] = inGoroutine.ReplaceAllString(l, "")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FormatLeaks groups leaked goroutines with the same stack and writes one report per group, the biggest first.
+func FormatLeaks(leaked []Goroutine) string {
+	type group struct {
+		first Goroutine
+		ids   []int
+	}
+	groups := map[string]*group{}
+	var keys []string
+	for _, g := range leaked {
+		k := g.State + "\n" + stackKey(g.Stack)
+		if groups[k] == nil {
+			groups[k] = &group{first: g}
+			keys = append(keys, k)
+		}
+		groups[k].ids = append(groups[k].ids, g.ID)
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return len(groups[keys[i]].ids) > len(groups[keys[j]].ids) })
+	var b strings.Builder
+	for _, k := range keys {
+		g := groups[k]
+		if len(g.ids) == 1 {
+			fmt.Fprintf(&b, "leaked goroutine %d [%s]:\n", g.first.ID, g.first.State)
+		} else {
+			fmt.Fprintf(&b, "%d leaked goroutines like this one, %d [%s]:\n", len(g.ids), g.first.ID, g.first.State)
+		}
+		fmt.Fprintf(&b, "%s\n\n", g.first.Stack)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// TB is the part of testing.TB that CheckLeaks needs, so *testing.T can be passed straight in.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Cleanup(func())
+}
+
+// CheckLeaks fails the test if, when it ends, goroutines are running that were not running when CheckLeaks was called.
+// Call it first thing in the test.
+func CheckLeaks(t TB, o LeakOptions) {
+	t.Helper()
+	before := SnapshotGoroutines()
+	t.Cleanup(func() {
+		if leaked := before.Leaks(o); len(leaked) > 0 {
+			t.Errorf("%d goroutines leaked:\n\n%s", len(leaked), FormatLeaks(leaked))
+		}
+	})
+}
+
+// deadliner is *testing.T's Deadline, which is when go test -timeout will panic.
+type deadliner interface {
+	Deadline() (time.Time, bool)
+}
+
+// WatchdogMargin is how long before the test's own deadline Watchdog fires, when it is not given a timeout.
+const WatchdogMargin = 5 * time.Second
+
+// Watchdog writes every goroutine's stack to out and fails the test if it is still running after timeout. If timeout
+// is zero and t has a deadline, it fires WatchdogMargin before that. It stops when the test ends.
+func Watchdog(t TB, timeout time.Duration, out io.Writer) {
+	t.Helper()
+	if timeout == 0 {
+		d, ok := t.(deadliner)
+		if !ok {
+			return
+		}
+		deadline, ok := d.Deadline()
+		if !ok {
+			return
+		}
+		timeout = time.Until(deadline) - WatchdogMargin
+	}
+	start := time.Now()
+	fired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		defer close(fired)
+		fmt.Fprintf(out, "watchdog: test still running after %v\n%s\n%s", time.Since(start).Round(time.Millisecond),
+			blockedSummary(Goroutines()), allStacks())
+		t.Errorf("watchdog: test did not finish within %v; every goroutine's stack was written out", timeout)
+	})
+	t.Cleanup(func() {
+		if !timer.Stop() {
+			//the dump is being written; the test is only over once it is
+			<-fired
+		}
+	})
+}
+
+// blockedSummary counts goroutines by state; a deadlock shows up as a pile of "chan receive" or "sync.Mutex.Lock".
+func blockedSummary(gs []Goroutine) string {
+	count := map[string]int{}
+	for _, g := range gs {
+		count[g.State]++
+	}
+	states := make([]string, 0, len(count))
+	for s := range count {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if count[states[i]] != count[states[j]] {
+			return count[states[i]] > count[states[j]]
+		}
+		return states[i] < states[j]
+	})
+	var b strings.Builder
+	for _, s := range states {
+		fmt.Fprintf(&b, "  %4d %s\n", count[s], s)
+	}
+	return b.String()
+}
+
+// printT stands in for *testing.T so main can show what the checks report. Run runs a test and then its cleanups.
+type printT struct {
+	name     string
+	mu       sync.Mutex
+	failed   bool
+	cleanups []func()
+}
+
+func (t *printT) Helper()          {}
+func (t *printT) Cleanup(f func()) { t.cleanups = append(t.cleanups, f) }
+func (t *printT) Errorf(format string, args ...any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed = true
+	msg := fmt.Sprintf(format, args...)
+	//the stacks contain this file's path; keep only the first lines of each report so the output stays readable
+	lines := strings.Split(msg, "\n")
+	if len(lines) > 12 {
+		lines = append(lines[:12], "\t...")
+	}
+	fmt.Printf("  FAIL %s: %s\n", t.name, strings.Join(lines, "\n  "))
+}
+
+func run(name string, test func(t *printT)) {
+	t := &printT{name: name}
+	test(t)
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.failed {
+		fmt.Printf("  ok   %s\n", name)
+	}
+}
+
+func main() {
+	quick := LeakOptions{Grace: 100 * time.Millisecond}
+
+	//conpatterndrop.go, if the manager forgets close(ch): the employee waits on range ch forever
+	run("drop pattern without close", func(t *printT) {
+		CheckLeaks(t, quick)
+		ch := make(chan string, 100)
+		go func() {
+			for p := range ch {
+				_ = p
+			}
+		}()
+		for w := 0; w < 200; w++ {
+			select {
+			case ch <- "paper":
+			default:
+			}
+		}
+	})
+
+	//the same with close(ch): the employee finishes within the grace period
+	run("drop pattern with close", func(t *printT) {
+		CheckLeaks(t, quick)
+		ch := make(chan string, 100)
+		go func() {
+			for range ch {
+			}
+		}()
+		for w := 0; w < 200; w++ {
+			select {
+			case ch <- "paper":
+			default:
+			}
+		}
+		close(ch)
+	})
+
+	//statefulgoroutines.go: readers that loop forever; the report groups the 100 of them into one entry
+	run("stateful goroutines", func(t *printT) {
+		CheckLeaks(t, quick)
+		reads := make(chan chan int)
+		go func() {
+			for resp := range reads {
+				resp <- 0
+			}
+		}()
+		for r := 0; r < 100; r++ {
+			go func() {
+				for {
+					resp := make(chan int)
+					reads <- resp
+					<-resp
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	//the fix: a context that the readers watch, and a WaitGroup so the test ends only when they have
+	run("stateful goroutines with a context", func(t *printT) {
+		CheckLeaks(t, quick)
+		ctx, cancel := context.WithCancel(context.Background())
+		reads := make(chan chan int)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case resp := <-reads:
+					resp <- 0
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		for r := 0; r < 100; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					resp := make(chan int, 1)
+					select {
+					case reads <- resp:
+						<-resp
+					case <-ctx.Done():
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		wg.Wait()
+	})
+
+	//a deadlock the runtime cannot report, because main is still running: two goroutines lock two mutexes in opposite order
+	var dump bytes.Buffer
+	run("deadlock", func(t *printT) {
+		Watchdog(t, 100*time.Millisecond, &dump)
+		var a, b sync.Mutex
+		var ready sync.WaitGroup
+		ready.Add(2)
+		done := make(chan struct{})
+		go func() {
+			a.Lock()
+			ready.Done()
+			ready.Wait()
+			b.Lock()
+			close(done)
+		}()
+		go func() {
+			b.Lock()
+			ready.Done()
+			ready.Wait()
+			a.Lock()
+		}()
+		select {
+		case <-done:
+		case <-time.After(300 * time.Millisecond):
+			//a real test would hang here until go test -timeout; the demo gives up so that main can end
+		}
+	})
+	head, _, _ := strings.Cut(dump.String(), "goroutine ")
+	fmt.Print(head)
+}
+
+/*
+Result
+go run leakcheck.go
+
+  FAIL drop pattern without close: 1 goroutines leaked:
+
+  leaked goroutine 7 [chan receive]:
+  main.main.func1.1()
+  	/path/leakcheck.go:329 +0x45
+  created by main.main.func1 in goroutine 1
+  	/path/leakcheck.go:328 +0xfa
+  ok   drop pattern with close
+  FAIL stateful goroutines: 101 goroutines leaked:
+
+  98 leaked goroutines like this one, 10 [runnable]:
+  time.Sleep(0xf4240)
+  	$GOROOT/src/runtime/time.go:368 +0x165
+  main.main.func3.2()
+  	/path/leakcheck.go:373 +0x65
+  created by main.main.func3 in goroutine 1
+  	/path/leakcheck.go:368 +0xf2
+
+  2 leaked goroutines like this one, 65 [runnable]:
+  main.main.func3.2()
+  	...
+  ok   stateful goroutines with a context
+  FAIL deadlock: watchdog: test did not finish within 100ms; every goroutine's stack was written out
+watchdog: test still running after 101ms
+   100 runnable
+     2 chan receive
+     2 sync.Mutex.Lock
+     1 running
+     1 select
+
+
+(the IDs, the states and how the leaked goroutines are grouped change from run to run)
+The deadlock summary shows the two goroutines stuck in sync.Mutex.Lock, and also the 100 readers leaked by the stateful goroutines test, still running: a leak does not end with the test that caused it.
+*/
@@ -0,0 +1,780 @@
+/*
+Composable middleware chain
+
+middleware.go has one closure, logDuration, that wraps a func(http.ResponseWriter, *http.Request) and prints how long it took. That works for one middleware, but once we have five of them we end up writing
+
+	logDuration(recover(cors(limit(getTime))))
+
+and the order is hard to read. Here we:
+
+1. Use http.Handler instead of raw functions, so anything from the standard library (http.FileServer, http.TimeoutHandler, a ServeMux) can sit in the chain
+2. Define Middleware as func(http.Handler) http.Handler - the same closure idea as logDuration
+3. Put middlewares in a Chain so they read top to bottom, in the order a request passes through them
+4. Write a set of ready-made middlewares: request ID, access log, panic recovery, CORS, compression, body-size limit and per-request timeout
+5. Keep the latency logDuration used to throw away: count requests and record latency histograms by route, method and status, and serve them (with the runtime numbers printMemStat in memstats.go prints) at /metrics in the Prometheus text format - no client library needed
+
+The access log needs the status code and the number of bytes written, but http.ResponseWriter doesn't let us read those back. The trick is to wrap the ResponseWriter in our own type that remembers them on the way through.
+
+go run middlewarechain.go
+curl -i -H 'Accept-Encoding: gzip' --compressed localhost:8080/now
+curl localhost:8080/metrics
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps an http.Handler with extra behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is an ordered list of middlewares. The first one is the outermost: it sees the request first and the response last.
+type Chain []Middleware
+
+// NewChain builds a Chain from the given middlewares.
+func NewChain(m ...Middleware) Chain {
+	return append(Chain(nil), m...)
+}
+
+// Append returns a new Chain with m added to the end. The original Chain is not modified, so a base chain can be shared.
+func (c Chain) Append(m ...Middleware) Chain {
+	out := make(Chain, 0, len(c)+len(m))
+	return append(append(out, c...), m...)
+}
+
+// Then wraps h with every middleware in the chain and returns the result.
+/*
+We wrap from the inside out: the last middleware wraps h first, so the first middleware ends up on the outside.
+*/
+func (c Chain) Then(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i](h)
+	}
+	return h
+}
+
+// ThenFunc is Then for a plain function, like getTime in middleware.go.
+func (c Chain) ThenFunc(f func(http.ResponseWriter, *http.Request)) http.Handler {
+	return c.Then(http.HandlerFunc(f))
+}
+
+// ResponseWriter wraps an http.ResponseWriter and records the status code and the number of body bytes written.
+type ResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WrapResponseWriter returns w as a *ResponseWriter, wrapping it only if it isn't one already.
+func WrapResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status returns the status code sent, or 200 if the handler wrote a body without calling WriteHeader, or 0 if nothing was written yet.
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
+// BytesWritten returns the number of body bytes written so far.
+func (w *ResponseWriter) BytesWritten() int64 {
+	return w.bytes
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer (for Flush, Hijack, deadlines...).
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush keeps streaming responses working through the wrapper.
+func (w *ResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack keeps websockets working through the wrapper.
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+type requestIDKey struct{}
+
+// RequestIDHeader is the header RequestID reads and writes.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID gives every request an ID. An ID sent by the client (or a proxy in front of us) is kept; otherwise a random one is made.
+// The ID is echoed in the response header and can be read by later handlers with RequestIDFrom.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFrom returns the ID stored by RequestID, or "" if there is none.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// AccessLog is logDuration grown up: one structured log line per request with method, path, status, bytes and latency.
+func AccessLog(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := WrapResponseWriter(w)
+			next.ServeHTTP(rw, r)
+			status := rw.Status()
+			if status == 0 {
+				//the handler wrote nothing at all, and net/http will send a 200
+				status = http.StatusOK
+			}
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("id", RequestIDFrom(r.Context())),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Int64("bytes", rw.BytesWritten()),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("remote", r.RemoteAddr),
+			)
+		})
+	}
+}
+
+// Recover turns a panic in a handler into a 500 and logs the panic value with its stack, instead of killing the connection.
+func Recover(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := WrapResponseWriter(w)
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				//http.ErrAbortHandler is the documented way to abort a response; let net/http deal with it
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logger.Error("panic",
+					slog.String("id", RequestIDFrom(r.Context())),
+					slog.Any("value", v),
+					slog.String("stack", string(debug.Stack())),
+				)
+				//if the handler already started the response, the status line is gone and all we can do is stop
+				if rw.Status() == 0 {
+					http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// CORSOptions configures CORS. An empty AllowedOrigins allows nothing; "*" allows any origin.
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS answers preflight OPTIONS requests and adds the Access-Control-* headers to allowed cross-origin requests.
+func CORS(opts CORSOptions) Middleware {
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodHead}
+	}
+	allowed := func(origin string) bool {
+		for _, o := range opts.AllowedOrigins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+	methods := strings.Join(opts.AllowedMethods, ", ")
+	headers := strings.Join(opts.AllowedHeaders, ", ")
+	exposed := strings.Join(opts.ExposedHeaders, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if origin == "" || !allowed(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			//with credentials the spec forbids "*", so we always echo the origin back
+			h.Set("Access-Control-Allow-Origin", origin)
+			if opts.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if !preflight {
+				if exposed != "" {
+					h.Set("Access-Control-Expose-Headers", exposed)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", methods)
+			if headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+				h.Set("Access-Control-Allow-Headers", req)
+			}
+			if opts.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// Encoder is a content encoding Compress can offer, for example gzip.
+type Encoder struct {
+	// Name is the Content-Encoding token, like "gzip" or "br".
+	Name string
+	New  func(w io.Writer) (io.WriteCloser, error)
+}
+
+// Gzip is the gzip Encoder from compress/gzip.
+var Gzip = Encoder{Name: "gzip", New: func(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+}}
+
+// Deflate is the deflate Encoder from compress/flate.
+var Deflate = Encoder{Name: "deflate", New: func(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}}
+
+/*
+Brotli ("br") is not in the standard library. To offer it, plug in an Encoder from a brotli package, e.g. with github.com/andybalholm/brotli:
+
+	Brotli := Encoder{Name: "br", New: func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriter(w), nil
+	}}
+	Compress(1024, Brotli, Gzip)
+*/
+
+// Compress encodes responses of at least minSize bytes with the first of encoders the client accepts.
+// Encoders are listed in order of preference; with none given, gzip then deflate are used.
+func Compress(minSize int, encoders ...Encoder) Middleware {
+	if len(encoders) == 0 {
+		encoders = []Encoder{Gzip, Deflate}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			enc, ok := negotiate(r.Header.Get("Accept-Encoding"), encoders)
+			if !ok || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, enc: enc, minSize: minSize}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiate picks the first of encoders with a non-zero q value in the Accept-Encoding header
+func negotiate(accept string, encoders []Encoder) (Encoder, bool) {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if name == "" {
+			continue
+		}
+		v := 1.0
+		if p, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(p, 64); err == nil {
+				v = f
+			}
+		}
+		q[strings.ToLower(name)] = v
+	}
+	type choice struct {
+		enc Encoder
+		q   float64
+	}
+	var choices []choice
+	for _, e := range encoders {
+		v, ok := q[e.Name]
+		if !ok {
+			v, ok = q["*"]
+		}
+		if ok && v > 0 {
+			choices = append(choices, choice{e, v})
+		}
+	}
+	if len(choices) == 0 {
+		return Encoder{}, false
+	}
+	//highest q wins; on a tie our own order of preference decides
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	return choices[0].enc, true
+}
+
+// compressWriter buffers the first minSize bytes so tiny responses are sent as they are
+type compressWriter struct {
+	http.ResponseWriter
+	enc     Encoder
+	minSize int
+
+	buf         []byte
+	status      int
+	wroteHeader bool
+	zw          io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.zw != nil {
+		return w.zw.Write(b)
+	}
+	if w.wroteHeader {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start decides, once, whether the response is compressed, and sends the header
+func (w *compressWriter) start(compress bool) error {
+	h := w.ResponseWriter.Header()
+	if h.Get("Content-Encoding") != "" || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		compress = false
+	}
+	if compress {
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		h.Set("Content-Encoding", w.enc.Name)
+		h.Del("Content-Length")
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if !compress {
+		_, err := w.ResponseWriter.Write(buf)
+		return err
+	}
+	zw, err := w.enc.New(w.ResponseWriter)
+	if err != nil {
+		return err
+	}
+	w.zw = zw
+	_, err = w.zw.Write(buf)
+	return err
+}
+
+func (w *compressWriter) Close() error {
+	if w.status == 0 {
+		return nil
+	}
+	if !w.wroteHeader {
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader && w.status != 0 {
+		w.start(len(w.buf) >= w.minSize)
+	}
+	if f, ok := w.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// MaxBytes rejects request bodies larger than n bytes. A Content-Length over the limit is refused with 413 straight away;
+// a body without a length is cut off by http.MaxBytesReader, and the handler sees an *http.MaxBytesError when it reads too far.
+func MaxBytes(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Timeout gives every request a deadline of d. The request context is cancelled at the deadline, and if the
+// handler hasn't answered by then the client gets a 503. This is http.TimeoutHandler in Middleware form.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, d, "request timed out")
+	}
+}
+
+// IsBodyTooLarge reports whether err came from reading past a MaxBytes limit.
+func IsBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// DefaultBuckets are the latency histogram bounds in seconds, the same as the Prometheus client defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// requestLabels is one series: we label by route pattern, never the raw path, so /users/1 and /users/2 don't make two series
+type requestLabels struct {
+	route, method, code string
+}
+
+// histogram counts observations into fixed buckets. Every field is updated atomically, so Observe never takes a lock.
+type histogram struct {
+	bounds  []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(v float64) {
+	//buckets are stored non-cumulative and summed when they are written out
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Metrics records request counts, latency histograms and in-flight requests, and serves them with the Go runtime stats.
+type Metrics struct {
+	buckets []float64
+
+	mu       sync.Mutex
+	requests map[requestLabels]*atomic.Uint64
+	latency  map[requestLabels]*histogram
+	inFlight atomic.Int64
+}
+
+// NewMetrics returns an empty Metrics. A nil buckets uses DefaultBuckets.
+func NewMetrics(buckets []float64) *Metrics {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		buckets:  buckets,
+		requests: make(map[requestLabels]*atomic.Uint64),
+		latency:  make(map[requestLabels]*histogram),
+	}
+}
+
+func (m *Metrics) series(l requestLabels) (*atomic.Uint64, *histogram) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.requests[l]
+	if !ok {
+		c = new(atomic.Uint64)
+		m.requests[l] = c
+		m.latency[l] = newHistogram(m.buckets)
+	}
+	return c, m.latency[l]
+}
+
+// Middleware records every request that passes through it.
+/*
+The route label is r.Pattern, which http.ServeMux fills in with the pattern that matched ("GET /users/{id}"). If the request didn't go through a ServeMux, or nothing matched, the route is "unmatched".
+*/
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		start := time.Now()
+		rw := WrapResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		status := rw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		c, h := m.series(requestLabels{route: route, method: r.Method, code: strconv.Itoa(status)})
+		c.Add(1)
+		h.Observe(time.Since(start).Seconds())
+	})
+}
+
+// Handler serves the metrics in the Prometheus text exposition format (version 0.0.4).
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	})
+}
+
+// WriteTo writes every metric to w in the text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	keys := make([]requestLabels, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	m.mu.Unlock()
+	//a stable order makes the output diffable and easy to read
+	sort.Slice(keys, func(i, j int) bool {
+		a, c := keys[i], keys[j]
+		if a.route != c.route {
+			return a.route < c.route
+		}
+		if a.method != c.method {
+			return a.method < c.method
+		}
+		return a.code < c.code
+	})
+
+	b.WriteString("# HELP http_requests_total Total number of HTTP requests handled.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	for _, k := range keys {
+		c, _ := m.series(k)
+		fmt.Fprintf(&b, "http_requests_total%s %d\n", k.labels(""), c.Load())
+	}
+
+	b.WriteString("# HELP http_request_duration_seconds Latency of HTTP requests.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, k := range keys {
+		_, h := m.series(k)
+		var cum uint64
+		for i, le := range h.bounds {
+			cum += h.counts[i].Load()
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket%s %d\n", k.labels(formatFloat(le)), cum)
+		}
+		count := h.count.Load()
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket%s %d\n", k.labels("+Inf"), count)
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum%s %s\n", k.labels(""), formatFloat(math.Float64frombits(h.sumBits.Load())))
+		fmt.Fprintf(&b, "http_request_duration_seconds_count%s %d\n", k.labels(""), count)
+	}
+
+	b.WriteString("# HELP http_requests_in_flight Number of HTTP requests being served right now.\n")
+	b.WriteString("# TYPE http_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", m.inFlight.Load())
+
+	writeRuntimeMetrics(&b)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (l requestLabels) labels(le string) string {
+	s := fmt.Sprintf(`{route="%s",method="%s",code="%s"`, escapeLabel(l.route), escapeLabel(l.method), l.code)
+	if le != "" {
+		s += fmt.Sprintf(`,le="%s"`, le)
+	}
+	return s + "}"
+}
+
+// escapeLabel escapes a label value as the exposition format requires: backslash, double quote and newline.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeRuntimeMetrics writes the fields printMemStat in memstats.go prints, plus the goroutine count, under the names the Prometheus Go client uses.
+func writeRuntimeMetrics(b *strings.Builder) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	metric := func(name, typ, help string, v uint64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+	}
+	metric("go_goroutines", "gauge", "Number of goroutines that currently exist.", uint64(runtime.NumGoroutine()))
+	metric("go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.", ms.Alloc)
+	metric("go_memstats_alloc_bytes_total", "counter", "Total bytes allocated for heap objects, even if freed.", ms.TotalAlloc)
+	metric("go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.", ms.Sys)
+	metric("go_memstats_mallocs_total", "counter", "Count of heap objects allocated.", ms.Mallocs)
+	metric("go_memstats_frees_total", "counter", "Count of heap objects freed.", ms.Frees)
+	metric("go_memstats_heap_objects", "gauge", "Count of live heap objects.", ms.Mallocs-ms.Frees)
+	metric("go_gc_cycles_total", "counter", "Number of completed GC cycles.", uint64(ms.NumGC))
+}
+
+func main() {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	metrics := NewMetrics(nil)
+
+	//the order here is the order a request walks through
+	base := NewChain(
+		RequestID,
+		metrics.Middleware,
+		AccessLog(logger),
+		Recover(logger),
+		CORS(CORSOptions{AllowedOrigins: []string{"http://localhost:3000"}, MaxAge: time.Hour}),
+		Compress(256),
+		Timeout(2*time.Second),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/now", base.ThenFunc(getTime))
+	mux.Handle("/panic", base.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something went wrong")
+	}))
+	mux.Handle("/slow", base.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+			fmt.Fprintln(w, "finally")
+		case <-r.Context().Done():
+		}
+	}))
+	mux.Handle("/upload", base.Append(MaxBytes(1<<10)).ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if IsBodyTooLarge(err) {
+			http.Error(w, "too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Fprintf(w, "read %d bytes\n", n)
+	}))
+	mux.Handle("/big", base.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("all work and no play makes jack a dull boy\n", 100))
+	}))
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	fmt.Println("Server started at port 8080")
+	log.Fatal(http.ListenAndServe(":8080", mux))
+}
+
+func getTime(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	_, err := fmt.Fprintf(w, "%s", now)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+Result
+curl localhost:8080/now
+curl localhost:8080/panic
+
+{"time":"...","level":"INFO","msg":"request","id":"9f1c2a...","method":"GET","path":"/now","status":200,"bytes":52,"latency":61542,"remote":"127.0.0.1:51234"}
+{"time":"...","level":"ERROR","msg":"panic","id":"4be0d1...","value":"something went wrong","stack":"goroutine 7 [running]:..."}
+{"time":"...","level":"INFO","msg":"request","id":"4be0d1...","method":"GET","path":"/panic","status":500,"bytes":22,"latency":180250,"remote":"127.0.0.1:51236"}
+
+curl localhost:8080/metrics
+
+# HELP http_requests_total Total number of HTTP requests handled.
+# TYPE http_requests_total counter
+http_requests_total{route="/now",method="GET",code="200"} 1
+http_requests_total{route="/panic",method="GET",code="500"} 1
+# HELP http_request_duration_seconds Latency of HTTP requests.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{route="/now",method="GET",code="200",le="0.005"} 1
+...
+http_request_duration_seconds_bucket{route="/now",method="GET",code="200",le="+Inf"} 1
+http_request_duration_seconds_sum{route="/now",method="GET",code="200"} 6.1542e-05
+http_request_duration_seconds_count{route="/now",method="GET",code="200"} 1
+...
+# HELP http_requests_in_flight Number of HTTP requests being served right now.
+# TYPE http_requests_in_flight gauge
+http_requests_in_flight 0
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 5
+...
+*/
@@ -0,0 +1,603 @@
+//Pub/sub broker: selectchannels.go and chanellbuffering.go, for any number of publishers and subscribers
+/*
+selectchannels.go receives from two channels it knows by name, and chanellbuffering.go shows that a channel with a buffer of 2 takes two values before a send blocks. A pub/sub broker puts a name on every message instead (its topic) and lets any number of subscribers say which topics they want. Publishers and subscribers never know about each other.
+
+Broker[T] does that in one process:
+
+1. Topics are dot-separated, like "orders.eu.created". A subscription pattern can use "*" for exactly one segment ("orders.*.created") and ">" as the last segment for one or more ("orders.>"), as NATS does
+2. Every subscriber has its own buffer, so one slow subscriber does not slow down the others. What happens when its buffer is full is the subscriber's choice (SlowPolicy):
+   Block - Publish waits for room, or for its context (chanellbuffering.go's third send). A subscriber that is still full when the context ends misses the message, but every other subscriber gets it: Publish returns how many did, and an error for each one that did not. A subscriber that drops the message by its own policy is left out of the count too, but that is no error
+   DropNewest / DropOldest - the new message, or the oldest one waiting, is thrown away (as in dropqueue.go)
+   Disconnect - the subscription is closed; Err says ErrSlowConsumer
+3. At-least-once delivery: with an AckTimeout, every message must be acknowledged with Ack. One that is not acked in time is delivered again (Attempt counts up), up to MaxAttempts. A consumer can crash halfway through a message and still get it - but it may see a message twice, so handling must be idempotent
+4. TTL: a message published with a TTL is thrown away if it is still waiting in a buffer when it expires. A price update from a minute ago is worse than none
+5. Graceful unsubscribe: Unsubscribe stops new messages, lets the subscriber receive what is already in its buffer and waits for the outstanding acks, then closes the channel
+
+Inside, every subscription is a queue guarded by a mutex and a sync.Cond (dropqueue.go again), and one goroutine that moves messages from the queue to the channel the subscriber reads from. That goroutine is where expired messages are skipped and where the ack deadline starts. The channel itself is unbuffered: the buffer is the queue, so the broker can look inside it (drop the oldest, skip expired ones), which it cannot do with a buffered channel.
+
+go run pubsub.go
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrSlowConsumer is the Err of a Disconnect subscription whose buffer was full.
+	ErrSlowConsumer = errors.New("pubsub: slow consumer disconnected")
+	// ErrBrokerClosed is returned by Publish and Subscribe after Close.
+	ErrBrokerClosed = errors.New("pubsub: broker closed")
+	// ErrUnsubscribed is the Err of a subscription that was unsubscribed.
+	ErrUnsubscribed = errors.New("pubsub: unsubscribed")
+)
+
+// SlowPolicy decides what Publish does when a subscriber's buffer is full.
+type SlowPolicy int
+
+const (
+	// Block makes Publish wait for room.
+	Block SlowPolicy = iota
+	// DropNewest throws away the message being published.
+	DropNewest
+	// DropOldest throws away the message that has waited longest.
+	DropOldest
+	// Disconnect closes the subscription.
+	Disconnect
+)
+
+// Message is one published message.
+type Message[T any] struct {
+	ID      uint64
+	Topic   string
+	Payload T
+	// Expires is when the message is no longer worth delivering. Zero means never.
+	Expires time.Time
+}
+
+// Delivery is a Message handed to one subscriber.
+type Delivery[T any] struct {
+	Message[T]
+	// Attempt is 1 the first time the message is delivered, 2 the first time it is delivered again, and so on.
+	Attempt int
+	sub     *Subscription[T]
+}
+
+// Ack tells the broker that the message has been handled, so that it is not delivered again. Acking twice, or
+// acking on a subscription without an AckTimeout, does nothing.
+func (d Delivery[T]) Ack() {
+	d.sub.ack(d.ID)
+}
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	// Buffer is how many messages can wait for the subscriber. Less than 1 means 1.
+	Buffer int
+	Policy SlowPolicy
+	// AckTimeout turns on at-least-once delivery: a message that is not acked this long after it was received is
+	// delivered again. Zero means every message is delivered once and needs no ack.
+	AckTimeout time.Duration
+	// MaxAttempts is how many times a message is delivered at most. Zero means 5.
+	MaxAttempts int
+}
+
+// SubscriptionStats counts what happened to a subscription's messages.
+type SubscriptionStats struct {
+	Delivered, Redelivered, Acked, Dropped, Expired, GaveUp uint64
+}
+
+type pending[T any] struct {
+	msg      Message[T]
+	attempt  int
+	deadline time.Time
+}
+
+// Subscription receives the messages of the topics its pattern matches.
+type Subscription[T any] struct {
+	broker  *Broker[T]
+	pattern []string
+	opts    SubscribeOptions
+	out     chan Delivery[T]
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []pending[T]
+	//handing is 1 while pump holds a message it has taken from queue but not handed over yet; it counts towards Buffer
+	handing  int
+	inFlight map[uint64]*pending[T]
+	//closing: no new messages, deliver what is left; closed: stop now
+	closing bool
+	closed  bool
+	err     error
+	quit    chan struct{}
+	done    chan struct{}
+
+	delivered, redelivered, acked, dropped, expired, gaveUp atomic.Uint64
+}
+
+// Broker routes published messages to subscriptions.
+type Broker[T any] struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription[T]]struct{}
+	closed bool
+	nextID atomic.Uint64
+	now    func() time.Time
+}
+
+// NewBroker returns an empty broker.
+func NewBroker[T any]() *Broker[T] {
+	return &Broker[T]{subs: make(map[*Subscription[T]]struct{}), now: time.Now}
+}
+
+// match reports whether topic matches pattern; both are split at the dots.
+func match(pattern, topic []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(topic) > i
+		}
+		if i >= len(topic) || (p != "*" && p != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// Subscribe returns a subscription to every topic pattern matches. Read its messages from C.
+func (b *Broker[T]) Subscribe(pattern string, opts SubscribeOptions) (*Subscription[T], error) {
+	if opts.Buffer < 1 {
+		opts.Buffer = 1
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 5
+	}
+	s := &Subscription[T]{
+		broker:   b,
+		pattern:  strings.Split(pattern, "."),
+		opts:     opts,
+		out:      make(chan Delivery[T]),
+		inFlight: make(map[uint64]*pending[T]),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	b.subs[s] = struct{}{}
+	go s.pump()
+	if opts.AckTimeout > 0 {
+		go s.redeliver()
+	}
+	return s, nil
+}
+
+// Publish sends payload to every subscription whose pattern matches topic, and returns how many queued it.
+// A ttl above zero makes the message expire. Publish only waits for subscriptions with the Block policy.
+// If ctx ends while one of those is full, that one misses the message but the others still get it: the count
+// leaves it out, and the error joins one error per subscription that missed it. A subscription that drops the
+// message (DropNewest, or DropOldest while its only message is being handed over), disconnects on it, or is being
+// unsubscribed is left out of the count as well, without an error: that is what it asked for.
+func (b *Broker[T]) Publish(ctx context.Context, topic string, payload T, ttl time.Duration) (int, error) {
+	msg := Message[T]{ID: b.nextID.Add(1), Topic: topic, Payload: payload}
+	if ttl > 0 {
+		msg.Expires = b.now().Add(ttl)
+	}
+	parts := strings.Split(topic, ".")
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return 0, ErrBrokerClosed
+	}
+	var targets []*Subscription[T]
+	for s := range b.subs {
+		if match(s.pattern, parts) {
+			targets = append(targets, s)
+		}
+	}
+	//a Block subscription can make us wait; we must not hold the broker's lock while we do
+	b.mu.RUnlock()
+	//the ones that never wait first, so a full Block subscription cannot keep the message from them
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].opts.Policy != Block && targets[j].opts.Policy == Block
+	})
+	n := 0
+	var errs []error
+	for _, s := range targets {
+		queued, err := s.enqueue(ctx, msg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pubsub: subscription %q: %w", strings.Join(s.pattern, "."), err))
+		}
+		if queued {
+			n++
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// enqueue adds msg to the queue, applying the SlowPolicy if it is full, and reports whether msg was queued.
+// The error is only set when a Block subscription stayed full until ctx ended.
+func (s *Subscription[T]) enqueue(ctx context.Context, msg Message[T]) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue)+s.handing >= s.opts.Buffer && !s.closing {
+		switch s.opts.Policy {
+		case DropNewest:
+			s.dropped.Add(1)
+			return false, nil
+		case DropOldest:
+			s.dropped.Add(1)
+			if len(s.queue) == 0 {
+				//the only message is the one pump holds, and that cannot be taken back
+				return false, nil
+			}
+			s.queue = s.queue[1:]
+		case Disconnect:
+			s.shutdown(ErrSlowConsumer)
+			return false, nil
+		default:
+			if ctx.Err() != nil {
+				return false, context.Cause(ctx)
+			}
+			//a Cond cannot wait for a context; wake it when ctx ends
+			stop := context.AfterFunc(ctx, func() {
+				s.mu.Lock()
+				s.cond.Broadcast()
+				s.mu.Unlock()
+			})
+			s.cond.Wait()
+			stop()
+		}
+	}
+	if s.closing {
+		//unsubscribed while we waited; the message is not for it any more
+		return false, nil
+	}
+	s.queue = append(s.queue, pending[T]{msg: msg, attempt: 1})
+	s.cond.Broadcast()
+	return true, nil
+}
+
+// pump hands queued messages to the subscriber, one at a time.
+func (s *Subscription[T]) pump() {
+	defer close(s.done)
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed && !(s.closing && len(s.inFlight) == 0) {
+			s.cond.Wait()
+		}
+		if s.closed || len(s.queue) == 0 {
+			//closed, or unsubscribed with nothing left to deliver and nothing left to ack
+			s.mu.Unlock()
+			return
+		}
+		p := s.queue[0]
+		s.queue = s.queue[1:]
+		s.handing = 1
+		//&p goes into inFlight, where redeliver changes attempt under the lock; read it here, not after
+		attempt := p.attempt
+		acks := s.opts.AckTimeout > 0
+		if acks {
+			//registered before the send, so that an Ack that comes right away finds it; a zero deadline keeps
+			//redeliver away from it until it has been handed over
+			s.inFlight[p.msg.ID] = &p
+		}
+		s.mu.Unlock()
+
+		sent := false
+		if !p.msg.Expires.IsZero() && !s.broker.now().Before(p.msg.Expires) {
+			s.expired.Add(1)
+		} else {
+			select {
+			case s.out <- Delivery[T]{Message: p.msg, Attempt: attempt, sub: s}:
+				sent = true
+			case <-s.quit:
+				return
+			}
+		}
+		s.mu.Lock()
+		s.handing = 0
+		if acks {
+			if !sent {
+				delete(s.inFlight, p.msg.ID)
+			} else if q, ok := s.inFlight[p.msg.ID]; ok {
+				q.deadline = s.broker.now().Add(s.opts.AckTimeout)
+			}
+		}
+		//there is room now for a blocked Publish
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if !sent {
+			continue
+		}
+		if attempt == 1 {
+			s.delivered.Add(1)
+		} else {
+			s.redelivered.Add(1)
+		}
+	}
+}
+
+// redeliver puts messages whose ack is overdue back at the front of the queue.
+func (s *Subscription[T]) redeliver() {
+	t := time.NewTicker(max(time.Millisecond, s.opts.AckTimeout/4))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		now := s.broker.now()
+		s.mu.Lock()
+		var again []pending[T]
+		for id, p := range s.inFlight {
+			if p.deadline.IsZero() || now.Before(p.deadline) {
+				continue
+			}
+			delete(s.inFlight, id)
+			if p.attempt >= s.opts.MaxAttempts {
+				s.gaveUp.Add(1)
+				continue
+			}
+			p.attempt++
+			again = append(again, *p)
+		}
+		if len(again) > 0 {
+			//in the order they were published; inFlight is a map
+			sort.Slice(again, func(i, j int) bool { return again[i].msg.ID < again[j].msg.ID })
+			//redeliveries skip the buffer limit: they were let in once already
+			s.queue = append(again, s.queue...)
+		}
+		//also wakes a pump waiting for the last ack of an Unsubscribe
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+func (s *Subscription[T]) ack(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inFlight[id]; ok {
+		delete(s.inFlight, id)
+		s.acked.Add(1)
+		s.cond.Broadcast()
+	}
+}
+
+// shutdown stops the subscription at once. s.mu must be held.
+func (s *Subscription[T]) shutdown(err error) {
+	if s.closed {
+		return
+	}
+	s.closing, s.closed, s.err = true, true, err
+	close(s.quit)
+	s.cond.Broadcast()
+	go s.broker.remove(s)
+}
+
+func (b *Broker[T]) remove(s *Subscription[T]) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, s)
+}
+
+// C is the channel messages arrive on. It is closed when the subscription ends; Err then says why.
+func (s *Subscription[T]) C() <-chan Delivery[T] {
+	return s.out
+}
+
+// Err returns why the subscription ended: ErrUnsubscribed, ErrSlowConsumer or ErrBrokerClosed. Call it after C is closed.
+func (s *Subscription[T]) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Unsubscribe stops new messages and waits until the subscriber has received everything in its buffer and acked
+// everything it received (redeliveries included), then closes C. The subscriber must keep reading C meanwhile.
+// If ctx ends first, the subscription is closed at once and the context error is returned.
+func (s *Subscription[T]) Unsubscribe(ctx context.Context) error {
+	s.broker.remove(s)
+	s.mu.Lock()
+	if !s.closing {
+		s.closing, s.err = true, ErrUnsubscribed
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		s.shutdown(ErrUnsubscribed)
+		s.mu.Unlock()
+		<-s.done
+		return ctx.Err()
+	}
+}
+
+// Stats returns the counters.
+func (s *Subscription[T]) Stats() SubscriptionStats {
+	return SubscriptionStats{
+		Delivered:   s.delivered.Load(),
+		Redelivered: s.redelivered.Load(),
+		Acked:       s.acked.Load(),
+		Dropped:     s.dropped.Load(),
+		Expired:     s.expired.Load(),
+		GaveUp:      s.gaveUp.Load(),
+	}
+}
+
+// Close closes every subscription at once, and makes Publish and Subscribe fail.
+func (b *Broker[T]) Close() {
+	b.mu.Lock()
+	b.closed = true
+	subs := make([]*Subscription[T], 0, len(b.subs))
+	for s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+	for _, s := range subs {
+		s.mu.Lock()
+		s.shutdown(ErrBrokerClosed)
+		s.mu.Unlock()
+		<-s.done
+	}
+}
+
+// drain reads everything that arrives on s within d.
+func drain[T any](s *Subscription[T], d time.Duration) []T {
+	var got []T
+	timeout := time.After(d)
+	for {
+		select {
+		case m, ok := <-s.C():
+			if !ok {
+				return got
+			}
+			got = append(got, m.Payload)
+		case <-timeout:
+			return got
+		}
+	}
+}
+
+func main() {
+	ctx := context.Background()
+	b := NewBroker[string]()
+
+	//selectchannels.go: two sources, but the subscriber names a pattern instead of two channels
+	all, _ := b.Subscribe("orders.*", SubscribeOptions{Buffer: 10})
+	eu, _ := b.Subscribe("orders.eu", SubscribeOptions{Buffer: 10})
+	every, _ := b.Subscribe(">", SubscribeOptions{Buffer: 10})
+	b.Publish(ctx, "orders.eu", "one", 0)
+	b.Publish(ctx, "orders.us", "two", 0)
+	b.Publish(ctx, "payments.eu", "three", 0)
+	fmt.Println("orders.*: ", drain(all, 20*time.Millisecond))
+	fmt.Println("orders.eu:", drain(eu, 20*time.Millisecond))
+	fmt.Println(">:        ", drain(every, 20*time.Millisecond))
+	for _, s := range []*Subscription[string]{all, eu, every} {
+		s.Unsubscribe(ctx)
+	}
+
+	//chanellbuffering.go's buffer of 2, with a subscriber that is not reading: 5 messages, 3 too many
+	for _, p := range []struct {
+		name   string
+		policy SlowPolicy
+	}{{"DropNewest", DropNewest}, {"DropOldest", DropOldest}, {"Disconnect", Disconnect}} {
+		s, _ := b.Subscribe("ice.cream", SubscribeOptions{Buffer: 2, Policy: p.policy})
+		queued := 0
+		for i, flavour := range []string{"vanilla", "chocolate", "mint", "lemon", "mango"} {
+			n, _ := b.Publish(ctx, "ice.cream", flavour, 0)
+			queued += n
+			if i == 0 {
+				//let the pump take vanilla; it holds it until the subscriber reads, and it counts towards the 2
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		got := drain(s, 20*time.Millisecond)
+		fmt.Printf("%-10s got %v, dropped %d, queued %d of 5, err %v\n", p.name, got, s.Stats().Dropped, queued, s.Err())
+		s.Unsubscribe(ctx)
+	}
+
+	//Block: the publisher waits for room, up to its context
+	blocked, _ := b.Subscribe("ice.cream", SubscribeOptions{Buffer: 2, Policy: Block})
+	//and one with room to spare, which must not miss mint because of the full one
+	roomy, _ := b.Subscribe("ice.>", SubscribeOptions{Buffer: 10})
+	b.Publish(ctx, "ice.cream", "vanilla", 0)
+	b.Publish(ctx, "ice.cream", "chocolate", 0)
+	pctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	n, err := b.Publish(pctx, "ice.cream", "mint", 0)
+	cancel()
+	fmt.Println("Block, buffer full: published to", n, "err:", err)
+	go b.Publish(ctx, "ice.cream", "lemon", 0) //waits until the subscriber reads vanilla
+	fmt.Println("Block got:", drain(blocked, 20*time.Millisecond))
+	fmt.Println("the other one got:", drain(roomy, 20*time.Millisecond))
+	blocked.Unsubscribe(ctx)
+	roomy.Unsubscribe(ctx)
+
+	//TTL: the subscriber is busy for 30ms; a message with a 10ms TTL is gone by the time it looks
+	ttl, _ := b.Subscribe("prices", SubscribeOptions{Buffer: 10})
+	b.Publish(ctx, "prices", "blocker", 0)
+	b.Publish(ctx, "prices", "price 3.50 (ttl 10ms)", 10*time.Millisecond)
+	b.Publish(ctx, "prices", "price 3.60 (no ttl)", 0)
+	time.Sleep(30 * time.Millisecond)
+	fmt.Println("TTL got:", drain(ttl, 20*time.Millisecond), "expired", ttl.Stats().Expired)
+	ttl.Unsubscribe(ctx)
+
+	//at-least-once: the first delivery of every message is "lost" (not acked), so each comes again
+	alo, _ := b.Subscribe("jobs.>", SubscribeOptions{Buffer: 10, AckTimeout: 20 * time.Millisecond})
+	b.Publish(ctx, "jobs.a", "job A", 0)
+	b.Publish(ctx, "jobs.b", "job B", 0)
+	var log []string
+	for len(log) < 4 {
+		d := <-alo.C()
+		log = append(log, fmt.Sprintf("%s#%d", d.Payload, d.Attempt))
+		if d.Attempt > 1 {
+			d.Ack()
+		}
+	}
+	fmt.Println("at-least-once:", log)
+
+	//graceful unsubscribe: one message received but not acked yet, one still in the buffer. Unsubscribe
+	//returns only when the subscriber has both and has acked both
+	b.Publish(ctx, "jobs.c", "job C", 0)
+	b.Publish(ctx, "jobs.d", "job D", 0)
+	first := <-alo.C()
+	unsubscribed := make(chan error)
+	go func() { unsubscribed <- alo.Unsubscribe(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	first.Ack()
+	got := []string{first.Payload}
+	for d := range alo.C() {
+		got = append(got, d.Payload)
+		d.Ack()
+	}
+	fmt.Println("Unsubscribe:", <-unsubscribed, "got", got)
+	n, _ = b.Publish(ctx, "jobs.e", "job E", 0)
+	fmt.Printf("published to %d subscribers, err: %v, stats: %+v\n", n, alo.Err(), alo.Stats())
+
+	b.Close()
+	_, err = b.Publish(ctx, "orders.eu", "late", 0)
+	fmt.Println("after Close:", err)
+}
+
+/*
+Result
+go run pubsub.go
+
+orders.*:  [one two]
+orders.eu: [one]
+>:         [one two three]
+DropNewest got [vanilla chocolate], dropped 3, queued 2 of 5, err <nil>
+DropOldest got [vanilla mango], dropped 3, queued 5 of 5, err <nil>
+Disconnect got [], dropped 0, queued 2 of 5, err pubsub: slow consumer disconnected
+Block, buffer full: published to 1 err: pubsub: subscription "ice.cream": context deadline exceeded
+Block got: [vanilla chocolate lemon]
+the other one got: [vanilla chocolate mint lemon]
+TTL got: [blocker price 3.60 (no ttl)] expired 1
+at-least-once: [job A#1 job B#1 job A#2 job B#2]
+Unsubscribe: <nil> got [job C job D]
+published to 0 subscribers, err: pubsub: unsubscribed, stats: {Delivered:4 Redelivered:2 Acked:4 Dropped:0 Expired:0 GaveUp:0}
+after Close: pubsub: broker closed
+
+The same on every run. The sleeps in main are not for the broker but for the demo: each one gives the pump time to take a message before main looks.
+
+orders.* matches orders.eu and orders.us but not payments.eu, and ">" matches everything. With a buffer of 2, vanilla is held by the pump (waiting for the subscriber to read) and counts as one of the 2:
+DropNewest keeps vanilla and chocolate. DropOldest keeps vanilla, which it cannot take back, and the newest in the queue, mango. Disconnect closes the subscription on mint and throws away what it had, vanilla included. Publish counts a message as queued only where it went into the queue: DropOldest takes every new one in (and evicts an older one for it), the other two stop at 2.
+Block makes mint miss the full subscription when Publish's context ends, and lemon's Publish wait until the subscriber reads. The "ice.>" subscription, with room to spare, gets mint all the same.
+The price with a 10ms TTL is skipped because it was still queued 30ms later.
+Jobs A and B are not acked the first time, so they come again 20ms later as attempt 2.
+Unsubscribe returns only after job C (received before it was called) and job D (still queued) are both received and acked. After that nothing reaches the subscription.
+*/
@@ -0,0 +1,995 @@
+//Resilient HTTP client: httpclient.go, for a service that calls other services all day
+/*
+httpclient.go calls http.Get, which uses http.DefaultClient, and panics if anything goes wrong. That is fine for a demo. For a service it is not: DefaultClient has no timeout at all, a 503 from a server that is restarting fails the call that a second try would have saved, and every caller ends up writing the same JSON and error handling around it.
+
+Client wraps http.Client with what our services need:
+
+1. Timeouts per phase: connecting (DialTimeout), the TLS handshake, waiting for the response headers, and a whole attempt including reading the body (AttemptTimeout). The context of the call limits everything, retries included
+2. Retries with exponential back-off for 429, 502, 503, 504 and for network errors and attempts that timed out; a bad URL or an unsupported scheme fails the same way every time, so it is not retried. Only idempotent methods are retried (GET, HEAD, OPTIONS, PUT, DELETE), and POST or PATCH only with an Idempotency-Key header: a POST that timed out may have been done already. A Retry-After header (seconds or a date) replaces the back-off, and a Retry-After that is longer than the time left is not waited for
+3. Connection pool tuning: the standard transport keeps only 2 idle connections per host, so a service that calls one backend a lot keeps opening new ones. MaxIdleConnsPerHost raises that, and MaxConnsPerHost caps how many there are in all
+4. Typed JSON: GetJSON[T] and DoJSON[T] encode the request, check the status and decode the answer into T. A status that is not 2xx is a *StatusError, with the start of the body in it
+5. Decompression: gzip and deflate bodies (Compress in middlewarechain.go sends either) are decompressed, whatever asked for them
+6. Logging hooks: OnRequest and OnResponse get a LogEntry for every attempt, with secret headers (Authorization, cookies, API keys) redacted. SlogHook logs them with log/slog, as AccessLog in middlewarechain.go does on the server side
+7. Record and replay: a Recorder is a RoundTripper that saves every request and response to a cassette file, or answers from one. A test that replays a cassette needs neither the network nor the other service, and gets the same answers every time
+
+The retries happen above the transport, so a Recorder records every attempt: replaying a cassette that has a 503 and then a 200 replays the retry too.
+
+go run resilientclient.go
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoRecording is returned by a replaying Recorder for a request that is not in the cassette.
+var ErrNoRecording = errors.New("resilientclient: no recorded response for request")
+
+// RetryPolicy says when and how long to wait before trying again.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try. Zero means 3; 1 turns retries off.
+	MaxAttempts int
+	// BaseDelay is the wait before the second attempt; it doubles for every attempt after that. Zero means 100ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the back-off. Zero means 5s.
+	MaxDelay time.Duration
+	// Jitter spreads the waits by up to this fraction either way (0.2 is +-20%), so that clients that failed
+	// together do not all come back at the same moment.
+	Jitter float64
+	// MaxRetryAfter is the longest Retry-After that is waited for. Zero means 30s.
+	MaxRetryAfter time.Duration
+	// Statuses are the status codes that are retried. Nil means 429, 502, 503 and 504.
+	Statuses []int
+}
+
+// LogEntry describes one attempt. Headers are redacted.
+type LogEntry struct {
+	Method  string
+	URL     string
+	Attempt int
+	// Status, ResponseHeader, Duration and Err are only set in OnResponse.
+	Status         int
+	RequestHeader  http.Header
+	ResponseHeader http.Header
+	Duration       time.Duration
+	Err            error
+}
+
+// ClientConfig configures a Client. Zero values mean the defaults in the comments.
+type ClientConfig struct {
+	// BaseURL is what relative paths in NewRequest, GetJSON and DoJSON are resolved against.
+	BaseURL string
+	// Header is added to every request (an Authorization or a User-Agent, say).
+	Header http.Header
+
+	// DialTimeout limits connecting. Zero means 5s.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout limits the TLS handshake. Zero means 5s.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout limits the wait for the response headers once the request is sent. Zero means 10s.
+	ResponseHeaderTimeout time.Duration
+	// AttemptTimeout limits one attempt, from connecting to reading the last byte of the body. Zero means 30s.
+	AttemptTimeout time.Duration
+
+	// MaxIdleConnsPerHost is how many idle connections are kept per host. Zero means 32.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps the connections per host, busy or idle. Zero means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes idle connections after this long. Zero means 90s.
+	IdleConnTimeout time.Duration
+
+	Retry RetryPolicy
+
+	// OnRequest is called before every attempt, OnResponse after it.
+	OnRequest  func(LogEntry)
+	OnResponse func(LogEntry)
+	// Redact lists the headers whose values are hidden from the hooks and from recordings. Nil means DefaultRedact.
+	Redact []string
+
+	// WrapTransport, if set, wraps the tuned transport; a Recorder goes here.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+}
+
+// DefaultRedact are the headers that are redacted when ClientConfig.Redact is nil.
+var DefaultRedact = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// Client is an http.Client with timeouts, retries, decompression and logging.
+type Client struct {
+	cfg  ClientConfig
+	base *url.URL
+	hc   *http.Client
+}
+
+// NewClient builds a Client and its transport.
+func NewClient(cfg ClientConfig) (*Client, error) {
+	cfg.DialTimeout = cmp.Or(cfg.DialTimeout, 5*time.Second)
+	cfg.TLSHandshakeTimeout = cmp.Or(cfg.TLSHandshakeTimeout, 5*time.Second)
+	cfg.ResponseHeaderTimeout = cmp.Or(cfg.ResponseHeaderTimeout, 10*time.Second)
+	cfg.AttemptTimeout = cmp.Or(cfg.AttemptTimeout, 30*time.Second)
+	cfg.MaxIdleConnsPerHost = cmp.Or(cfg.MaxIdleConnsPerHost, 32)
+	cfg.IdleConnTimeout = cmp.Or(cfg.IdleConnTimeout, 90*time.Second)
+	cfg.Retry.MaxAttempts = cmp.Or(cfg.Retry.MaxAttempts, 3)
+	cfg.Retry.BaseDelay = cmp.Or(cfg.Retry.BaseDelay, 100*time.Millisecond)
+	cfg.Retry.MaxDelay = cmp.Or(cfg.Retry.MaxDelay, 5*time.Second)
+	cfg.Retry.MaxRetryAfter = cmp.Or(cfg.Retry.MaxRetryAfter, 30*time.Second)
+	if cfg.Retry.Statuses == nil {
+		cfg.Retry.Statuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if cfg.Redact == nil {
+		cfg.Redact = DefaultRedact
+	}
+	c := &Client{cfg: cfg}
+	if cfg.BaseURL != "" {
+		u, err := url.Parse(cfg.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("resilientclient: BaseURL: %w", err)
+		}
+		c.base = u
+	}
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		MaxIdleConns:          max(100, cfg.MaxIdleConnsPerHost),
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		ForceAttemptHTTP2:     true,
+		//we decompress ourselves, so that deflate works too and a Recorder sees the bytes that were sent
+		DisableCompression: true,
+	}
+	if cfg.WrapTransport != nil {
+		rt = cfg.WrapTransport(rt)
+	}
+	c.hc = &http.Client{Transport: rt}
+	return c, nil
+}
+
+// NewRequest is http.NewRequestWithContext with path resolved against BaseURL.
+func (c *Client) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	u := path
+	if c.base != nil {
+		ref, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		u = c.base.ResolveReference(ref).String()
+	}
+	return http.NewRequestWithContext(ctx, method, u, body)
+}
+
+// idempotent reports whether req may be sent twice.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// Do sends req, retrying it when the policy allows, and returns the last response. As with http.Client, a status
+// that is not 2xx is not an error; the caller must close the body.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	attempts := 1
+	//a body we cannot read again cannot be sent again
+	if idempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil) {
+		attempts = c.cfg.Retry.MaxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		res, err := c.attempt(req, attempt)
+		if attempt == attempts || ctx.Err() != nil {
+			return res, err
+		}
+		wait, retry := c.retryAfter(res, err, attempt)
+		if !retry {
+			return res, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			//we would be cut off before we could try again
+			return res, err
+		}
+		if res != nil {
+			//read to the end so that the connection can be used again
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+			res.Body.Close()
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// attempt sends req once, with its own AttemptTimeout.
+func (c *Client) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.cfg.AttemptTimeout)
+	r := req.Clone(ctx)
+	if attempt > 1 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.Body = body
+	}
+	for k, vs := range c.cfg.Header {
+		if r.Header.Get(k) == "" {
+			r.Header[k] = vs
+		}
+	}
+	if r.Header.Get("Accept-Encoding") == "" {
+		r.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	entry := LogEntry{Method: r.Method, URL: r.URL.Redacted(), Attempt: attempt, RequestHeader: c.redact(r.Header)}
+	if c.cfg.OnRequest != nil {
+		c.cfg.OnRequest(entry)
+	}
+	start := time.Now()
+	res, err := c.hc.Do(r)
+	if err == nil {
+		decompress(res)
+	}
+	entry.Duration, entry.Err = time.Since(start), err
+	if res != nil {
+		entry.Status, entry.ResponseHeader = res.StatusCode, c.redact(res.Header)
+	}
+	if c.cfg.OnResponse != nil {
+		c.cfg.OnResponse(entry)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	//the attempt's context has to live until the body has been read
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryAfter decides whether an attempt that got res or err is tried again, and after how long.
+func (c *Client) retryAfter(res *http.Response, err error, attempt int) (time.Duration, bool) {
+	p := c.cfg.Retry
+	if err != nil && !transient(err) {
+		return 0, false
+	}
+	if err == nil && !slices.Contains(p.Statuses, res.StatusCode) {
+		return 0, false
+	}
+	if res != nil {
+		if v := res.Header.Get("Retry-After"); v != "" {
+			d, ok := parseRetryAfter(v)
+			if ok && d > p.MaxRetryAfter {
+				return 0, false
+			}
+			if ok {
+				return d, true
+			}
+		}
+	}
+	return p.backoff(attempt), true
+}
+
+// backoff is the wait after attempt: BaseDelay doubled for every attempt after the first, up to MaxDelay, and jittered.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	//one doubling at a time, stopping at MaxDelay: BaseDelay<<(attempt-1) would overflow after about 37 attempts
+	//and come out negative
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		if d > p.MaxDelay/2 {
+			d = p.MaxDelay
+			break
+		}
+		d *= 2
+	}
+	d = min(p.MaxDelay, d)
+	if p.Jitter > 0 {
+		//a Jitter above 1 could take it below zero
+		d = max(0, time.Duration(float64(d)*(1+p.Jitter*(2*rand.Float64()-1))))
+	}
+	return d
+}
+
+// transient reports whether err from http.Client.Do is worth another attempt: a network error (refused, reset,
+// closed early) or a timeout of the attempt. A bad URL, an unsupported scheme or a redirect loop fails the same way
+// every time. Do has already stopped if the caller's own context ended.
+func transient(err error) bool {
+	var ue *url.Error
+	if !errors.As(err, &ue) {
+		return false
+	}
+	//*url.Error is a net.Error itself, so look at what it wraps
+	if errors.Is(ue.Err, context.DeadlineExceeded) || errors.Is(ue.Err, io.EOF) || errors.Is(ue.Err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(ue.Err, &ne)
+}
+
+// parseRetryAfter reads a Retry-After header: a number of seconds, or a date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(0, time.Until(t)), true
+	}
+	return 0, false
+}
+
+// decompress replaces a gzip or deflate body with one that decompresses it. Responses that have no body (to a
+// HEAD, a 204 or a 304, or an empty one) are left alone, whatever Content-Encoding says.
+func decompress(res *http.Response) {
+	enc := strings.ToLower(res.Header.Get("Content-Encoding"))
+	if enc != "gzip" && enc != "deflate" {
+		return
+	}
+	if res.Request != nil && res.Request.Method == http.MethodHead ||
+		res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified || res.ContentLength == 0 {
+		return
+	}
+	res.Body = &decoder{body: res.Body, enc: enc}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+}
+
+// decoder makes the gzip or zlib reader on the first Read, as net/http's transport does for gzip: the headers of a
+// compressed stream are only read when someone wants the body, and a bad header is an error from Read.
+type decoder struct {
+	body io.ReadCloser
+	enc  string
+	r    io.Reader
+	err  error
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = d.open()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *decoder) open() (io.Reader, error) {
+	if d.enc == "gzip" {
+		zr, err := gzip.NewReader(d.body)
+		if err == io.EOF {
+			//no body at all: nothing to decompress
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resilientclient: gzip body: %w", err)
+		}
+		return zr, nil
+	}
+	//the standard says zlib, but many servers (middlewarechain.go among them) send raw deflate; the first two
+	//bytes of a zlib stream tell them apart
+	br := bufio.NewReader(d.body)
+	h, err := br.Peek(2)
+	if err == io.EOF && len(h) == 0 {
+		return nil, io.EOF
+	}
+	if err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("resilientclient: deflate body: %w", err)
+		}
+		return zr, nil
+	}
+	return flate.NewReader(br), nil
+}
+
+func (d *decoder) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		return errors.Join(c.Close(), d.body.Close())
+	}
+	return d.body.Close()
+}
+
+func (c *Client) redact(h http.Header) http.Header {
+	return redactHeader(h, c.cfg.Redact)
+}
+
+func redactHeader(h http.Header, names []string) http.Header {
+	out := h.Clone()
+	for _, name := range names {
+		if vs := out.Values(name); len(vs) > 0 {
+			out[http.CanonicalHeaderKey(name)] = []string{"[REDACTED]"}
+		}
+	}
+	return out
+}
+
+// StatusError is returned by GetJSON and DoJSON for a status that is not 2xx.
+type StatusError struct {
+	Method, URL string
+	StatusCode  int
+	// Body is the start of the response body, which often says what went wrong.
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: status %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// DoJSON sends in (if not nil) as JSON and decodes a 2xx answer into a T.
+func DoJSON[T any](ctx context.Context, c *Client, method, path string, in any) (T, error) {
+	var out T
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return out, err
+		}
+		//a bytes.Reader lets NewRequest set GetBody, so the request can be retried
+		body = bytes.NewReader(b)
+	}
+	req, err := c.NewRequest(ctx, method, path, body)
+	if err != nil {
+		return out, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return out, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return out, &StatusError{Method: method, URL: req.URL.Redacted(), StatusCode: res.StatusCode, Body: strings.TrimSpace(string(snippet))}
+	}
+	if res.StatusCode == http.StatusNoContent {
+		return out, nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return out, fmt.Errorf("%s %s: decoding %T: %w", method, req.URL.Redacted(), out, err)
+	}
+	//the decoder stops at the end of the value; what is left (a newline, say) is read so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+	return out, nil
+}
+
+// GetJSON is DoJSON for a GET.
+func GetJSON[T any](ctx context.Context, c *Client, path string) (T, error) {
+	return DoJSON[T](ctx, c, http.MethodGet, path, nil)
+}
+
+// SlogHook returns an OnResponse hook that logs every attempt.
+func SlogHook(logger *slog.Logger) func(LogEntry) {
+	return func(e LogEntry) {
+		level := slog.LevelInfo
+		if e.Err != nil || e.Status >= 500 {
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", e.Method),
+			slog.String("url", e.URL),
+			slog.Int("attempt", e.Attempt),
+			slog.Int("status", e.Status),
+			slog.Duration("latency", e.Duration),
+			slog.String("authorization", e.RequestHeader.Get("Authorization")),
+		}
+		if e.Err != nil {
+			attrs = append(attrs, slog.String("err", e.Err.Error()))
+		}
+		logger.LogAttrs(context.Background(), level, "http call", attrs...)
+	}
+}
+
+// Interaction is one recorded request and its response.
+type Interaction struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	RequestBody   string      `json:"request_body,omitempty"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header,omitempty"`
+	// Body is the body as it was sent, still compressed if it was.
+	Body []byte `json:"body"`
+}
+
+// RecorderMode says whether a Recorder records or replays.
+type RecorderMode int
+
+const (
+	Record RecorderMode = iota
+	Replay
+)
+
+// Recorder is a RoundTripper that records to a cassette, or replays from one.
+type Recorder struct {
+	Mode RecorderMode
+	// Base sends the requests when recording.
+	Base http.RoundTripper
+	// Redact lists the request headers that are not written to the cassette. Nil means DefaultRedact.
+	Redact []string
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// LoadRecorder returns a Recorder that replays the cassette in path.
+func LoadRecorder(path string) (*Recorder, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{Mode: Replay}
+	if err := json.Unmarshal(b, &r.interactions); err != nil {
+		return nil, fmt.Errorf("resilientclient: cassette %s: %w", path, err)
+	}
+	r.used = make([]bool, len(r.interactions))
+	return r, nil
+}
+
+// Save writes what was recorded to path.
+func (r *Recorder) Save(path string) error {
+	r.mu.Lock()
+	b, err := json.MarshalIndent(r.interactions, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// RoundTrip records or replays one request.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if r.Mode == Replay {
+		return r.replay(req, body)
+	}
+	res, err := r.Base.RoundTrip(req)
+	if err != nil {
+		//errors are not recorded: replay answers ErrNoRecording instead
+		return nil, err
+	}
+	resBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+	r.mu.Lock()
+	r.interactions = append(r.interactions, Interaction{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: redactHeader(req.Header, cmpOrNil(r.Redact, DefaultRedact)),
+		RequestBody:   string(body),
+		Status:        res.StatusCode,
+		Header:        redactHeader(res.Header, cmpOrNil(r.Redact, DefaultRedact)),
+		Body:          resBody,
+	})
+	r.mu.Unlock()
+	return res, nil
+}
+
+func cmpOrNil(v, def []string) []string {
+	if v == nil {
+		return def
+	}
+	return v
+}
+
+// replay answers with the first unused interaction with the same method, URL and body. A request made twice gets
+// the two recorded answers in the order they were recorded.
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.interactions {
+		if r.used[i] || in.Method != req.Method || in.URL != req.URL.String() || in.RequestBody != string(body) {
+			continue
+		}
+		r.used[i] = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			StatusCode:    in.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        in.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(in.Body)),
+			ContentLength: int64(len(in.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrNoRecording, req.Method, req.URL)
+}
+
+type User struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func main() {
+	ctx := context.Background()
+	var calls atomic.Int32
+	var newConns atomic.Int32
+	mux := http.NewServeMux()
+	//fails twice with a 503, then works
+	mux.HandleFunc("GET /flaky", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /busy", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /very-busy", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "come back in an hour", http.StatusTooManyRequests)
+	})
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "restarting", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("GET /slow-headers", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	})
+	mux.HandleFunc("GET /slow-body", func(w http.ResponseWriter, r *http.Request) {
+		for i := range 10 {
+			fmt.Fprintln(w, i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	mux.HandleFunc("GET /report", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintln(w, "{}")
+	})
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "1" {
+			http.Error(w, `{"error":"no such user"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		fmt.Fprintln(w, `{"id":1,"name":"karen"}`)
+	})
+	mux.HandleFunc("POST /users", func(w http.ResponseWriter, r *http.Request) {
+		var u User
+		json.NewDecoder(r.Body).Decode(&u)
+		u.ID = 2
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(u)
+	})
+	mux.HandleFunc("GET /compressed", func(w http.ResponseWriter, r *http.Request) {
+		var zw io.WriteCloser
+		switch enc := r.URL.Query().Get("enc"); enc {
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw = gzip.NewWriter(w)
+		case "deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			zw, _ = flate.NewWriter(w, flate.DefaultCompression)
+		case "zlib":
+			w.Header().Set("Content-Encoding", "deflate")
+			zw = zlib.NewWriter(w)
+		}
+		fmt.Fprint(zw, strings.Repeat("vanilla ", 3))
+		zw.Close()
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	var log []string
+	var logMu sync.Mutex
+	start := time.Now()
+	c, _ := NewClient(ClientConfig{
+		BaseURL:               srv.URL,
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+		AttemptTimeout:        200 * time.Millisecond,
+		Retry:                 RetryPolicy{BaseDelay: 50 * time.Millisecond},
+		OnResponse: func(e LogEntry) {
+			logMu.Lock()
+			defer logMu.Unlock()
+			log = append(log, fmt.Sprintf("%s attempt %d: %d after %v", strings.TrimPrefix(e.URL, srv.URL), e.Attempt, e.Status, time.Since(start).Round(50*time.Millisecond)))
+		},
+	})
+	printLog := func() {
+		logMu.Lock()
+		defer logMu.Unlock()
+		for _, l := range log {
+			fmt.Println("  " + l)
+		}
+		log = nil
+	}
+	get := func(path string) string {
+		start = time.Now()
+		req, _ := c.NewRequest(ctx, http.MethodGet, path, nil)
+		res, err := c.Do(req)
+		if err != nil {
+			return strings.ReplaceAll(err.Error(), srv.URL, "")
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Sprintf("%d, reading body: %v", res.StatusCode, err)
+		}
+		return fmt.Sprintf("%d %q", res.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	fmt.Println("retries with back-off:", get("/flaky"))
+	printLog()
+	calls.Store(0)
+	fmt.Println("Retry-After: 1:", get("/busy"))
+	printLog()
+	fmt.Println("Retry-After: 3600:", get("/very-busy"))
+	printLog()
+
+	calls.Store(0)
+	req, _ := c.NewRequest(ctx, http.MethodPost, "/orders", strings.NewReader(`{"cones":2}`))
+	res, _ := c.Do(req)
+	res.Body.Close()
+	fmt.Println("POST:", res.StatusCode, "after", calls.Load(), "call")
+	calls.Store(0)
+	req, _ = c.NewRequest(ctx, http.MethodPost, "/orders", strings.NewReader(`{"cones":2}`))
+	req.Header.Set("Idempotency-Key", "order-42")
+	res, _ = c.Do(req)
+	res.Body.Close()
+	fmt.Println("POST with Idempotency-Key:", res.StatusCode, "after", calls.Load(), "calls")
+	log = nil
+
+	//the timeouts: neither is retried forever, and each one says which phase was too slow
+	c.cfg.Retry.MaxAttempts = 1
+	fmt.Println("slow headers:", get("/slow-headers"))
+	fmt.Println("slow body:", get("/slow-body"))
+	log = nil
+
+	//the connection pool: one connection for many calls one after the other; for many at once, one each unless
+	//MaxConnsPerHost says otherwise
+	pooled, _ := NewClient(ClientConfig{BaseURL: srv.URL})
+	newConns.Store(0)
+	for range 20 {
+		GetJSON[User](ctx, pooled, "/users/1")
+	}
+	fmt.Println("20 calls in a row, new connections:", newConns.Load())
+	for _, limit := range []int{0, 2} {
+		c, _ := NewClient(ClientConfig{BaseURL: srv.URL, MaxConnsPerHost: limit})
+		newConns.Store(0)
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Go(func() { GetJSON[struct{}](ctx, c, "/report") })
+		}
+		wg.Wait()
+		fmt.Printf("20 calls at once, MaxConnsPerHost %d, new connections: %d\n", limit, newConns.Load())
+	}
+
+	//typed JSON
+	u, err := GetJSON[User](ctx, pooled, "/users/1")
+	fmt.Printf("GetJSON: %+v %v\n", u, err)
+	created, err := DoJSON[User](ctx, pooled, http.MethodPost, "/users", User{Name: "ann"})
+	fmt.Printf("DoJSON POST: %+v %v\n", created, err)
+	_, err = GetJSON[User](ctx, pooled, "/users/7")
+	var se *StatusError
+	fmt.Println("GetJSON 404:", errors.As(err, &se) && se.StatusCode == 404, strings.ReplaceAll(err.Error(), srv.URL, ""))
+
+	//decompression
+	for _, enc := range []string{"gzip", "deflate", "zlib"} {
+		req, _ := pooled.NewRequest(ctx, http.MethodGet, "/compressed?enc="+enc, nil)
+		res, _ := pooled.Do(req)
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		fmt.Printf("%s: %q, uncompressed %v\n", enc, b, res.Uncompressed)
+	}
+	//a HEAD answer says gzip too, but has no body to decompress
+	head, _ := pooled.NewRequest(ctx, http.MethodHead, "/compressed?enc=gzip", nil)
+	res, err = pooled.Do(head)
+	if err == nil {
+		res.Body.Close()
+		fmt.Println("HEAD of a gzip resource:", res.StatusCode)
+	} else {
+		fmt.Println("HEAD of a gzip resource:", err)
+	}
+
+	//which errors are retried: a refused connection is, a scheme we cannot speak is not
+	var tries atomic.Int32
+	counting, _ := NewClient(ClientConfig{
+		Retry:     RetryPolicy{BaseDelay: time.Millisecond},
+		OnRequest: func(LogEntry) { tries.Add(1) },
+	})
+	closed := httptest.NewServer(mux)
+	closed.Close()
+	for _, t := range []struct{ name, url string }{
+		{"connection refused", closed.URL + "/users/1"},
+		{"ftp scheme", "ftp://127.0.0.1/users/1"},
+	} {
+		tries.Store(0)
+		_, err := GetJSON[User](ctx, counting, t.url)
+		fmt.Printf("%s: failed %v after %d attempts\n", t.name, err != nil, tries.Load())
+	}
+
+	//logging, with the token redacted; the time and latency are left out so the output stays the same
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey || a.Key == "latency" {
+			return slog.Attr{}
+		}
+		if a.Key == "url" {
+			a.Value = slog.StringValue(strings.ReplaceAll(a.Value.String(), srv.URL, ""))
+		}
+		return a
+	}}))
+	logged, _ := NewClient(ClientConfig{
+		BaseURL:    srv.URL,
+		Header:     http.Header{"Authorization": {"Bearer s3cr3t"}},
+		OnResponse: SlogHook(logger),
+	})
+	GetJSON[User](ctx, logged, "/users/1")
+
+	//record against the server, then replay with the server gone
+	dir, _ := os.MkdirTemp("", "cassette")
+	defer os.RemoveAll(dir)
+	cassette := filepath.Join(dir, "users.json")
+	rec := &Recorder{Mode: Record}
+	recording, _ := NewClient(ClientConfig{
+		BaseURL:       srv.URL,
+		Header:        http.Header{"Authorization": {"Bearer s3cr3t"}},
+		Retry:         RetryPolicy{BaseDelay: time.Millisecond},
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper { rec.Base = rt; return rec },
+	})
+	calls.Store(0)
+	u1, _ := GetJSON[User](ctx, recording, "/users/1")
+	u2, _ := DoJSON[User](ctx, recording, http.MethodPost, "/users", User{Name: "ann"})
+	recordedFlaky, _ := recording.NewRequest(ctx, http.MethodGet, "/flaky", nil)
+	res, _ = recording.Do(recordedFlaky)
+	res.Body.Close()
+	rec.Save(cassette)
+	fmt.Printf("recorded: %+v %+v, flaky %d after %d calls\n", u1, u2, res.StatusCode, calls.Load())
+	cas, _ := os.ReadFile(cassette)
+	fmt.Println("cassette has the token:", bytes.Contains(cas, []byte("s3cr3t")))
+	srv.Close()
+
+	player, err := LoadRecorder(cassette)
+	if err != nil {
+		panic(err)
+	}
+	replaying, _ := NewClient(ClientConfig{
+		BaseURL:       srv.URL,
+		Retry:         RetryPolicy{BaseDelay: time.Millisecond},
+		WrapTransport: func(http.RoundTripper) http.RoundTripper { return player },
+	})
+	u1, _ = GetJSON[User](ctx, replaying, "/users/1")
+	u2, _ = DoJSON[User](ctx, replaying, http.MethodPost, "/users", User{Name: "ann"})
+	var attempts []int
+	replayed, _ := NewClient(ClientConfig{
+		BaseURL:       srv.URL,
+		Retry:         RetryPolicy{BaseDelay: time.Millisecond},
+		WrapTransport: func(http.RoundTripper) http.RoundTripper { return player },
+		OnResponse:    func(e LogEntry) { attempts = append(attempts, e.Status) },
+	})
+	replayedFlaky, _ := replayed.NewRequest(ctx, http.MethodGet, "/flaky", nil)
+	res, err = replayed.Do(replayedFlaky)
+	if err == nil {
+		res.Body.Close()
+	}
+	fmt.Printf("replayed: %+v %+v, flaky statuses %v\n", u1, u2, attempts)
+	_, err = GetJSON[User](ctx, replaying, "/users/3")
+	fmt.Println("not recorded:", errors.Is(err, ErrNoRecording))
+
+	//the default back-off, long after a plain BaseDelay<<(attempt-1) would have overflowed; and a Jitter of 3
+	//spreads the wait from -2x to 4x, which must not come out below zero
+	defaults, _ := NewClient(ClientConfig{})
+	p := defaults.cfg.Retry
+	fmt.Println("back-off at attempts 2, 40, 100:", p.backoff(2), p.backoff(40), p.backoff(100))
+	p.Jitter = 3
+	lowest := p.backoff(1)
+	for range 1000 {
+		lowest = min(lowest, p.backoff(1))
+	}
+	fmt.Println("lowest of 1000 back-offs with Jitter 3:", lowest)
+}
+
+/*
+Result
+go run resilientclient.go
+
+retries with back-off: 200 "ok"
+  /flaky attempt 1: 503 after 0s
+  /flaky attempt 2: 503 after 50ms
+  /flaky attempt 3: 200 after 150ms
+Retry-After: 1: 200 "ok"
+  /busy attempt 1: 429 after 0s
+  /busy attempt 2: 200 after 1s
+Retry-After: 3600: 429 "come back in an hour"
+  /very-busy attempt 1: 429 after 0s
+POST: 503 after 1 call
+POST with Idempotency-Key: 503 after 3 calls
+slow headers: Get "/slow-headers": net/http: timeout awaiting response headers
+slow body: 200, reading body: context deadline exceeded
+20 calls in a row, new connections: 1
+20 calls at once, MaxConnsPerHost 0, new connections: 20
+20 calls at once, MaxConnsPerHost 2, new connections: 2
+GetJSON: {ID:1 Name:karen} <nil>
+DoJSON POST: {ID:2 Name:ann} <nil>
+GetJSON 404: true GET /users/7: status 404: {"error":"no such user"}
+gzip: "vanilla vanilla vanilla ", uncompressed true
+deflate: "vanilla vanilla vanilla ", uncompressed true
+zlib: "vanilla vanilla vanilla ", uncompressed true
+HEAD of a gzip resource: 200
+connection refused: failed true after 3 attempts
+ftp scheme: failed true after 1 attempts
+level=INFO msg="http call" method=GET url=/users/1 attempt=1 status=200 authorization=[REDACTED]
+recorded: {ID:1 Name:karen} {ID:2 Name:ann}, flaky 200 after 3 calls
+cassette has the token: false
+replayed: {ID:1 Name:karen} {ID:2 Name:ann}, flaky statuses [503 503 200]
+not recorded: true
+back-off at attempts 2, 40, 100: 200ms 5s 5s
+lowest of 1000 back-offs with Jitter 3: 0s
+
+(the same on every run, give or take a rounding of the times)
+
+/flaky is tried three times, 50ms and then 100ms apart, and the third try works. /busy waits the second its Retry-After asks for; /very-busy asks for an hour, which is more than MaxRetryAfter, so its 429 is returned right away.
+The POST without an Idempotency-Key is sent once: the server may have taken the order before it failed. With the key it is tried three times.
+The two timeouts say which phase was too slow: the headers did not come within ResponseHeaderTimeout, or the body was not read within AttemptTimeout.
+Calls one after the other share one connection. Twenty at once open twenty connections, unless MaxConnsPerHost makes them wait for two.
+The HEAD answer says Content-Encoding: gzip but has no body, so there is nothing to decompress and no error. A refused connection may work on the next try; an ftp:// URL never will, so it is tried once.
+The cassette does not have the token in it, and replaying it gives the same answers, including the two 503s of /flaky before its 200, with no server.
+*/
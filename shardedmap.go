@@ -0,0 +1,477 @@
+//Sharded map: mutex.go's Container, split so that goroutines stop waiting for each other
+/*
+mutex.go guards one map with one sync.Mutex. Every goroutine, reading or writing, whatever key it wants, waits for the same lock. statefulgoroutines.go does the same with a goroutine instead of a lock: every read and write is a message to the one goroutine that owns the map. Both are correct, and both let exactly one goroutine touch the map at a time. On a machine with 16 cores, 15 of them wait.
+
+ShardedMap[K, V] splits the map into shards - many small maps, each with its own sync.RWMutex. A key always lives in the same shard (its hash picks it), so two goroutines only wait for each other when their keys happen to land in the same shard. With 64 shards that is rare. And because the locks are RWMutexes, readers of the same shard do not wait for each other at all.
+
+On top of Get, Set and Delete it has:
+
+Compute - read, change and write one key as a single step, while holding that key's shard lock. Container.inc is Compute with old+1
+Upsert - store a value, or merge it into the one already there
+All - a range-over-func iterator. It copies one shard at a time and runs the loop body without holding any lock, so the body can call back into the map. Snapshot copies everything at one point in time instead (it holds every shard's read lock while copying)
+TTL - entries can expire. Expired entries are invisible at once; a janitor goroutine removes them every CleanupInterval
+
+sync.Map is the standard library's answer to the same problem. Its documentation says it is built for two cases: keys that are written once and read many times, and goroutines that work on disjoint keys. main runs benchmarks (with testing.Benchmark, so they run with go run) of all four under a read-heavy and a write-heavy mix.
+
+go run shardedmap.go
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/maphash"
+	"iter"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ShardedMapConfig configures a ShardedMap.
+type ShardedMapConfig struct {
+	// Shards is the number of shards. Less than 1 means 64.
+	Shards int
+	// TTL is how long entries live if Set is used. Zero means forever. SetTTL sets it per entry.
+	TTL time.Duration
+	// CleanupInterval is how often a janitor goroutine removes expired entries. Zero means no janitor:
+	// expired entries are then only removed when they are overwritten or deleted, or by Sweep.
+	CleanupInterval time.Duration
+	// Now returns the current time. nil means time.Now.
+	Now func() time.Time
+}
+
+type shardEntry[V any] struct {
+	val V
+	//expires is in UnixNano; 0 means never
+	expires int64
+}
+
+type shard[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]shardEntry[V]
+}
+
+// ShardedMap is a map that is safe for concurrent use, with one RWMutex per shard.
+type ShardedMap[K comparable, V any] struct {
+	shards []*shard[K, V]
+	seed   maphash.Seed
+	ttl    time.Duration
+	now    func() time.Time
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// NewShardedMap returns an empty map. If cfg.CleanupInterval is set, Close must be called to stop the janitor.
+func NewShardedMap[K comparable, V any](cfg ShardedMapConfig) *ShardedMap[K, V] {
+	if cfg.Shards < 1 {
+		cfg.Shards = 64
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	m := &ShardedMap[K, V]{seed: maphash.MakeSeed(), ttl: cfg.TTL, now: cfg.Now, stop: make(chan struct{})}
+	for i := 0; i < cfg.Shards; i++ {
+		m.shards = append(m.shards, &shard[K, V]{m: make(map[K]shardEntry[V])})
+	}
+	if cfg.CleanupInterval > 0 {
+		go m.janitor(cfg.CleanupInterval)
+	}
+	return m
+}
+
+func (m *ShardedMap[K, V]) shard(key K) *shard[K, V] {
+	return m.shards[maphash.Comparable(m.seed, key)%uint64(len(m.shards))]
+}
+
+func (m *ShardedMap[K, V]) expires(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return m.now().Add(ttl).UnixNano()
+}
+
+func (m *ShardedMap[K, V]) live(e shardEntry[V], now int64) bool {
+	return e.expires == 0 || e.expires > now
+}
+
+// expired reports whether e has expired. It only reads the clock if e can expire at all, which keeps Get cheap.
+func (m *ShardedMap[K, V]) expired(e shardEntry[V]) bool {
+	return e.expires != 0 && e.expires <= m.now().UnixNano()
+}
+
+// Get returns the value for key and whether it is there.
+func (m *ShardedMap[K, V]) Get(key K) (V, bool) {
+	s := m.shard(key)
+	s.mu.RLock()
+	e, ok := s.m[key]
+	s.mu.RUnlock()
+	if !ok || m.expired(e) {
+		var zero V
+		return zero, false
+	}
+	return e.val, true
+}
+
+// Set stores val under key, with the map's TTL.
+func (m *ShardedMap[K, V]) Set(key K, val V) {
+	m.SetTTL(key, val, m.ttl)
+}
+
+// SetTTL stores val under key; it expires after ttl. Zero means never.
+func (m *ShardedMap[K, V]) SetTTL(key K, val V, ttl time.Duration) {
+	s := m.shard(key)
+	e := shardEntry[V]{val: val, expires: m.expires(ttl)}
+	s.mu.Lock()
+	s.m[key] = e
+	s.mu.Unlock()
+}
+
+// Delete removes key.
+func (m *ShardedMap[K, V]) Delete(key K) {
+	s := m.shard(key)
+	s.mu.Lock()
+	delete(s.m, key)
+	s.mu.Unlock()
+}
+
+// Compute calls fn with the current value of key (and whether there is one) and stores what it returns, or deletes
+// key if keep is false. Nothing else can read or write the key in between. fn must not use the map: it runs while
+// the shard is locked. A value written by Compute gets the map's TTL.
+func (m *ShardedMap[K, V]) Compute(key K, fn func(old V, found bool) (val V, keep bool)) (V, bool) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, found := s.m[key]
+	if found && m.expired(e) {
+		var zero V
+		e, found = shardEntry[V]{val: zero}, false
+	}
+	val, keep := fn(e.val, found)
+	if !keep {
+		delete(s.m, key)
+		return val, false
+	}
+	s.m[key] = shardEntry[V]{val: val, expires: m.expires(m.ttl)}
+	return val, true
+}
+
+// Upsert stores val under key if it is not there, and merge(old, val) if it is. It returns what was stored.
+func (m *ShardedMap[K, V]) Upsert(key K, val V, merge func(old, new V) V) V {
+	v, _ := m.Compute(key, func(old V, found bool) (V, bool) {
+		if found {
+			return merge(old, val), true
+		}
+		return val, true
+	})
+	return v
+}
+
+// Len returns the number of entries that have not expired.
+func (m *ShardedMap[K, V]) Len() int {
+	now := m.now().UnixNano()
+	n := 0
+	for _, s := range m.shards {
+		s.mu.RLock()
+		for _, e := range s.m {
+			if m.live(e, now) {
+				n++
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// All iterates over the map one shard at a time. Each shard is copied under its read lock and the loop body runs
+// without any lock held, so it may use the map. A write to a shard that has not been copied yet is seen; a write to
+// one that has been is not.
+func (m *ShardedMap[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		type kv struct {
+			k K
+			v V
+		}
+		var buf []kv
+		for _, s := range m.shards {
+			now := m.now().UnixNano()
+			buf = buf[:0]
+			s.mu.RLock()
+			for k, e := range s.m {
+				if m.live(e, now) {
+					buf = append(buf, kv{k, e.val})
+				}
+			}
+			s.mu.RUnlock()
+			for _, p := range buf {
+				if !yield(p.k, p.v) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Snapshot returns a copy of the whole map at one point in time. It holds every shard's read lock while copying,
+// so writers wait for it.
+func (m *ShardedMap[K, V]) Snapshot() map[K]V {
+	for _, s := range m.shards {
+		s.mu.RLock()
+	}
+	now := m.now().UnixNano()
+	out := make(map[K]V)
+	for _, s := range m.shards {
+		for k, e := range s.m {
+			if m.live(e, now) {
+				out[k] = e.val
+			}
+		}
+	}
+	for _, s := range m.shards {
+		s.mu.RUnlock()
+	}
+	return out
+}
+
+// Sweep removes expired entries and returns how many it removed.
+func (m *ShardedMap[K, V]) Sweep() int {
+	n := 0
+	for _, s := range m.shards {
+		now := m.now().UnixNano()
+		s.mu.Lock()
+		for k, e := range s.m {
+			if !m.live(e, now) {
+				delete(s.m, k)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (m *ShardedMap[K, V]) janitor(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.Sweep()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Close stops the janitor.
+func (m *ShardedMap[K, V]) Close() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+// Container is the counter map from mutex.go, with a get so it can be benchmarked on reads too.
+type Container struct {
+	mu       sync.Mutex
+	counters map[string]int
+}
+
+func (c *Container) inc(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters[name]++
+}
+
+func (c *Container) get(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counters[name]
+}
+
+// ownerMap is the map from statefulgoroutines.go, owned by one goroutine.
+type ownerMap struct {
+	reads  chan readOp
+	writes chan writeOp
+}
+
+type readOp struct {
+	key  string
+	resp chan int
+}
+
+type writeOp struct {
+	key  string
+	resp chan bool
+}
+
+func newOwnerMap() *ownerMap {
+	o := &ownerMap{reads: make(chan readOp), writes: make(chan writeOp)}
+	go func() {
+		state := make(map[string]int)
+		for {
+			select {
+			case read := <-o.reads:
+				read.resp <- state[read.key]
+			case write := <-o.writes:
+				state[write.key]++
+				write.resp <- true
+			}
+		}
+	}()
+	return o
+}
+
+func (o *ownerMap) inc(name string) {
+	w := writeOp{key: name, resp: make(chan bool)}
+	o.writes <- w
+	<-w.resp
+}
+
+func (o *ownerMap) get(name string) int {
+	r := readOp{key: name, resp: make(chan int)}
+	o.reads <- r
+	return <-r.resp
+}
+
+// syncMap counts with sync.Map. Counters are *atomic.Int64, so inc does not need Compute: sync.Map has none.
+type syncMap struct {
+	m sync.Map
+}
+
+func (s *syncMap) inc(name string) {
+	v, ok := s.m.Load(name)
+	if !ok {
+		v, _ = s.m.LoadOrStore(name, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Add(1)
+}
+
+func (s *syncMap) get(name string) int {
+	v, ok := s.m.Load(name)
+	if !ok {
+		return 0
+	}
+	return int(v.(*atomic.Int64).Load())
+}
+
+type shardedCounters struct {
+	m *ShardedMap[string, int]
+}
+
+func (s shardedCounters) inc(name string) {
+	s.m.Compute(name, func(old int, _ bool) (int, bool) { return old + 1, true })
+}
+
+func (s shardedCounters) get(name string) int {
+	v, _ := s.m.Get(name)
+	return v
+}
+
+// counters is what the benchmarks need from each map.
+type counters interface {
+	inc(name string)
+	get(name string) int
+}
+
+// benchmark runs a parallel mix of reads and writes on c: out of every 10 operations, writes are writes.
+func benchmark(c counters, keys []string, writes int) testing.BenchmarkResult {
+	return testing.Benchmark(func(b *testing.B) {
+		for _, k := range keys {
+			c.inc(k)
+		}
+		var next atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			//every goroutine starts at a different key
+			i := int(next.Add(7919))
+			for pb.Next() {
+				k := keys[i%len(keys)]
+				if i%10 < writes {
+					c.inc(k)
+				} else {
+					c.get(k)
+				}
+				i++
+			}
+		})
+	})
+}
+
+func main() {
+	//Container.inc from mutex.go, done with Compute
+	m := NewShardedMap[string, int](ShardedMapConfig{})
+	var wg sync.WaitGroup
+	doIncrement := func(name string, n int) {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			m.Compute(name, func(old int, _ bool) (int, bool) { return old + 1, true })
+		}
+	}
+	wg.Add(3)
+	go doIncrement("a", 10000)
+	go doIncrement("a", 10000)
+	go doIncrement("b", 10000)
+	wg.Wait()
+	fmt.Println(m.Snapshot())
+
+	//Upsert merges; All can change the map while it iterates
+	m.Upsert("a", 5, func(old, n int) int { return old + n })
+	m.Upsert("c", 5, func(old, n int) int { return old + n })
+	for k, v := range m.All() {
+		if v < 10 {
+			m.Delete(k)
+		}
+	}
+	fmt.Println("after Upsert and deleting the small ones:", m.Snapshot())
+
+	//TTL with a clock we move by hand
+	var now atomic.Int64
+	clock := func() time.Time { return time.Unix(0, now.Load()) }
+	ttl := NewShardedMap[string, string](ShardedMapConfig{TTL: time.Minute, Now: clock})
+	ttl.Set("session", "alice")
+	ttl.SetTTL("remember-me", "alice", time.Hour)
+	now.Add(int64(2 * time.Minute))
+	_, ok := ttl.Get("session")
+	fmt.Println("after 2 minutes: session", ok, "len", ttl.Len(), "swept", ttl.Sweep())
+
+	//benchmarks: 1000 keys, 9 reads to 1 write, then 1 read to 9 writes
+	testing.Init()
+	flag.Set("test.benchtime", "200ms")
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	maps := []struct {
+		name string
+		new  func() counters
+	}{
+		{"Container (one Mutex)", func() counters { return &Container{counters: map[string]int{}} }},
+		{"owner goroutine", func() counters { return newOwnerMap() }},
+		{"sync.Map", func() counters { return &syncMap{} }},
+		{"ShardedMap", func() counters { return shardedCounters{NewShardedMap[string, int](ShardedMapConfig{})} }},
+	}
+	fmt.Printf("%-22s %14s %14s\n", "ns/op", "90% reads", "90% writes")
+	for _, mp := range maps {
+		read := benchmark(mp.new(), keys, 1)
+		write := benchmark(mp.new(), keys, 9)
+		fmt.Printf("%-22s %14d %14d\n", mp.name, read.NsPerOp(), write.NsPerOp())
+	}
+}
+
+/*
+Result
+go run shardedmap.go
+
+map[a:20000 b:10000]
+after Upsert and deleting the small ones: map[a:20005 b:10000]
+after 2 minutes: session false len 1 swept 1
+ns/op                       90% reads     90% writes
+Container (one Mutex)              48             49
+owner goroutine                  1317           1342
+sync.Map                           57             61
+ShardedMap                         70            107
+
+(the numbers depend on the machine; these are from a machine with a single CPU)
+With one CPU only one goroutine runs at a time, so nobody ever waits for a lock and splitting the lock buys nothing: the plain Mutex wins, and ShardedMap pays for hashing the key and for the Compute closure. The owner goroutine is 20-30 times slower on any machine: every operation is two channel operations and a switch between goroutines.
+Run it with more cores (or compare GOMAXPROCS=1 with the default on a laptop): the one Mutex and the owner goroutine get slower per operation as goroutines queue for them, while ShardedMap and, for reads, sync.Map get faster. sync.Map falls behind ShardedMap in the write-heavy mix, which is not one of the two cases it is built for.
+*/
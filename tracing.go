@@ -0,0 +1,765 @@
+/*
+Distributed tracing with W3C Trace Context
+
+middleware.go, restserver.go and guardian-auth.go each log what happens inside one server, and httpclient.go calls out to another one. When a request goes through three of those, nothing ties the log lines together. Tracing does: every request carries a trace ID, and every piece of work done for it (a handler, an outgoing call) is a span with its own ID and a pointer to its parent.
+
+The W3C Trace Context spec (https://www.w3.org/TR/trace-context/) says how the IDs travel between services, in two headers:
+
+	traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	             |  |                                |                |
+	             |  trace id (16 bytes, hex)         parent span id   flags (01 = sampled)
+	             version
+	tracestate:  vendor1=value,vendor2=value   (opaque, passed along untouched)
+
+Here we:
+
+1. Parse and format traceparent/tracestate
+2. Write a server Middleware (same shape as the ones in middlewarechain.go) that continues the caller's trace, or starts a new one, and records a span around the handler
+3. Write a client Transport that records a span for each outgoing request and injects the headers, so the next server continues the same trace
+4. Send finished spans to a pluggable Exporter: one prints JSON lines, the other posts OTLP/HTTP JSON to a collector
+
+The demo starts a fake collector, a backend and a frontend with httptest, so it needs nothing else running.
+
+go run tracing.go
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies one trace across every service it touches.
+type TraceID [16]byte
+
+// SpanID identifies one span inside a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether t is not all zeroes, which the spec forbids.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether s is not all zeroes, which the spec forbids.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// FlagSampled is the only trace flag defined by the spec.
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span that travels between services.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+// Sampled reports whether the sampled flag is set.
+func (sc SpanContext) Sampled() bool { return sc.Flags&FlagSampled != 0 }
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ErrBadTraceparent is returned by ParseTraceparent for a header that doesn't follow the spec.
+var ErrBadTraceparent = errors.New("malformed traceparent")
+
+// ParseTraceparent parses a traceparent header value.
+/*
+The rules from the spec:
+- version ff is invalid
+- version 00 has exactly four fields
+- a higher version may add fields after the flags, which we must ignore (so we can talk to newer tracers)
+- all-zero trace or span IDs are invalid
+- hex must be lowercase
+*/
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return sc, ErrBadTraceparent
+	}
+	version, err := decodeHex(parts[0], 1)
+	if err != nil || version[0] == 0xff {
+		return sc, ErrBadTraceparent
+	}
+	if version[0] == 0 && len(parts) != 4 {
+		return sc, ErrBadTraceparent
+	}
+	tid, err := decodeHex(parts[1], 16)
+	if err != nil {
+		return sc, ErrBadTraceparent
+	}
+	sid, err := decodeHex(parts[2], 8)
+	if err != nil {
+		return sc, ErrBadTraceparent
+	}
+	flags, err := decodeHex(parts[3], 1)
+	if err != nil {
+		return sc, ErrBadTraceparent
+	}
+	copy(sc.TraceID[:], tid)
+	copy(sc.SpanID[:], sid)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ErrBadTraceparent
+	}
+	return sc, nil
+}
+
+func decodeHex(s string, n int) ([]byte, error) {
+	if len(s) != 2*n || strings.ToLower(s) != s {
+		return nil, ErrBadTraceparent
+	}
+	return hex.DecodeString(s)
+}
+
+// ParseTracestate cleans up a tracestate header: it drops empty and malformed members and keeps at most 32, as the spec asks.
+// A tracestate that can't be cleaned up is dropped, since the spec says a bad tracestate must not break the traceparent.
+func ParseTracestate(s string) string {
+	var members []string
+	seen := map[string]bool{}
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(m, "=")
+		if !ok || key == "" || val == "" || len(key) > 256 || len(val) > 256 || seen[key] {
+			return ""
+		}
+		seen[key] = true
+		members = append(members, m)
+		if len(members) == 32 {
+			break
+		}
+	}
+	return strings.Join(members, ",")
+}
+
+// SpanKind says which side of a call a span is on.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	}
+	return "internal"
+}
+
+// SpanData is a finished span, ready to export.
+type SpanData struct {
+	Service    string
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	Err        string
+}
+
+// Span is a span that is still recording. Call End exactly once.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Context returns the SpanContext to propagate to child spans and other services.
+func (s *Span) Context() SpanContext {
+	return s.data.Context
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *Span) SetAttribute(key string, v any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes[key] = v
+}
+
+// RecordError marks the span as failed.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err.Error()
+}
+
+// End finishes the span and hands it to the Tracer's exporter if it is sampled.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	//the exporter gets its own copy of the attributes, so a late SetAttribute can't race with it
+	data.Attributes = make(map[string]any, len(s.data.Attributes))
+	for k, v := range s.data.Attributes {
+		data.Attributes[k] = v
+	}
+	s.mu.Unlock()
+	if data.Context.Sampled() {
+		s.tracer.enqueue(data)
+	}
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+type remoteKey struct{}
+
+// ContextWithRemoteParent stores a SpanContext received from another service, so the next span started from ctx continues that trace.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// Tracer starts spans and exports the finished ones in batches from a background goroutine, so exporting never slows down a request.
+type Tracer struct {
+	Service string
+
+	exporter Exporter
+	queue    chan SpanData
+	flushReq chan chan struct{}
+	//stop is closed by Shutdown; the queue itself is never closed, so a late End cannot send on a closed channel
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTracer starts a Tracer for service that exports through exp at most every interval, or sooner once batch spans are waiting.
+// It panics if batch is less than 1 or interval is not positive, as time.NewTicker does.
+func NewTracer(service string, exp Exporter, batch int, interval time.Duration) *Tracer {
+	if batch < 1 {
+		panic("tracing: NewTracer: batch must be at least 1")
+	}
+	if interval <= 0 {
+		panic("tracing: NewTracer: interval must be positive")
+	}
+	t := &Tracer{
+		Service:  service,
+		exporter: exp,
+		queue:    make(chan SpanData, 4*batch),
+		flushReq: make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.loop(batch, interval)
+	return t
+}
+
+func (t *Tracer) loop(batch int, interval time.Duration) {
+	defer close(t.done)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	var buf []SpanData
+	export := func() {
+		if len(buf) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.exporter.Export(ctx, buf); err != nil {
+			fmt.Fprintln(os.Stderr, "trace export:", err)
+		}
+		cancel()
+		buf = nil
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			buf = append(buf, s)
+			if len(buf) >= batch {
+				export()
+			}
+		case <-tick.C:
+			export()
+		case ack := <-t.flushReq:
+			//take what is already queued before exporting
+			for n := len(t.queue); n > 0; n-- {
+				buf = append(buf, <-t.queue)
+			}
+			export()
+			close(ack)
+		case <-t.stop:
+			for n := len(t.queue); n > 0; n-- {
+				buf = append(buf, <-t.queue)
+			}
+			export()
+			return
+		}
+	}
+}
+
+// enqueue drops the span rather than block a request when the exporter can't keep up, or after Shutdown
+func (t *Tracer) enqueue(s SpanData) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+// Flush exports every span that has ended so far.
+func (t *Tracer) Flush() {
+	ack := make(chan struct{})
+	select {
+	case t.flushReq <- ack:
+		<-ack
+	case <-t.done:
+	}
+}
+
+// Shutdown exports what is left and stops the background goroutine. Spans ended after Shutdown are lost.
+func (t *Tracer) Shutdown() {
+	t.closeOnce.Do(func() {
+		close(t.stop)
+	})
+	<-t.done
+}
+
+// Start starts a span as a child of the span (or remote parent) in ctx, and returns a ctx that holds the new span.
+// With no parent, a new sampled trace is started.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.Context()
+	} else if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = sc
+	}
+	sc := parent
+	if !parent.IsValid() {
+		sc = SpanContext{Flags: FlagSampled}
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+	s := &Span{tracer: t, data: SpanData{
+		Service:    t.Service,
+		Name:       name,
+		Kind:       kind,
+		Context:    sc,
+		Parent:     parent.SpanID,
+		Start:      time.Now(),
+		Attributes: map[string]any{},
+	}}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// statusWriter remembers the status code for the span
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware continues the trace in the incoming traceparent header (or starts a new one) and records a server span around the handler.
+// It has the same shape as the middlewares in middlewarechain.go, so it can go in a Chain.
+func Middleware(t *Tracer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if sc, err := ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+				sc.TraceState = ParseTracestate(strings.Join(r.Header.Values("tracestate"), ","))
+				ctx = ContextWithRemoteParent(ctx, sc)
+			}
+			ctx, span := t.Start(ctx, r.Method+" "+r.URL.Path, SpanKindServer)
+			defer span.End()
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("url.path", r.URL.Path)
+
+			sw := &statusWriter{ResponseWriter: w}
+			r = r.WithContext(ctx)
+			next.ServeHTTP(sw, r)
+
+			//r.Pattern is only known after the ServeMux routed the request, so the name is fixed up at the end
+			if r.Pattern != "" {
+				span.mu.Lock()
+				span.data.Name = r.Pattern
+				span.mu.Unlock()
+				span.SetAttribute("http.route", r.Pattern)
+			}
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttribute("http.response.status_code", status)
+			if status >= 500 {
+				span.RecordError(errors.New(http.StatusText(status)))
+			}
+		})
+	}
+}
+
+// Transport records a client span for every request and injects traceparent and tracestate, so the server continues the trace.
+type Transport struct {
+	Tracer *Tracer
+	// Base defaults to http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+func (tr *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := tr.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	_, span := tr.Tracer.Start(r.Context(), r.Method+" "+r.URL.Host, SpanKindClient)
+	defer span.End()
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.full", r.URL.String())
+
+	//a RoundTripper must not modify the request it was given
+	r = r.Clone(r.Context())
+	sc := span.Context()
+	r.Header.Set("traceparent", sc.Traceparent())
+	if sc.TraceState != "" {
+		r.Header.Set("tracestate", sc.TraceState)
+	}
+	resp, err := base.RoundTrip(r)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.RecordError(errors.New(resp.Status))
+	}
+	return resp, nil
+}
+
+// StdoutExporter writes each span as one line of JSON to W (os.Stdout if nil).
+type StdoutExporter struct {
+	W io.Writer
+}
+
+func (e *StdoutExporter) Export(ctx context.Context, spans []SpanData) error {
+	w := e.W
+	if w == nil {
+		w = os.Stdout
+	}
+	enc := json.NewEncoder(w)
+	for _, s := range spans {
+		parent := ""
+		if s.Parent.IsValid() {
+			parent = s.Parent.String()
+		}
+		err := enc.Encode(map[string]any{
+			"service":    s.Service,
+			"name":       s.Name,
+			"kind":       s.Kind.String(),
+			"trace_id":   s.Context.TraceID.String(),
+			"span_id":    s.Context.SpanID.String(),
+			"parent_id":  parent,
+			"start":      s.Start,
+			"duration":   s.End.Sub(s.Start).String(),
+			"attributes": s.Attributes,
+			"error":      s.Err,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP/HTTP with the JSON encoding.
+type OTLPExporter struct {
+	// Endpoint is the collector base URL, e.g. http://localhost:4318. Spans are posted to Endpoint + "/v1/traces".
+	Endpoint string
+	Headers  map[string]string
+	// Client defaults to a client with a 10 second timeout.
+	Client *http.Client
+}
+
+/*
+The OTLP JSON mapping is the protobuf message written as JSON: IDs are hex strings, 64-bit integers (the timestamps) are strings, and attribute values are wrapped in {"stringValue": ...}, {"intValue": ...} and so on.
+*/
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpValue(v any) otlpAnyValue {
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	}
+	s := fmt.Sprint(v)
+	return otlpAnyValue{StringValue: &s}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	//one resourceSpans entry per service, each with a single scope
+	var req otlpRequest
+	index := map[string]int{}
+	for _, s := range spans {
+		i, ok := index[s.Service]
+		if !ok {
+			i = len(req.ResourceSpans)
+			index[s.Service] = i
+			var rs otlpResourceSpans
+			rs.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpValue(s.Service)}}
+			var ss otlpScopeSpans
+			ss.Scope.Name = "vumultimodal/tracing"
+			rs.ScopeSpans = []otlpScopeSpans{ss}
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+		out := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			TraceState:        s.Context.TraceState,
+			Name:              s.Name,
+			Kind:              int(s.Kind),
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent.IsValid() {
+			out.ParentSpanID = s.Parent.String()
+		}
+		for k, v := range s.Attributes {
+			out.Attributes = append(out.Attributes, otlpKeyValue{Key: k, Value: otlpValue(v)})
+		}
+		if s.Err != "" {
+			//2 is STATUS_CODE_ERROR
+			out.Status.Code, out.Status.Message = 2, s.Err
+		}
+		ss := &req.ResourceSpans[i].ScopeSpans[0]
+		ss.Spans = append(ss.Spans, out)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(e.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		hr.Header.Set(k, v)
+	}
+	c := e.Client
+	if c == nil {
+		c = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := c.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export: %s", resp.Status)
+	}
+	return nil
+}
+
+func main() {
+	//a stand-in for an OpenTelemetry collector: it decodes what we post and prints one line per span
+	var mu sync.Mutex
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			service := *rs.Resource.Attributes[0].Value.StringValue
+			for _, s := range rs.ScopeSpans[0].Spans {
+				fmt.Printf("collector: trace=%s span=%s parent=%-16s %-8s %s\n", s.TraceID, s.SpanID, s.ParentSpanID, service, s.Name)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	exp := &OTLPExporter{Endpoint: collector.URL}
+	backendTracer := NewTracer("backend", exp, 10, time.Second)
+	frontendTracer := NewTracer("frontend", exp, 10, time.Second)
+
+	backendMux := http.NewServeMux()
+	backendMux.HandleFunc("GET /price/{item}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s costs 3 dollars", r.PathValue("item"))
+	})
+	backend := httptest.NewServer(Middleware(backendTracer)(backendMux))
+	defer backend.Close()
+
+	//the frontend calls the backend with a client whose Transport carries the trace on
+	client := &http.Client{Transport: &Transport{Tracer: frontendTracer}}
+	frontendMux := http.NewServeMux()
+	frontendMux.HandleFunc("GET /quote", func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL+"/price/apple", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	})
+	frontend := httptest.NewServer(Middleware(frontendTracer)(frontendMux))
+	defer frontend.Close()
+
+	//pretend we are a browser that is already part of a trace
+	req, _ := http.NewRequest(http.MethodGet, frontend.URL+"/quote", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "congo=t61rcWkgMzE")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	fmt.Println("response:", string(body))
+
+	frontendTracer.Shutdown()
+	backendTracer.Shutdown()
+
+	//the same spans can go to stdout instead
+	local := NewTracer("local", &StdoutExporter{}, 10, time.Second)
+	ctx, parent := local.Start(context.Background(), "batch job", SpanKindInternal)
+	_, child := local.Start(ctx, "step 1", SpanKindInternal)
+	child.RecordError(errors.New("disk full"))
+	child.End()
+	_, late := local.Start(ctx, "step 2", SpanKindInternal)
+	parent.End()
+	local.Shutdown()
+	//ended after Shutdown: dropped, not exported
+	late.End()
+
+	fmt.Println(ParseTraceparent("ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+}
+
+/*
+Result
+go run tracing.go
+
+response: apple costs 3 dollars
+collector: trace=4bf92f3577b34da6a3ce929d0e0e4736 span=5d1a0f3c2b7e4a19 parent=9c0e27b5a1d34f88 frontend GET 127.0.0.1:35293
+collector: trace=4bf92f3577b34da6a3ce929d0e0e4736 span=9c0e27b5a1d34f88 parent=00f067aa0ba902b7 frontend GET /quote
+collector: trace=4bf92f3577b34da6a3ce929d0e0e4736 span=e3a8c1d204b6f7a2 parent=5d1a0f3c2b7e4a19 backend  GET /price/{item}
+{"attributes":{},"duration":"3.991µs","error":"disk full","kind":"internal","name":"step 1",...}
+{"attributes":{},"duration":"15.224µs","error":"","kind":"internal","name":"batch job",...}
+{00000000000000000000000000000000 0000000000000000 0 } malformed traceparent
+
+Every span has the trace id the "browser" sent, and each parent points at the span that called it.
+"step 2" ends after Shutdown, so it is dropped instead of exported.
+*/
@@ -0,0 +1,552 @@
+//Virtual clock: testing timing-dependent code without waiting for it, and getting the same answer every time
+/*
+conpatterncancelcontext.go sleeps for rand.Intn(200) milliseconds and races that against a 150ms timeout. Run it twice and you may get "work complete" once and "work cancelled" the next time. conpatternfanout.go prints the employees in a different order every run, selectchannels.go takes 2 real seconds, and done.go takes 1. None of them can be tested: a test that sleeps is slow, and a test whose result depends on the scheduler and the random generator is flaky.
+
+Two things make the outcome random: time and randomness. Both become inputs:
+
+1. Randomness: the patterns take a *rand.Rand. A test seeds it, so the "random" latencies are the same in every run
+2. Time: the patterns take a Clock instead of calling the time package. RealClock calls the time package. FakeClock has its own time that only moves when the test calls Advance
+
+genericscondemo.go has a ManualClock with just Now and After, enough for its retry and timeout decorators. Clock here has everything the patterns use: Now, Since, Sleep, After, timers, tickers, AfterFunc, and contexts with a deadline (WithTimeout, WithDeadline) that expire in the clock's time, not in real time.
+
+How a test drives a FakeClock:
+
+BlockUntil(n) waits until n timers are waiting. Without it, a test could Advance before the goroutine under test has even called Sleep, and the Advance would be lost
+Advance(d) moves the clock forward d, firing every timer on the way in time order, each at its own time
+AdvanceToNext() moves the clock to the next timer and fires just that one
+
+Advance fires timers in order, but the goroutines they wake up still run whenever the scheduler likes. If two timers fire in one Advance, the goroutines can see them in either order. AdvanceToNext fires one at a time, so a test can wait for the effect of each before firing the next, and every run sees the same order.
+
+AfterFunc functions run in the goroutine that called Advance, before Advance returns (with the time package they get a goroutine of their own). That makes them deterministic too.
+
+main ports the four programs to take a Clock and a *rand.Rand, and checks every branch of each, in no real time.
+
+go run virtualclock.go
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Timer is a *time.Timer from a Clock.
+type Timer interface {
+	// C is the channel the time is sent on. It is nil for a timer made by AfterFunc.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if it had already fired or been stopped.
+	Stop() bool
+	// Reset makes the timer fire d from now. It returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a *time.Ticker from a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// Clock is everything timing code needs from the time and context packages.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+	WithDeadline(parent context.Context, d time.Time) (context.Context, context.CancelFunc)
+	WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+type realClock struct{}
+
+// RealClock is the Clock that uses the time package.
+var RealClock Clock = realClock{}
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time   { return t.t.C }
+func (t realTicker) Stop()                 { t.t.Stop() }
+func (t realTicker) Reset(d time.Duration) { t.t.Reset(d) }
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+func (realClock) WithDeadline(parent context.Context, d time.Time) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(parent, d)
+}
+func (realClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, d)
+}
+
+// FakeClock is a Clock whose time only moves when Advance or AdvanceToNext is called.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+	//seq breaks ties between timers due at the same moment: the one made first fires first
+	seq uint64
+}
+
+// NewFakeClock returns a FakeClock set to start.
+func NewFakeClock(start time.Time) *FakeClock {
+	c := &FakeClock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// fakeTimer is a timer, a ticker (period > 0) or an AfterFunc (fn != nil) on a FakeClock.
+type fakeTimer struct {
+	clock  *FakeClock
+	at     time.Time
+	seq    uint64
+	period time.Duration
+	ch     chan time.Time
+	fn     func()
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// add registers t to fire d from now. c.mu must be held.
+func (c *FakeClock) add(t *fakeTimer, d time.Duration) {
+	c.seq++
+	t.at, t.seq = c.now.Add(d), c.seq
+	c.timers = append(c.timers, t)
+	sort.Slice(c.timers, func(i, j int) bool {
+		a, b := c.timers[i], c.timers[j]
+		if !a.at.Equal(b.at) {
+			return a.at.Before(b.at)
+		}
+		return a.seq < b.seq
+	})
+	c.cond.Broadcast()
+}
+
+// remove unregisters t and reports whether it was registered. c.mu must be held.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	i := slices.Index(c.timers, t)
+	if i < 0 {
+		return false
+	}
+	c.timers = slices.Delete(c.timers, i, i+1)
+	return true
+}
+
+func (c *FakeClock) newTimer(d time.Duration, period time.Duration, fn func()) *fakeTimer {
+	t := &fakeTimer{clock: c, period: period, fn: fn}
+	if fn == nil {
+		//buffered like the time package's channels: a timer never blocks the clock, and a tick nobody reads is dropped
+		t.ch = make(chan time.Time, 1)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(t, d)
+	return t
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0, nil)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.newTimer(d, 0, nil).ch
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.newTimer(d, 0, f)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.newTimer(d, d, nil)}
+}
+
+// fakeTicker is a fakeTimer with a period, with the methods of a Ticker.
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop()                 { t.fakeTimer.Stop() }
+func (t fakeTicker) Reset(d time.Duration) { t.fakeTimer.Reset(d) }
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.remove(t)
+	if t.period > 0 {
+		t.period = d
+	}
+	t.clock.add(t, d)
+	return active
+}
+
+// fire sends on or runs the earliest timer if it is due at or before until, and moves the clock to it.
+// It reports whether there was one.
+func (c *FakeClock) fire(until time.Time) bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 || c.timers[0].at.After(until) {
+		c.mu.Unlock()
+		return false
+	}
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+	c.now = t.at
+	now := c.now
+	if t.period > 0 {
+		c.add(t, t.period)
+	}
+	c.mu.Unlock()
+
+	if t.fn != nil {
+		t.fn()
+		return true
+	}
+	select {
+	case t.ch <- now:
+	default:
+	}
+	return true
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due on the way, in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	until := c.now.Add(d)
+	c.mu.Unlock()
+	for c.fire(until) {
+	}
+	c.mu.Lock()
+	c.now = until
+	c.mu.Unlock()
+}
+
+// AdvanceToNext moves the clock to the next timer and fires it, and returns how far the clock moved.
+// With no timers waiting it does nothing and returns 0.
+func (c *FakeClock) AdvanceToNext() time.Duration {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return 0
+	}
+	at, from := c.timers[0].at, c.now
+	c.mu.Unlock()
+	c.fire(at)
+	return at.Sub(from)
+}
+
+// BlockUntil waits until at least n timers (including tickers and AfterFuncs) are waiting to fire.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// clockCtx is a context that the clock's AfterFunc cancels at its deadline.
+// It has its own done channel and error rather than wrapping a cancelCtx, so a context derived from it
+// (context.WithCancel, WithValue and so on) reads Err from it and sees DeadlineExceeded too.
+type clockCtx struct {
+	parent   context.Context
+	deadline time.Time
+	done     chan struct{}
+
+	mu    sync.Mutex
+	err   error
+	timer Timer       //the clock's AfterFunc, nil once the deadline had passed
+	stop  func() bool //stops the propagation of the parent's cancellation
+}
+
+func (c *clockCtx) Deadline() (time.Time, bool) { return c.deadline, true }
+func (c *clockCtx) Done() <-chan struct{}       { return c.done }
+func (c *clockCtx) Value(key any) any           { return c.parent.Value(key) }
+
+func (c *clockCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// cancel ends the context with err, the first time only, and releases the timer and the parent hook.
+func (c *clockCtx) cancel(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	timer, stop := c.timer, c.stop
+	c.mu.Unlock()
+	if timer != nil {
+		timer.Stop()
+	}
+	if stop != nil {
+		stop()
+	}
+}
+
+func (c *FakeClock) WithDeadline(parent context.Context, d time.Time) (context.Context, context.CancelFunc) {
+	if cur, ok := parent.Deadline(); ok && cur.Before(d) {
+		//the parent ends first anyway
+		return context.WithCancel(parent)
+	}
+	ctx := &clockCtx{parent: parent, deadline: d, done: make(chan struct{})}
+	cancel := func() { ctx.cancel(context.Canceled) }
+	if !d.After(c.Now()) {
+		ctx.cancel(context.DeadlineExceeded)
+		return ctx, cancel
+	}
+	//the hooks are installed under mu, so a cancel that races with them still releases both
+	ctx.mu.Lock()
+	ctx.timer = c.AfterFunc(d.Sub(c.Now()), func() { ctx.cancel(context.DeadlineExceeded) })
+	ctx.stop = context.AfterFunc(parent, func() { ctx.cancel(parent.Err()) })
+	ctx.mu.Unlock()
+	return ctx, cancel
+}
+
+func (c *FakeClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return c.WithDeadline(parent, c.Now().Add(d))
+}
+
+// cancellation is conpatterncancelcontext.go: a worker with a random latency of up to 200ms against a timeout.
+func cancellation(clk Clock, rng *rand.Rand, timeout time.Duration) string {
+	ctx, cancel := clk.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	latency := time.Duration(rng.IntN(200)) * time.Millisecond
+	ch := make(chan string, 1)
+	go func() {
+		clk.Sleep(latency)
+		ch <- "paper"
+	}()
+	select {
+	case d := <-ch:
+		return "work complete " + d
+	case <-ctx.Done():
+		return "work cancelled: " + ctx.Err().Error()
+	}
+}
+
+// fanOut is conpatternfanout.go: every employee works for a random time and then sends its number. The latencies are
+// drawn before the goroutines start, so the order of the draws does not depend on the scheduler.
+func fanOut(clk Clock, rng *rand.Rand, employees int) <-chan int {
+	ch := make(chan int, employees)
+	for e := 0; e < employees; e++ {
+		latency := time.Duration(rng.IntN(200)) * time.Millisecond
+		go func() {
+			clk.Sleep(latency)
+			ch <- e
+		}()
+	}
+	return ch
+}
+
+// selectTwo is selectchannels.go: two results after 1 and 2 seconds, received with select. It passes on what it
+// receives as it receives it, so a test can check the first before the second is sent.
+func selectTwo(clk Clock, got chan<- string) {
+	c1 := make(chan string)
+	c2 := make(chan string)
+	go func() {
+		clk.Sleep(1 * time.Second)
+		c1 <- "one"
+	}()
+	go func() {
+		clk.Sleep(2 * time.Second)
+		c2 <- "two"
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case msg1 := <-c1:
+			got <- "received " + msg1
+		case msg2 := <-c2:
+			got <- "received " + msg2
+		}
+	}
+}
+
+// worker is done.go's worker.
+func worker(clk Clock, done chan bool) {
+	clk.Sleep(time.Second)
+	done <- true
+}
+
+// check stands in for a test assertion.
+func check(name string, got, want any) {
+	if fmt.Sprint(got) == fmt.Sprint(want) {
+		fmt.Printf("  ok   %s: %v\n", name, got)
+		return
+	}
+	fmt.Printf("  FAIL %s: got %v, want %v\n", name, got, want)
+}
+
+func main() {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	began := time.Now()
+
+	//conpatterncancelcontext.go, both branches. With seed 1 the latency is 119ms, with seed 14 it is 183ms.
+	for _, seed := range []uint64{1, 14} {
+		clk := NewFakeClock(start)
+		result := make(chan string)
+		go func() { result <- cancellation(clk, rand.New(rand.NewPCG(seed, 0)), 150*time.Millisecond) }()
+		//the worker's Sleep and the context's deadline
+		clk.BlockUntil(2)
+		//only the earlier of the two fires, so select never sees both ready at once
+		clk.AdvanceToNext()
+		check(fmt.Sprintf("cancellation, seed %d, at +%v", seed, clk.Since(start)), <-result, map[uint64]string{
+			1:  "work complete paper",
+			14: "work cancelled: context deadline exceeded",
+		}[seed])
+	}
+
+	//conpatternfanout.go: the same seed gives the same order, every run
+	order := func(seed uint64) []int {
+		clk := NewFakeClock(start)
+		ch := fanOut(clk, rand.New(rand.NewPCG(seed, 0)), 5)
+		var got []int
+		for i := 0; i < 5; i++ {
+			clk.BlockUntil(5 - i)
+			clk.AdvanceToNext()
+			got = append(got, <-ch)
+		}
+		return got
+	}
+	first := order(42)
+	check("fan out, seed 42, twice", order(42), first)
+
+	//selectchannels.go: 2 seconds of sleeping, in no real time at all. Advance(2 * time.Second) in one go would wake
+	//both senders at once, and select could then pick either; one second at a time, it can only be "one" first
+	clk := NewFakeClock(start)
+	got := make(chan string)
+	go selectTwo(clk, got)
+	clk.BlockUntil(2)
+	clk.Advance(time.Second)
+	check("select at 1s", <-got, "received one")
+	clk.Advance(time.Second)
+	check("select at 2s", <-got, "received two")
+
+	//done.go: the worker is not done before 1s, and is done at 1s
+	clk = NewFakeClock(start)
+	done := make(chan bool, 1)
+	go worker(clk, done)
+	clk.BlockUntil(1)
+	clk.Advance(999 * time.Millisecond)
+	select {
+	case <-done:
+		check("done before 1s", true, false)
+	default:
+		check("done before 1s", false, false)
+	}
+	clk.Advance(time.Millisecond)
+	check("done at 1s", <-done, true)
+
+	//tickers drop ticks nobody reads, like time.Ticker: 3.5 ticks' worth of Advance, one tick in the channel
+	clk = NewFakeClock(start)
+	tk := clk.NewTicker(time.Second)
+	clk.Advance(3500 * time.Millisecond)
+	ticks := 0
+	for len(tk.C()) > 0 {
+		<-tk.C()
+		ticks++
+	}
+	check("unread ticks", ticks, 1)
+	tk.Stop()
+
+	//AfterFunc runs inside Advance, so its effect is visible as soon as Advance returns
+	var fired []string
+	clk.AfterFunc(2*time.Second, func() { fired = append(fired, "second") })
+	clk.AfterFunc(time.Second, func() { fired = append(fired, "first") })
+	t := clk.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	t.Stop()
+	clk.Advance(5 * time.Second)
+	check("AfterFunc order", fired, []string{"first", "second"})
+
+	//a context with a virtual deadline
+	ctx, cancel := clk.WithTimeout(context.Background(), time.Minute)
+	deadline, _ := ctx.Deadline()
+	child, cancelChild := context.WithCancel(ctx)
+	defer cancelChild()
+	clk.Advance(59 * time.Second)
+	check("ctx before its deadline", ctx.Err(), nil)
+	clk.Advance(time.Second)
+	check("ctx at its deadline", ctx.Err(), context.DeadlineExceeded)
+	<-child.Done()
+	check("child of ctx at its deadline", child.Err(), context.DeadlineExceeded)
+	//and a cancelled parent ends a virtual-deadline ctx with the parent's error
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx2, cancel2 := clk.WithTimeout(parent, time.Minute)
+	defer cancel2()
+	cancelParent()
+	<-ctx2.Done()
+	check("ctx of a cancelled parent", ctx2.Err(), context.Canceled)
+	//the ticker and AfterFunc checks moved the clock 8.5s before the context was made
+	check("deadline", deadline.Sub(start), 8500*time.Millisecond+time.Minute)
+	cancel()
+
+	fmt.Println("real time taken under a second:", time.Since(began) < time.Second)
+}
+
+/*
+Result
+go run virtualclock.go
+
+  ok   cancellation, seed 1, at +119ms: work complete paper
+  ok   cancellation, seed 14, at +150ms: work cancelled: context deadline exceeded
+  ok   fan out, seed 42, twice: [3 2 4 0 1]
+  ok   select at 1s: received one
+  ok   select at 2s: received two
+  ok   done before 1s: false
+  ok   done at 1s: true
+  ok   unread ticks: 1
+  ok   AfterFunc order: [first second]
+  ok   ctx before its deadline: <nil>
+  ok   ctx at its deadline: context deadline exceeded
+  ok   child of ctx at its deadline: context deadline exceeded
+  ok   ctx of a cancelled parent: context canceled
+  ok   deadline: 1m8.5s
+real time taken under a second: true
+*/
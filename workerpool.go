@@ -0,0 +1,574 @@
+//Worker pool: waitgroups.go's five workers, made into something jobs can be submitted to
+/*
+waitgroups.go starts five goroutines, one per job, and waits for them with a WaitGroup. done.go waits for one worker with a channel. That works when the jobs are known up front and there are few of them. A service gets jobs all day long, and wants more control over them:
+
+1. A fixed number of workers, and a queue in front of them. The queue is kept sorted by priority (highest first, first in first out within a priority), as DropQueue in dropqueue.go does for DropLowestPriority
+2. Every job runs with its own context: it comes from the ctx passed to Submit (so a caller that gives up also cancels a job that is still queued: it leaves the queue at once, even while the pool is paused, and never takes a rate-limit token), with the job's Timeout on top
+3. Rate limits, as token buckets: one for the whole pool (say, 100 jobs a second against an API) and one per Job.Key (say, 5 a second per customer). When the job at the front is held back by its key's limit, a worker takes the next job whose key is not, so one busy customer does not hold up everyone else. A key's bucket is forgotten once it is full again (a full bucket is no different from a new one), so a pool that sees a million customers does not keep a million buckets
+4. Pause stops workers from starting new jobs (jobs already running finish); Resume lets them go on
+5. Shutdown(ctx) stops taking jobs and waits for the workers to finish everything queued and running. If ctx ends first, it cancels the jobs that are still running and returns an *UnfinishedError that lists what did not finish
+6. Stats counts jobs queued, running, succeeded and failed, at any moment
+
+Workers wait on a sync.Cond. A Cond has no timeout, so when every queued job is held back by a rate limit, the worker sets a timer (time.AfterFunc) to wake everyone when the next token is due.
+
+go run workerpool.go
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrPoolClosed is returned by Submit after Shutdown.
+	ErrPoolClosed = errors.New("workerpool: closed")
+	// ErrQueueFull is returned by Submit when the queue is at its capacity.
+	ErrQueueFull = errors.New("workerpool: queue full")
+)
+
+// Job is one piece of work.
+type Job struct {
+	// Name identifies the job in an UnfinishedError.
+	Name string
+	// Priority orders the queue: higher runs first.
+	Priority int
+	// Key is what the per-key rate limit counts by. Empty means the job has no key limit.
+	Key string
+	// Timeout, if set, limits how long Run may take.
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// PoolConfig configures a Pool.
+type PoolConfig struct {
+	// Workers is how many jobs run at once. Less than 1 means 1.
+	Workers int
+	// QueueSize is how many jobs may wait. Zero means no limit.
+	QueueSize int
+	// Rate is how many jobs per second the pool starts, with bursts of up to Burst. Zero means no limit.
+	Rate  float64
+	Burst int
+	// KeyRate and KeyBurst are the same limit for each Job.Key on its own.
+	KeyRate  float64
+	KeyBurst int
+}
+
+// tokenBucket holds up to burst tokens and gains rate of them per second. A job may start if it can take one.
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(max(1, burst))
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// ready returns how long until a token is there; 0 means now.
+func (b *tokenBucket) ready(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// JobHandle follows one submitted job.
+type JobHandle struct {
+	done chan struct{}
+	err  error
+}
+
+// Done is closed when the job has finished, or will never run.
+func (h *JobHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns what Run returned, the context error if the job's context ended while it was queued, or ErrPoolClosed
+// if the pool shut down before it ran. It may only be called after Done is closed.
+func (h *JobHandle) Err() error {
+	return h.err
+}
+
+// Wait waits for the job to finish, or for ctx.
+func (h *JobHandle) Wait(ctx context.Context) error {
+	select {
+	case <-h.done:
+		return h.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type queuedJob struct {
+	job    Job
+	ctx    context.Context
+	handle *JobHandle
+	//stop stops the AfterFunc that takes the job out of the queue when ctx ends
+	stop func() bool
+}
+
+// PoolStats is a Pool's counters at one moment.
+type PoolStats struct {
+	Queued, Running      int
+	Succeeded, Failed    uint64
+	Paused, ShuttingDown bool
+}
+
+// UnfinishedError lists the jobs a Shutdown did not wait for.
+type UnfinishedError struct {
+	// Queued never started. Running were cancelled.
+	Queued, Running []string
+}
+
+func (e *UnfinishedError) Error() string {
+	return fmt.Sprintf("workerpool: shutdown before %d queued and %d running jobs finished (queued: %s; running: %s)",
+		len(e.Queued), len(e.Running), strings.Join(e.Queued, ", "), strings.Join(e.Running, ", "))
+}
+
+// Pool runs submitted jobs on a fixed number of workers.
+type Pool struct {
+	cfg PoolConfig
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*queuedJob
+	running map[*queuedJob]struct{}
+	paused  bool
+	closed  bool
+	global  *tokenBucket
+	keys    map[string]*tokenBucket
+	pruned  time.Time
+	wake    *time.Timer
+	wakeAt  time.Time
+	wg      sync.WaitGroup
+
+	//stop cancels every running job, when Shutdown runs out of time
+	stop      context.Context
+	stopAll   context.CancelFunc
+	succeeded atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// NewPool starts cfg.Workers workers.
+func NewPool(cfg PoolConfig) *Pool {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	p := &Pool{cfg: cfg, running: make(map[*queuedJob]struct{}), keys: make(map[string]*tokenBucket)}
+	p.cond = sync.NewCond(&p.mu)
+	p.stop, p.stopAll = context.WithCancel(context.Background())
+	if cfg.Rate > 0 {
+		p.global = newTokenBucket(cfg.Rate, cfg.Burst, time.Now())
+	}
+	p.wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Submit queues job. ctx is the parent of the job's context: if it ends while the job is queued, the job does not run.
+func (p *Pool) Submit(ctx context.Context, job Job) (*JobHandle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	if p.cfg.QueueSize > 0 && len(p.queue) >= p.cfg.QueueSize {
+		return nil, ErrQueueFull
+	}
+	q := &queuedJob{job: job, ctx: ctx, handle: &JobHandle{done: make(chan struct{})}}
+	//insert after every job of the same or higher priority, so equal priorities stay first in, first out
+	i := sort.Search(len(p.queue), func(i int) bool { return p.queue[i].job.Priority < job.Priority })
+	p.queue = append(p.queue, nil)
+	copy(p.queue[i+1:], p.queue[i:])
+	p.queue[i] = q
+	//no worker looks at the queue while the pool is paused or rate limited, so the job cannot wait for one to notice
+	q.stop = context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if i := slices.Index(p.queue, q); i >= 0 {
+			p.drop(i, ctx.Err())
+		}
+	})
+	p.cond.Signal()
+	return q.handle, nil
+}
+
+// drop takes the job at i out of the queue and finishes its handle with err. p.mu must be held.
+func (p *Pool) drop(i int, err error) {
+	q := p.queue[i]
+	p.queue = slices.Delete(p.queue, i, i+1)
+	q.stop()
+	q.handle.err = err
+	close(q.handle.done)
+}
+
+// next takes the first job that the rate limits let start. If there is none, it returns how long until one might be.
+// p.mu must be held.
+func (p *Pool) next(now time.Time) (*queuedJob, time.Duration) {
+	//a job whose caller has given up must not use up a token; its AfterFunc may not have run yet
+	for i := len(p.queue) - 1; i >= 0; i-- {
+		if err := p.queue[i].ctx.Err(); err != nil {
+			p.drop(i, err)
+		}
+	}
+	p.prune(now)
+	if p.global != nil {
+		if d := p.global.ready(now); d > 0 {
+			return nil, d
+		}
+	}
+	wait := time.Duration(-1)
+	for i, q := range p.queue {
+		var b *tokenBucket
+		if p.cfg.KeyRate > 0 && q.job.Key != "" {
+			b = p.keys[q.job.Key]
+			if b == nil {
+				b = newTokenBucket(p.cfg.KeyRate, p.cfg.KeyBurst, now)
+				p.keys[q.job.Key] = b
+			}
+			if d := b.ready(now); d > 0 {
+				if wait < 0 || d < wait {
+					wait = d
+				}
+				continue
+			}
+			b.take()
+		}
+		if p.global != nil {
+			p.global.take()
+		}
+		p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		q.stop()
+		return q, 0
+	}
+	return nil, wait
+}
+
+// prune forgets the key buckets that are full. It looks at most once per the time a bucket takes to fill up, since
+// a bucket that has been idle that long is full. p.mu must be held.
+func (p *Pool) prune(now time.Time) {
+	if p.cfg.KeyRate <= 0 || now.Sub(p.pruned).Seconds() < float64(max(1, p.cfg.KeyBurst))/p.cfg.KeyRate {
+		return
+	}
+	p.pruned = now
+	for key, b := range p.keys {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(p.keys, key)
+		}
+	}
+}
+
+// sleep waits on the Cond for at most d. One timer wakes every worker, so it is only replaced by an earlier one.
+// p.mu must be held.
+func (p *Pool) sleep(d time.Duration) {
+	at := time.Now().Add(d)
+	if p.wake == nil || at.Before(p.wakeAt) {
+		if p.wake != nil {
+			p.wake.Stop()
+		}
+		var t *time.Timer
+		t = time.AfterFunc(d, func() {
+			p.mu.Lock()
+			if p.wake == t {
+				p.wake = nil
+			}
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+		p.wake, p.wakeAt = t, at
+	}
+	p.cond.Wait()
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	p.mu.Lock()
+	for {
+		if len(p.queue) == 0 && p.closed {
+			p.mu.Unlock()
+			return
+		}
+		if len(p.queue) == 0 || p.paused {
+			p.cond.Wait()
+			continue
+		}
+		q, wait := p.next(time.Now())
+		if q == nil {
+			if wait >= 0 {
+				p.sleep(wait)
+			}
+			//else next dropped every job there was
+			continue
+		}
+		p.running[q] = struct{}{}
+		p.mu.Unlock()
+
+		err := p.run(q)
+
+		p.mu.Lock()
+		delete(p.running, q)
+		q.handle.err = err
+		close(q.handle.done)
+		//a Shutdown may be waiting for the last running job
+		p.cond.Broadcast()
+	}
+}
+
+func (p *Pool) run(q *queuedJob) (err error) {
+	if err := q.ctx.Err(); err != nil {
+		//the caller gave up while the job was queued; it neither succeeded nor failed
+		return err
+	}
+	ctx, cancel := context.WithCancel(q.ctx)
+	defer cancel()
+	stop := context.AfterFunc(p.stop, cancel)
+	defer stop()
+	if q.job.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, q.job.Timeout)
+		defer cancelTimeout()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("workerpool: job %s panicked: %v", q.job.Name, v)
+		}
+		if err != nil {
+			p.failed.Add(1)
+		} else {
+			p.succeeded.Add(1)
+		}
+	}()
+	return q.job.Run(ctx)
+}
+
+// Pause stops workers from starting jobs. Running jobs go on.
+func (p *Pool) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+}
+
+// Resume lets workers start jobs again.
+func (p *Pool) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = false
+	p.cond.Broadcast()
+}
+
+// Stats returns the counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		Queued:       len(p.queue),
+		Running:      len(p.running),
+		Succeeded:    p.succeeded.Load(),
+		Failed:       p.failed.Load(),
+		Paused:       p.paused,
+		ShuttingDown: p.closed,
+	}
+}
+
+// Shutdown stops taking jobs and waits until everything queued and running has finished. A paused pool is resumed,
+// so that its queue can drain. If ctx ends first, the jobs still queued are dropped (their Err is ErrPoolClosed),
+// the running ones are cancelled, and Shutdown returns an *UnfinishedError naming them both. It still waits for the
+// cancelled jobs to return, so a job that ignores its context keeps Shutdown waiting.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.paused = false
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	ue := &UnfinishedError{}
+	for _, q := range p.queue {
+		ue.Queued = append(ue.Queued, q.job.Name)
+		q.stop()
+		q.handle.err = ErrPoolClosed
+		close(q.handle.done)
+	}
+	p.queue = nil
+	for q := range p.running {
+		ue.Running = append(ue.Running, q.job.Name)
+	}
+	sort.Strings(ue.Running)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.stopAll()
+	//the running jobs have been cancelled; wait for the workers to notice, so no goroutine outlives Shutdown
+	<-drained
+	return ue
+}
+
+func main() {
+	ctx := context.Background()
+
+	//waitgroups.go: five jobs of one second each, here 100ms, on five workers
+	pool := NewPool(PoolConfig{Workers: 5})
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		pool.Submit(ctx, Job{Name: fmt.Sprint("worker ", i), Run: func(ctx context.Context) error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		}})
+	}
+	time.Sleep(10 * time.Millisecond)
+	fmt.Printf("stats while running: %+v\n", pool.Stats())
+	pool.Shutdown(ctx)
+	fmt.Printf("after Shutdown: %+v, took ~%v\n", pool.Stats(), time.Since(start).Round(100*time.Millisecond))
+
+	//priorities: queue while paused, then resume; one worker takes them highest first
+	pool = NewPool(PoolConfig{Workers: 1})
+	pool.Pause()
+	var mu sync.Mutex
+	var order []string
+	for i, prio := range []int{1, 5, 1, 9, 5} {
+		name := fmt.Sprintf("job%d(p%d)", i, prio)
+		pool.Submit(ctx, Job{Name: name, Priority: prio, Run: func(ctx context.Context) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}})
+	}
+	fmt.Printf("paused: %+v\n", pool.Stats())
+	//a job whose caller gives up leaves the queue straight away, paused or not
+	jobCtx, cancelJob := context.WithCancel(ctx)
+	gone, _ := pool.Submit(jobCtx, Job{Name: "gone", Priority: 9, Run: func(ctx context.Context) error {
+		mu.Lock()
+		order = append(order, "gone")
+		mu.Unlock()
+		return nil
+	}})
+	cancelJob()
+	<-gone.Done()
+	fmt.Println("cancelled while paused:", gone.Err(), "still queued:", pool.Stats().Queued)
+	pool.Resume()
+	pool.Shutdown(ctx)
+	fmt.Println("priority order:", order)
+
+	//rate limits: 20 jobs a second overall, and 5 a second for the noisy customer; the quiet one is not held up by it
+	pool = NewPool(PoolConfig{Workers: 4, Rate: 20, Burst: 1, KeyRate: 5, KeyBurst: 1})
+	start = time.Now()
+	var quietDone, noisyDone atomic.Int64
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{"noisy", "noisy", "quiet"} {
+			counter := &noisyDone
+			if key == "quiet" {
+				counter = &quietDone
+			}
+			pool.Submit(ctx, Job{Name: key, Key: key, Run: func(ctx context.Context) error {
+				counter.Store(int64(time.Since(start)))
+				return nil
+			}})
+		}
+	}
+	pool.Shutdown(ctx)
+	fmt.Printf("rate limited: 5 quiet jobs done after ~%v (their own limit), 10 noisy after ~%v\n",
+		time.Duration(quietDone.Load()).Round(100*time.Millisecond), time.Duration(noisyDone.Load()).Round(100*time.Millisecond))
+
+	//100 customers once each: their buckets are dropped again once they are full, 10ms later
+	pool = NewPool(PoolConfig{Workers: 4, KeyRate: 100, KeyBurst: 1})
+	var handles []*JobHandle
+	for i := range 100 {
+		h, _ := pool.Submit(ctx, Job{Name: "once", Key: fmt.Sprint("customer", i), Run: func(ctx context.Context) error { return nil }})
+		handles = append(handles, h)
+	}
+	for _, h := range handles {
+		h.Wait(ctx)
+	}
+	time.Sleep(20 * time.Millisecond)
+	h, _ := pool.Submit(ctx, Job{Name: "later", Key: "customer100", Run: func(ctx context.Context) error { return nil }})
+	h.Wait(ctx)
+	pool.mu.Lock()
+	fmt.Println("key buckets after 101 customers:", len(pool.keys))
+	pool.mu.Unlock()
+	pool.Shutdown(ctx)
+
+	//per-job timeouts and failures
+	pool = NewPool(PoolConfig{Workers: 2})
+	slow, _ := pool.Submit(ctx, Job{Name: "slow", Timeout: 20 * time.Millisecond, Run: func(ctx context.Context) error {
+		select {
+		case <-time.After(time.Second):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}})
+	boom, _ := pool.Submit(ctx, Job{Name: "boom", Run: func(ctx context.Context) error { panic("out of ice cream") }})
+	fmt.Println("slow:", slow.Wait(ctx))
+	fmt.Println("boom:", boom.Wait(ctx))
+	fmt.Printf("stats: %+v\n", pool.Stats())
+	pool.Shutdown(ctx)
+
+	//a Shutdown that runs out of time: every job runs until its context ends, and there is one worker, so one job runs and three stay queued
+	pool = NewPool(PoolConfig{Workers: 1})
+	for i := 0; i < 4; i++ {
+		pool.Submit(ctx, Job{Name: fmt.Sprint("cone", i), Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}})
+	}
+	time.Sleep(10 * time.Millisecond)
+	sctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err := pool.Shutdown(sctx)
+	fmt.Println(err)
+	_, err = pool.Submit(ctx, Job{Name: "late"})
+	fmt.Println("submit after Shutdown:", err)
+}
+
+/*
+Result
+go run workerpool.go
+
+stats while running: {Queued:0 Running:5 Succeeded:0 Failed:0 Paused:false ShuttingDown:false}
+after Shutdown: {Queued:0 Running:0 Succeeded:5 Failed:0 Paused:false ShuttingDown:true}, took ~100ms
+paused: {Queued:5 Running:0 Succeeded:0 Failed:0 Paused:true ShuttingDown:false}
+cancelled while paused: context canceled still queued: 5
+priority order: [job3(p9) job1(p5) job4(p5) job0(p1) job2(p1)]
+rate limited: 5 quiet jobs done after ~900ms (their own limit), 10 noisy after ~1.8s
+key buckets after 101 customers: 1
+slow: context deadline exceeded
+boom: workerpool: job boom panicked: out of ice cream
+stats: {Queued:0 Running:0 Succeeded:0 Failed:2 Paused:false ShuttingDown:false}
+workerpool: shutdown before 3 queued and 1 running jobs finished (queued: cone1, cone2, cone3; running: cone0)
+submit after Shutdown: workerpool: closed
+
+(the rate-limited times change a little from run to run)
+*/